@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"jmux/internal/audit"
+	"jmux/internal/jcat"
+)
+
+var (
+	auditUser    string
+	auditSession string
+	auditSince   string
+	auditJSON    bool
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show who joined which shared session",
+	Long: `Show the audit log of shared sessions: every guest that joined, left or
+was turned away, when, from where, in which mode, for how long and how many
+bytes moved.
+
+Each record is hashed together with the one before it, so editing, removing
+or reordering records is caught by 'dmux audit verify'.
+
+Examples:
+  dmux audit                         # Everything
+  dmux audit --user bob --since 24h  # bob's connections, as guest or host, today
+  dmux audit --since 2024-05-01      # Since a date
+  dmux audit --json                  # Raw records, one JSON object per line`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := parseSince(auditSince)
+		if err != nil {
+			cmd.Printf("Error: %v\n", err)
+			return
+		}
+
+		records, err := audit.Read(cfg.AuditFile)
+		if err != nil {
+			cmd.Printf("Error reading audit log: %v\n", err)
+			return
+		}
+
+		shown := 0
+		encoder := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if r.Time.Before(since) || (auditUser != "" && r.User != auditUser && r.Host != auditUser) ||
+				(auditSession != "" && r.Session != auditSession) {
+				continue
+			}
+			shown++
+			if auditJSON {
+				encoder.Encode(r)
+			} else {
+				printAuditRecord(r)
+			}
+		}
+		if shown == 0 && !auditJSON {
+			color.Yellow("No matching audit records")
+		}
+	},
+}
+
+// auditVerifyCmd checks the audit log's hash chain
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the audit log for tampering",
+	Long: `Check that no record of the audit log was edited, removed or reordered.
+
+The hash of the last record is printed; keep it somewhere else to also
+catch records being cut off the end later.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		count, head, err := audit.Verify(cfg.AuditFile)
+		if err != nil {
+			color.Red("✗ Audit log %s has been tampered with: %v", cfg.AuditFile, err)
+			os.Exit(1)
+		}
+		color.Green("✓ Audit log intact: %d records", count)
+		if head != "" {
+			fmt.Printf("  Last record: %s\n", head)
+		}
+	},
+}
+
+// parseSince reads --since as a duration back from now or as a date
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q: use a duration such as 24h or a date such as 2024-05-01", value)
+}
+
+// printAuditRecord prints one audit record on a line
+func printAuditRecord(r audit.Record) {
+	guest := r.User
+	if guest == "" {
+		guest = "?"
+	}
+	what := fmt.Sprintf("%s → %s/%s", guest, r.Host, r.Session)
+	if r.Session == "" {
+		what = fmt.Sprintf("%s → %s", guest, r.Host)
+	}
+	if r.Exec {
+		what += " (exec)"
+	}
+	if r.Invite != "" {
+		what += " (invite " + r.Invite + ")"
+	}
+	stamp := r.Time.Local().Format("2006-01-02 15:04:05")
+
+	switch r.Event {
+	case audit.EventJoin:
+		color.Green("%s  join     %s from %s in %s mode", stamp, what, r.Remote, r.Mode)
+	case audit.EventLeave:
+		duration := time.Duration(r.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Printf("%s  leave    %s from %s after %s, %s in, %s out\n", stamp, what, r.Remote,
+			duration, jcat.FormatSize(r.BytesIn), jcat.FormatSize(r.BytesOut))
+	case audit.EventRefused:
+		color.Yellow("%s  refused  %s from %s: %s", stamp, what, r.Remote, r.Reason)
+	case audit.EventAuthFailed:
+		color.Red("%s  auth     %s from %s: %s", stamp, what, r.Remote, r.Reason)
+	default:
+		fmt.Printf("%s  %-8s %s from %s\n", stamp, r.Event, what, r.Remote)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+
+	auditCmd.Flags().StringVar(&auditUser, "user", "", "Only records where this user is the guest or the host")
+	auditCmd.Flags().StringVar(&auditSession, "session", "", "Only records of this session")
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "Only records since a duration ago (24h) or a date (2024-05-01)")
+	auditCmd.Flags().BoolVar(&auditJSON, "json", false, "Print the raw records as JSON lines")
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"jmux/internal/security"
+)
+
+// caCmd represents the ca command
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the team certificate authority for TLS shares",
+	Long: `Manage the team certificate authority (CA) that 'dmux share --tls' relies on.
+
+Under TLS, hosts and guests prove who they are with certificates issued by
+the team CA, and the host learns each guest's name from its certificate
+rather than trusting what the guest says.
+
+The CA lives in the shared directory. Only whoever ran 'dmux ca init' can
+read its key, so only they issue and revoke certificates. Everyone keeps
+their own private key in their config directory and only publishes a
+request for it.
+
+Examples:
+  dmux ca init          # Create the team CA (once per team)
+  dmux ca request       # Ask for a certificate for your key
+  dmux ca issue bob     # Sign bob's request (CA owner only)
+  dmux ca revoke bob    # Lock bob out of TLS shares (CA owner only)`,
+}
+
+// caInitCmd creates the team CA
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create the team CA in the shared directory",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ca := security.NewCA(cfg.CADir)
+		cert, err := ca.Init(os.Getenv("USER"))
+		if err != nil {
+			cmd.Printf("Error creating CA: %v\n", err)
+			return
+		}
+		color.Green("✓ Created %s in %s, valid until %s", cert.Subject.CommonName, cfg.CADir, cert.NotAfter.Format("2006-01-02"))
+		color.Cyan("Issue your own certificate with: dmux ca issue %s", os.Getenv("USER"))
+	},
+}
+
+// caRequestCmd publishes a signing request for the user's key
+var caRequestCmd = &cobra.Command{
+	Use:   "request",
+	Short: "Request a certificate from the team CA",
+	Long: `Create your private key, if you have none yet, in your config directory
+and publish a request for a certificate for it, which the CA owner signs
+with 'dmux ca issue'. The private key never leaves your config directory.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		user := os.Getenv("USER")
+		if err := requestCert(user); err != nil {
+			cmd.Printf("Error requesting certificate: %v\n", err)
+			return
+		}
+		color.Green("✓ Requested a certificate for %s", user)
+		color.Cyan("Ask the CA owner to run: dmux ca issue %s", user)
+	},
+}
+
+// caIssueCmd signs a user's request
+var caIssueCmd = &cobra.Command{
+	Use:   "issue <user>",
+	Short: "Issue a certificate to a user (CA owner only)",
+	Long: `Sign the certificate request user made with 'dmux ca request'. The
+certificate lets user host TLS shares and join those of others.
+
+Issuing to yourself makes the request for you.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		user := args[0]
+		ca := security.NewCA(cfg.CADir)
+		if user == os.Getenv("USER") && !ca.HasRequest(user) {
+			if err := requestCert(user); err != nil {
+				cmd.Printf("Error requesting certificate: %v\n", err)
+				return
+			}
+		}
+
+		cert, err := ca.Issue(user)
+		if err != nil {
+			cmd.Printf("Error issuing certificate: %v\n", err)
+			return
+		}
+		color.Green("✓ Issued a certificate to %s, valid until %s", user, cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("  Serial: %x\n", cert.SerialNumber)
+		fmt.Printf("  Published at %s\n", ca.UserCertPath(user))
+	},
+}
+
+// caRevokeCmd revokes a user's certificate
+var caRevokeCmd = &cobra.Command{
+	Use:   "revoke <user>",
+	Short: "Revoke a user's certificate (CA owner only)",
+	Long: `Revoke the certificate issued to user. Running TLS shares refuse it from
+their next handshake on; guests already connected stay until they leave.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cert, err := security.NewCA(cfg.CADir).Revoke(args[0])
+		if err != nil {
+			cmd.Printf("Error revoking certificate: %v\n", err)
+			return
+		}
+		color.Green("✓ Revoked %s's certificate (serial %x)", args[0], cert.SerialNumber)
+	},
+}
+
+// requestCert publishes a signing request for user's key, creating the key
+// if needed
+func requestCert(user string) error {
+	key, err := security.LoadOrCreateKey(cfg.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	return security.NewCA(cfg.CADir).Request(user, key)
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caInitCmd)
+	caCmd.AddCommand(caRequestCmd)
+	caCmd.AddCommand(caIssueCmd)
+	caCmd.AddCommand(caRevokeCmd)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	execPassword string
+	execNoStdin  bool
+)
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec <user> [session] -- <command...>",
+	Short: "Run a command in another user's shared session",
+	Long: `Run a single command on the host of another user's shared session, without
+a terminal, and exit with the command's exit code.
+
+The command runs with the host's shell in the directory of the host's active
+tmux pane. Each argument reaches the command as it was given; for pipes or
+other shell syntax, run it through sh -c. Its stdout and stderr are streamed back as they come. Input piped
+into dmux exec is passed on to the command; a terminal is not.
+
+The host must share with --allow-exec, and view-only shares never allow it.
+If the command cannot be run at all, dmux exec exits with 255.
+
+Examples:
+  dmux exec alice -- make test                 # Run the tests in alice's session
+  dmux exec bob mysession -- git status        # In a specific session
+  git diff | dmux exec alice -- git apply      # Feed the command input
+  dmux exec alice -- sh -c 'make | tee log'    # Use the host's shell`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 1 || dash > 2 || len(args) == dash {
+			return fmt.Errorf("usage: dmux exec <user> [session] -- <command...>")
+		}
+		return nil
+	},
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		hostUser := args[0]
+		sessionName := ""
+		if dash > 1 {
+			sessionName = args[1]
+		}
+
+		var stdin io.Reader
+		if !execNoStdin && !term.IsTerminal(int(os.Stdin.Fd())) {
+			stdin = os.Stdin
+		}
+
+		code, err := sessMgr.Exec(hostUser, sessionName, execPassword, args[dash:], stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			cmd.PrintErrf("Error running command: %v\n", err)
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().StringVar(&execPassword, "password", "", "Password for secure sessions")
+	execCmd.Flags().BoolVarP(&execNoStdin, "no-stdin", "n", false, "Do not pass input on to the command")
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"jmux/internal/jcat"
+)
+
+var (
+	getFileSession string
+	getFileForce   bool
+)
+
+// getFileCmd represents the get-file command
+var getFileCmd = &cobra.Command{
+	Use:   "get-file <remote-path> [local-path]",
+	Short: "Fetch a file from the host of a joined session",
+	Long: `Fetch a file from the host of a session you have joined.
+
+The file travels over the existing 'dmux join' connection, so run this from
+another terminal on your machine while joined. Relative remote paths are
+resolved against the directory of the host's active tmux pane.
+
+The transfer is checked with SHA-256 before the file is moved into place.
+View-only guests cannot fetch files, and hosts can turn transfers off with
+'dmux share --no-files'.
+
+Examples:
+  dmux get-file out/report.pdf               # Into the current directory
+  dmux get-file /var/log/app.log ~/logs/     # Into a specific directory
+  dmux get-file notes.md --session alice     # When joined to several sessions`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		localPath := ""
+		if len(args) > 1 {
+			localPath = args[1]
+		}
+
+		opts := jcat.TransferOptions{Force: getFileForce, Progress: os.Stderr}
+		where, err := sessMgr.GetFile(getFileSession, args[0], localPath, opts)
+		if err != nil {
+			cmd.Printf("Error fetching file: %v\n", err)
+			return
+		}
+		color.Green("✓ Fetched %s from the host (checksum verified)", where)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(getFileCmd)
+
+	getFileCmd.Flags().StringVar(&getFileSession, "session", "", "Joined session to use, as <host-user>[/<session>]")
+	getFileCmd.Flags().BoolVar(&getFileForce, "force", false, "Replace the local file if it already exists")
+}
@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"jmux/internal/jcat"
 )
 
+var internalServerSession string
+
 // internalJcatServerCmd is a hidden command to run jcat server inside tmux
 var internalJcatServerCmd = &cobra.Command{
 	Use:    "_internal_jcat_server [port] [setsize-script]",
@@ -23,10 +29,40 @@ var internalJcatServerCmd = &cobra.Command{
 		}
 		
 		setSizeScript := args[1]
-		
-		// Start the jcat server
-		server := jcat.NewServer(fmt.Sprintf(":%d", port), setSizeScript)
-		if err := server.Start(); err != nil {
+
+		// Registered shares carry their settings in the session file
+		if internalServerSession != "" {
+			session, err := sessMgr.FindSession(os.Getenv("USER"), internalServerSession)
+			if err != nil {
+				fmt.Printf("jcat server error: %v\n", err)
+				return
+			}
+
+			// Secure shares receive their password through the environment
+			securityConfig := *cfg.Security
+			if session.Secure {
+				securityConfig.SessionPasswords = map[string]string{
+					session.Name: os.Getenv("JMUX_SHARE_PASSWORD"),
+				}
+				os.Unsetenv("JMUX_SHARE_PASSWORD")
+			}
+
+			if err := sessMgr.RunServer(session, &securityConfig); err != nil {
+				fmt.Printf("jcat server error: %v\n", err)
+			}
+			return
+		}
+
+		// Start the jcat server, shutting it down cleanly when told to stop
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		bind, err := jcat.ResolveBind(cfg.BindAddress)
+		if err != nil {
+			fmt.Printf("jcat server error: %v\n", err)
+			return
+		}
+		server := jcat.NewServer(jcat.ListenAddr(bind, port), setSizeScript)
+		if err := server.Serve(ctx); err != nil {
 			fmt.Printf("jcat server error: %v\n", err)
 		}
 	},
@@ -34,4 +70,6 @@ var internalJcatServerCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(internalJcatServerCmd)
-}
\ No newline at end of file
+
+	internalJcatServerCmd.Flags().StringVar(&internalServerSession, "session", "", "Name of the registered session to serve")
+}
@@ -2,12 +2,19 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"jmux/internal/jcat"
+	"jmux/internal/session"
 )
 
 var (
 	joinView     bool
 	joinRogue    bool
-	joinPassword string
+	joinPassword    string
+	joinNoReconnect bool
+	joinStats       bool
+	joinCompress    bool
+	joinLocal       []string
+	joinRemote      []string
 )
 
 // joinCmd represents the join command
@@ -24,12 +31,31 @@ Join Modes:
 Security Options:
   --password: Password for secure sessions
 
+Connection Options:
+  --no-reconnect: Exit when the connection drops. By default the client
+                  reconnects with backoff and resumes the session, replaying
+                  any output missed while it was away.
+  --stats:        Show round-trip time and throughput in the top right
+                  corner, to tell network lag from a slow host.
+  --compress:     Ask the host to compress the session output. Used only if
+                  the host shared with --compress; plain output otherwise.
+
+Port Forwarding (the host must share with --allow-forward; not in view mode):
+  -L [bind:]port:host:hostport  Listen on port here and connect to host:hostport
+                                from the host's machine, like ssh -L
+  -R [bind:]port:host:hostport  Listen on port on the host's machine and
+                                connect to host:hostport from here, like ssh -R
+  Without a bind address only this machine (or the host's, for -R) can use
+  the forwarded port. Both flags may be repeated.
+
 Examples:
   dmux join alice                    # Join alice's default session with its configured mode
   dmux join bob mysession           # Join bob's specific session with its configured mode
   dmux join alice --view            # Join alice's session in read-only mode
   dmux join bob mysession --rogue   # Join bob's session in rogue mode
-  dmux join alice --password mypass # Join alice's secure session with password`,
+  dmux join alice --password mypass # Join alice's secure session with password
+  dmux join alice -L 3000:localhost:3000  # Reach alice's dev server on localhost:3000
+  dmux join alice -R 8080:localhost:8080  # Let alice reach your port 8080`,
 	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
 		// Validate mutually exclusive flags
@@ -52,7 +78,29 @@ Examples:
 			modeOverride = "rogue"
 		}
 
-		err := sessMgr.JoinSession(hostUser, sessionName, modeOverride, joinPassword)
+		opts := session.JoinOptions{
+			NoReconnect: joinNoReconnect,
+			ShowStats:   joinStats,
+			Compress:    joinCompress,
+		}
+		for _, spec := range joinLocal {
+			fwd, err := jcat.ParseForward(spec)
+			if err != nil {
+				cmd.Printf("Error: -L: %v\n", err)
+				return
+			}
+			opts.LocalForwards = append(opts.LocalForwards, fwd)
+		}
+		for _, spec := range joinRemote {
+			fwd, err := jcat.ParseForward(spec)
+			if err != nil {
+				cmd.Printf("Error: -R: %v\n", err)
+				return
+			}
+			opts.RemoteForwards = append(opts.RemoteForwards, fwd)
+		}
+
+		err := sessMgr.JoinSessionWithOptions(hostUser, sessionName, modeOverride, joinPassword, opts)
 		if err != nil {
 			cmd.Printf("Error joining session: %v\n", err)
 			cmd.Printf("Tip: Try 'dmux sessions' to see available sessions\n")
@@ -68,4 +116,9 @@ func init() {
 	joinCmd.Flags().BoolVar(&joinView, "view", false, "Force view-only mode (read-only)")
 	joinCmd.Flags().BoolVar(&joinRogue, "rogue", false, "Force rogue mode (independent control)")
 	joinCmd.Flags().StringVar(&joinPassword, "password", "", "Password for secure sessions")
+	joinCmd.Flags().BoolVar(&joinNoReconnect, "no-reconnect", false, "Exit when the connection drops instead of resuming")
+	joinCmd.Flags().BoolVar(&joinStats, "stats", false, "Show latency and throughput while connected")
+	joinCmd.Flags().BoolVar(&joinCompress, "compress", false, "Ask the host to compress the session output")
+	joinCmd.Flags().StringArrayVarP(&joinLocal, "local-forward", "L", nil, "Forward a local port to the host's side: [bind:]port:host:hostport")
+	joinCmd.Flags().StringArrayVarP(&joinRemote, "remote-forward", "R", nil, "Forward a port on the host's side to here: [bind:]port:host:hostport")
 }
\ No newline at end of file
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"jmux/internal/recording"
+)
+
+var (
+	replaySpeed     float64
+	replayIdleLimit time.Duration
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay <file>",
+	Short: "Replay a recorded session",
+	Long: `Replay a session recorded with 'dmux share --record'.
+
+Recordings are asciicast v2 files, so they also play in asciinema. They
+play in the size of your terminal; window resizes in the recording are
+not replayed.
+
+Controls:
+  space   Pause / resume
+  q       Quit
+
+Examples:
+  dmux replay ~/.config/jmux/recordings/demo-20240101-100000.cast
+  dmux replay demo.cast --speed 2          # Play twice as fast
+  dmux replay demo.cast --idle-limit 2s    # Skip pauses longer than 2 seconds`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cast, err := recording.Load(args[0])
+		if err != nil {
+			cmd.Printf("Error reading recording: %v\n", err)
+			return
+		}
+
+		commands := make(chan recording.Command, 1)
+
+		// Read playback controls from the keyboard when we have a terminal
+		stdin := int(os.Stdin.Fd())
+		if term.IsTerminal(stdin) {
+			oldState, err := term.MakeRaw(stdin)
+			if err == nil {
+				defer term.Restore(stdin, oldState)
+				go readReplayControls(commands)
+			}
+		}
+
+		opts := recording.PlayOptions{
+			Speed:         replaySpeed,
+			IdleTimeLimit: replayIdleLimit,
+		}
+		if err := cast.Play(os.Stdout, opts, commands); err != nil {
+			os.Stdout.WriteString("\r\n")
+			color.Red("Error replaying recording: %v\r", err)
+			return
+		}
+
+		os.Stdout.WriteString("\r\n")
+		color.Green("✓ Replay finished\r")
+	},
+}
+
+// readReplayControls turns key presses into playback commands
+func readReplayControls(commands chan<- recording.Command) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buf); err != nil {
+			return
+		}
+		switch buf[0] {
+		case ' ':
+			commands <- recording.TogglePause
+		case 'q', 'Q', 3: // 3 is Ctrl+C in raw mode
+			commands <- recording.Quit
+			return
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "Playback speed multiplier")
+	replayCmd.Flags().DurationVar(&replayIdleLimit, "idle-limit", 0, "Cap pauses between events (e.g. 2s)")
+}
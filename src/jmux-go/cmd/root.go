@@ -99,6 +99,11 @@ func initializeSystem() {
 
 	// Initialize messaging system
 	msgSystem = messaging.NewMessaging(cfg)
+
+	// Hosts deliver invitation tokens to a box only this user can list
+	if err := msgSystem.EnsureInviteBox(); err != nil {
+		color.Yellow("Warning: Invitations cannot reach you: %v", err)
+	}
 	
 	// Initialize monitor manager
 	monitorMgr = messaging.NewMonitorManager(cfg)
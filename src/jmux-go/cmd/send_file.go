@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"jmux/internal/jcat"
+)
+
+var (
+	sendFileSession string
+	sendFileForce   bool
+)
+
+// sendFileCmd represents the send-file command
+var sendFileCmd = &cobra.Command{
+	Use:   "send-file <path> [remote-path]",
+	Short: "Send a file to the host of a joined session",
+	Long: `Send a local file to the host of a session you have joined.
+
+The file travels over the existing 'dmux join' connection, so run this from
+another terminal on your machine while joined. Relative remote paths are
+resolved against the directory of the host's active tmux pane.
+
+The transfer is checked with SHA-256 before the file is moved into place.
+View-only guests cannot send files, and hosts can turn transfers off with
+'dmux share --no-files'.
+
+Examples:
+  dmux send-file report.pdf                  # Into the host's current directory
+  dmux send-file build.log /tmp/build.log    # To a specific path on the host
+  dmux send-file notes.md --session alice    # When joined to several sessions`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		remotePath := ""
+		if len(args) > 1 {
+			remotePath = args[1]
+		}
+
+		opts := jcat.TransferOptions{Force: sendFileForce, Progress: os.Stderr}
+		where, err := sessMgr.SendFile(sendFileSession, args[0], remotePath, opts)
+		if err != nil {
+			cmd.Printf("Error sending file: %v\n", err)
+			return
+		}
+		color.Green("✓ Sent %s to %s on the host (checksum verified)", args[0], where)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sendFileCmd)
+
+	sendFileCmd.Flags().StringVar(&sendFileSession, "session", "", "Joined session to use, as <host-user>[/<session>]")
+	sendFileCmd.Flags().BoolVar(&sendFileForce, "force", false, "Replace the file if it already exists on the host")
+}
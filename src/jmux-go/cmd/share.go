@@ -1,7 +1,16 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
+	"jmux/internal/invite"
+	"jmux/internal/security"
+	"jmux/internal/session"
 )
 
 var (
@@ -12,6 +21,23 @@ var (
 	shareRogue   bool
 	sharePassword string
 	shareSecure   bool
+	shareTLS      bool
+	shareSSHKey   bool
+	shareHub      bool
+	shareRecord   bool
+	shareRecordFile string
+	shareCompress   bool
+	shareNoFiles    bool
+	shareForward    bool
+	shareMaxGuests  int
+	shareMaxPerIP   int
+	shareExec       bool
+	shareBind       string
+	shareAllowFrom  []string
+	shareSocketMode string
+	shareCommand    string
+	shareInviteTTL  time.Duration
+	shareInviteReconnects int
 )
 
 // shareCmd represents the share command
@@ -25,9 +51,68 @@ Sharing Modes:
   --view:  View-only mode (joining users can only observe, read-only)
   --rogue: Rogue mode (joining users get independent control within same tmux server)
 
+Invitations:
+  --invite:             Send these users an invitation with a token of their
+                        own, which 'dmux join' presents for them. Shares
+                        that send invitations let in only invited users
+                        with their token.
+  --invite-ttl:         How long invitations stay good (default: 24h)
+  --invite-reconnects:  Times an invited guest may join again with its
+                        invitation (default: 0, joins once). Resuming a
+                        dropped connection and dmux exec do not count.
+
+Sharing a Program:
+  --command:     Share one program, run with your shell, instead of a tmux
+                 session. Guests all see the same running copy; the share
+                 runs in the foreground until Ctrl+C or 'dmux stop'.
+
+Hub Mode:
+  --hub:   Serve every guest from one shared terminal on the host instead of
+           starting a shell per guest (rogue guests still get their own)
+
+Recording:
+  --record:      Record the guests' terminal output to an asciicast v2 file
+  --record-file: Where to write the recording (default: ~/.config/jmux/recordings)
+
+Compression:
+  --compress:    Compress the output sent to guests that join with --compress.
+                 Helps guests on slow links; others get it uncompressed.
+
+File Transfer:
+  --no-files:    Refuse 'dmux send-file' and 'dmux get-file' from guests
+
+Port Forwarding:
+  --allow-forward: Let pair and rogue guests forward TCP ports with
+                   'dmux join -L/-R'. Off by default; never for view guests.
+
+Commands:
+  --allow-exec:  Let pair and rogue guests run single commands without a
+                 terminal with 'dmux exec', for scripts and CI hooks
+
+Limits:
+  --max-guests:  Turn guests away once this many are connected (default: no limit)
+  --max-per-ip:  Connections one IP address may have open at once
+                 (default: 8, -1 for no limit). Refused guests are told why.
+
+Network:
+  --bind:        Listen only on this IP address, interface (eth0) or the
+                 machine's address in a CIDR (default: $JMUX_BIND, or every
+                 interface). IPv6 addresses work anywhere IPv4 ones do.
+  --allow-from:  Only accept guests from these networks, as CIDRs or
+                 addresses (default: $JMUX_ALLOW_FROM, or any). Others are
+                 turned away before a shell is started.
+  --socket-mode: Who on this machine may reach the share's Unix socket, as
+                 octal permissions (default: 0666, everyone). Guests on it
+                 are known by the account they run as.
+
 Security Options:
   --secure:   Enable encrypted sessions (requires password)
   --password: Set password for secure sessions
+  --tls:      Encrypt with mutual TLS instead: guests need a certificate from
+              the team CA (see 'dmux ca') and are known by the name in it
+  --sshkey:   Encrypt and let in guests whose SSH key (from ssh-agent or
+              ~/.ssh) is in your ~/.ssh/authorized_keys; they are known by
+              the user in the key's comment, which --private checks
 
 Examples:
   dmux share                              # Share current session publicly
@@ -36,14 +121,24 @@ Examples:
   dmux share --view                       # Share in read-only mode
   dmux share --rogue                      # Share in rogue mode (independent sessions)
   dmux share --private --invite user1,user2  # Private session with invites
+  dmux share --hub                        # One shared terminal for all guests
+  dmux share --command "htop" monitoring  # Share a single program
+  dmux share --record walkthrough         # Record the session for later replay
+  dmux share --compress                   # Compress output for slow links
+  dmux share --bind eth1 --allow-from 10.0.0.0/8,fd00::/8  # Lab network only
   dmux share --secure --password mypass   # Secure encrypted session
-  dmux share --secure                     # Secure session with config password`,
+  dmux share --secure                     # Secure session with config password
+  dmux share --tls                        # Team members with certificates only
+  dmux share --sshkey --private --invite bob  # Only bob's SSH key gets in`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Use positional argument if provided, otherwise use flag
 		sessionName := shareName
 		if len(args) > 0 {
 			sessionName = args[0]
 		}
+		if sessionName == "" {
+			sessionName = session.DefaultSessionName()
+		}
 		
 		// Validate mutually exclusive flags
 		if shareView && shareRogue {
@@ -52,7 +147,11 @@ Examples:
 		}
 
 		// Validate security options
-		if shareSecure && sharePassword == "" && cfg.Security.GlobalPassword == "" {
+		if shareTLS && shareSSHKey {
+			cmd.Printf("Error: --tls and --sshkey flags are mutually exclusive\n")
+			return
+		}
+		if shareSecure && !shareTLS && !shareSSHKey && sharePassword == "" && cfg.Security.GlobalPassword == "" {
 			cmd.Printf("Error: --secure requires a password (use --password or configure global password)\n")
 			return
 		}
@@ -69,10 +168,16 @@ Examples:
 		}
 
 		// Configure security for this session if requested
-		if shareSecure {
+		if shareSecure || shareTLS || shareSSHKey {
 			// Create a copy of the config with security enabled
 			secureConfig := *cfg.Security
 			secureConfig.Enabled = true
+			if shareTLS {
+				secureConfig.Method = security.AuthMethodTLS
+			}
+			if shareSSHKey {
+				secureConfig.Method = security.AuthMethodSSHKey
+			}
 			
 			// Set session-specific password if provided
 			if sharePassword != "" {
@@ -90,7 +195,46 @@ Examples:
 			}()
 		}
 
-		err := sessMgr.StartShare(sessionName, sharePrivate, shareInvite, shareMode)
+		opts := session.ShareOptions{
+			Hub:      shareHub,
+			Compress: shareCompress,
+			NoFiles:  shareNoFiles,
+
+			AllowForward: shareForward,
+			MaxGuests:    shareMaxGuests,
+			MaxPerIP:     shareMaxPerIP,
+			AllowExec:    shareExec,
+			Bind:         shareBind,
+			AllowFrom:    shareAllowFrom,
+			Command:      shareCommand,
+
+			InviteTTL:        shareInviteTTL,
+			InviteReconnects: shareInviteReconnects,
+		}
+		socketMode, err := strconv.ParseUint(shareSocketMode, 8, 32)
+		if err != nil {
+			cmd.Printf("Error: --socket-mode must be octal permissions such as 0660\n")
+			return
+		}
+		opts.SocketMode = os.FileMode(socketMode)
+		if opts.Bind == "" {
+			opts.Bind = cfg.BindAddress
+		}
+		if len(opts.AllowFrom) == 0 {
+			opts.AllowFrom = cfg.AllowFrom
+		}
+		if shareRecord || shareRecordFile != "" {
+			opts.Record = shareRecordFile
+			if opts.Record == "" {
+				fileName := fmt.Sprintf("%s-%s.cast", sessionName, time.Now().Format("20060102-150405"))
+				opts.Record = filepath.Join(cfg.RecordingsDir, fileName)
+			}
+			if absPath, err := filepath.Abs(opts.Record); err == nil {
+				opts.Record = absPath
+			}
+		}
+
+		err = sessMgr.StartShareWithOptions(sessionName, sharePrivate, shareInvite, shareMode, opts)
 		if err != nil {
 			cmd.Printf("Error starting share: %v\n", err)
 			return
@@ -104,8 +248,25 @@ func init() {
 	shareCmd.Flags().StringVar(&shareName, "name", "", "Custom session name")
 	shareCmd.Flags().BoolVar(&sharePrivate, "private", false, "Create private session")
 	shareCmd.Flags().StringSliceVar(&shareInvite, "invite", []string{}, "Users to invite (comma-separated)")
+	shareCmd.Flags().DurationVar(&shareInviteTTL, "invite-ttl", invite.DefaultTTL, "How long invitations stay good")
+	shareCmd.Flags().IntVar(&shareInviteReconnects, "invite-reconnects", 0, "Times an invited guest may join again with its invitation")
 	shareCmd.Flags().BoolVar(&shareView, "view", false, "Share in view-only mode (read-only for joining users)")
 	shareCmd.Flags().BoolVar(&shareRogue, "rogue", false, "Share in rogue mode (independent control for joining users)")
 	shareCmd.Flags().BoolVar(&shareSecure, "secure", false, "Enable encrypted session (requires password)")
 	shareCmd.Flags().StringVar(&sharePassword, "password", "", "Password for secure session")
+	shareCmd.Flags().BoolVar(&shareTLS, "tls", false, "Require guests to present a certificate from the team CA")
+	shareCmd.Flags().BoolVar(&shareSSHKey, "sshkey", false, "Require guests to sign in with an SSH key from your authorized_keys")
+	shareCmd.Flags().StringVar(&shareCommand, "command", "", "Share this program instead of a tmux session")
+	shareCmd.Flags().BoolVar(&shareHub, "hub", false, "Serve all guests from one shared terminal")
+	shareCmd.Flags().BoolVar(&shareRecord, "record", false, "Record the session to an asciicast v2 file")
+	shareCmd.Flags().StringVar(&shareRecordFile, "record-file", "", "File to record the session to (implies --record)")
+	shareCmd.Flags().BoolVar(&shareCompress, "compress", false, "Compress output for guests that ask for it")
+	shareCmd.Flags().BoolVar(&shareNoFiles, "no-files", false, "Do not let guests transfer files")
+	shareCmd.Flags().BoolVar(&shareForward, "allow-forward", false, "Let pair and rogue guests forward TCP ports")
+	shareCmd.Flags().BoolVar(&shareExec, "allow-exec", false, "Let pair and rogue guests run commands with dmux exec")
+	shareCmd.Flags().IntVar(&shareMaxGuests, "max-guests", 0, "Most guests connected at once (0 for no limit)")
+	shareCmd.Flags().StringVar(&shareBind, "bind", "", "IP address, interface or CIDR to listen on (default: every interface)")
+	shareCmd.Flags().StringSliceVar(&shareAllowFrom, "allow-from", []string{}, "Networks guests may connect from (comma-separated CIDRs or addresses)")
+	shareCmd.Flags().StringVar(&shareSocketMode, "socket-mode", "0666", "Permissions of the share's Unix socket, in octal")
+	shareCmd.Flags().IntVar(&shareMaxPerIP, "max-per-ip", 0, "Most connections from one IP address at once (0 for the default, -1 for no limit)")
 }
\ No newline at end of file
@@ -10,6 +10,7 @@ import (
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
+	"jmux/internal/jcat"
 )
 
 // statusCmd represents the status command
@@ -87,6 +88,27 @@ func showStatus() {
 			} else {
 				color.Green("  Public session")
 			}
+
+			guests, err := sessMgr.GuestStats(session)
+			if err != nil {
+				color.Yellow("  Guests: unavailable (%v)", err)
+				continue
+			}
+			if len(guests) == 0 {
+				fmt.Printf("  Guests: none connected\n")
+				continue
+			}
+			fmt.Printf("  Guests (%d):\n", len(guests))
+			for _, guest := range guests {
+				user := guest.User
+				if user == "" {
+					user = "?"
+				}
+				fmt.Printf("    %-12s %-24s %-5s rtt %-7s in %-10s out %-10s connected %s\n",
+					user, guest.Remote, guest.Mode,
+					jcat.FormatRTT(guest.RTT), jcat.FormatRate(guest.InRate), jcat.FormatRate(guest.OutRate),
+					time.Since(guest.Connected).Round(time.Second))
+			}
 		}
 	}
 
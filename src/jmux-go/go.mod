@@ -10,6 +10,7 @@ require (
 	github.com/fsnotify/fsnotify v1.8.0
 	github.com/hashicorp/yamux v0.1.2
 	github.com/spf13/cobra v1.8.1
+	golang.org/x/crypto v0.42.0
 	golang.org/x/term v0.35.0
 )
 
@@ -18,6 +19,5 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.42.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
 )
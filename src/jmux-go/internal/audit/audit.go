@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Kinds of connection events
+const (
+	EventJoin       = "join"        // a guest was let in
+	EventLeave      = "leave"       // a guest disconnected
+	EventRefused    = "refused"     // a guest was turned away
+	EventAuthFailed = "auth_failed" // a secure handshake failed
+)
+
+// tailSize is how much of the end of the log is read to find the last
+// record, far more than any one record takes
+const tailSize = 64 * 1024
+
+// Record is one line of the audit log. Hash covers the record with Hash
+// left empty, Prev included, so every record vouches for all before it.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Host     string    `json:"host"`              // user sharing the session
+	Machine  string    `json:"machine,omitempty"` // where the share runs
+	Session  string    `json:"session,omitempty"`
+	User     string    `json:"user,omitempty"` // guest, as it introduced itself
+	Remote   string    `json:"remote"`         // guest address
+	Mode     string    `json:"mode,omitempty"`
+	Exec     bool      `json:"exec,omitempty"`     // the guest ran a command rather than joining
+	Duration float64   `json:"duration,omitempty"` // seconds connected, on leave
+	BytesIn  int64     `json:"bytes_in,omitempty"`
+	BytesOut int64     `json:"bytes_out,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // why a guest was refused or left
+	Invite   string    `json:"invite,omitempty"` // ID of the invitation a guest joined with
+	Prev     string    `json:"prev"`             // hash of the record before, empty for the first
+	Hash     string    `json:"hash"`
+}
+
+// hash returns the hash of r as it is chained
+func (r Record) hash() string {
+	r.Hash = ""
+	body, _ := json.Marshal(r)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Logger appends records to an audit log that several servers, possibly on
+// different machines, share
+type Logger struct {
+	path string
+}
+
+// NewLogger returns a logger appending to the log at path
+func NewLogger(path string) *Logger {
+	return &Logger{path: path}
+}
+
+// Log chains r to the last record in the log and appends it. The log is
+// locked meanwhile, so concurrent servers cannot fork the chain.
+func (l *Logger) Log(r Record) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	last, err := lastRecord(file)
+	if err != nil {
+		return err
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+	r.Prev = last.Hash
+	r.Hash = r.hash()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// lastRecord returns the last record in file, or an empty one if there is
+// none
+func lastRecord(file *os.File) (Record, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return Record{}, err
+	}
+	offset := max(info.Size()-tailSize, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return Record{}, err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	var last Record
+	if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+		return Record{}, fmt.Errorf("audit log ends in a malformed record: %v", err)
+	}
+	return last, nil
+}
+
+// Read returns every record in the log at path, oldest first. A missing log
+// has no records.
+func Read(path string) ([]Record, error) {
+	var records []Record
+	err := scan(path, func(r Record, line int) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+// Verify checks that every record in the log at path hashes to its Hash
+// and chains to the one before it. It returns how many records it checked
+// and the hash of the last, which can be noted elsewhere so that later
+// truncation is caught too.
+func Verify(path string) (count int, head string, err error) {
+	err = scan(path, func(r Record, line int) error {
+		if r.Prev != head {
+			return fmt.Errorf("line %d: chain broken, record follows %.12s but the record before is %.12s", line, r.Prev, head)
+		}
+		if r.hash() != r.Hash {
+			return fmt.Errorf("line %d: record was altered, it no longer matches its hash", line)
+		}
+		count++
+		head = r.Hash
+		return nil
+	})
+	return count, head, err
+}
+
+// scan calls fn with every record in the log at path and its line number
+func scan(path string, fn func(r Record, line int) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), tailSize)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("line %d: malformed record: %v", line, err)
+		}
+		if err := fn(r, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
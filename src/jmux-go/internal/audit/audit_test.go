@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogChainsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger := NewLogger(path)
+
+	// Servers log concurrently without forking the chain
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := logger.Log(Record{Event: EventJoin, Host: "alice", User: "bob", Remote: "10.0.0.2:5000"}); err != nil {
+				t.Errorf("Log failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, head, err := Verify(path)
+	if err != nil || count != 20 {
+		t.Fatalf("Verify = %d, %v, want 20 records and no error", count, err)
+	}
+	records, err := Read(path)
+	if err != nil || records[len(records)-1].Hash != head {
+		t.Fatalf("Read = %d records, %v; head %s", len(records), err, head)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		want   string
+	}{
+		{"edited", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"user":"bob"`, `"user":"eve"`, 1)
+			return lines
+		}, "line 2: record was altered"},
+		{"deleted", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, "line 2: chain broken"},
+		{"reordered", func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		}, "line 1: chain broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			logger := NewLogger(path)
+			for _, user := range []string{"carol", "bob", "dave"} {
+				if err := logger.Log(Record{Event: EventJoin, Host: "alice", User: user, Remote: "10.0.0.2:5000"}); err != nil {
+					t.Fatalf("Log failed: %v", err)
+				}
+			}
+
+			data, _ := os.ReadFile(path)
+			lines := tt.tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+			os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+			if _, _, err := Verify(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Verify error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
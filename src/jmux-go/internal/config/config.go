@@ -18,6 +18,11 @@ type Config struct {
 	SetSizeScript          string
 	MessagesDir            string
 	UsersFile              string
+	AuditFile              string
+	CADir                  string // team CA for the tls method, shared by everyone
+	TLSKeyFile             string // this user's private key for the tls method
+	InvitesDir             string // invitations to this user's shares, one store per session
+	InviteBoxesDir         string // every user's box of invitation tokens sent to them
 	SessionsDir            string
 	PortMapFile            string
 	RealtimeEnabled        bool
@@ -25,7 +30,11 @@ type Config struct {
 	WatcherPIDFile         string
 	MonitorPIDFile         string
 	MonitorLogFile         string
+	RecordingsDir          string
 	MessageDisplayMethod   string // "kdialog", "terminal", "tmux"
+	BindAddress            string   // address, interface or CIDR shares listen on; every interface if empty
+	AllowFrom              []string // networks guests may connect from; any if empty
+	Shell                  string   // shell guests get; the login shell if empty
 	Security               *security.SecurityConfig
 }
 
@@ -35,6 +44,12 @@ func DefaultConfig() *Config {
 	// defaultSharedDir := filepath.Join(homeDir, ".jmux", "shared")
 	sharedDir := getEnvOrDefault("JMUX_SHARED_DIR", "/projects/common/work/dory/jmux")
 	configDir := filepath.Join(homeDir, ".config", "jmux")
+	caDir := filepath.Join(sharedDir, "ca")
+	tlsKeyFile := filepath.Join(configDir, "tls", "key.pem")
+
+	securityConfig := security.DefaultSecurityConfig()
+	securityConfig.TLS = security.NewCA(caDir).TLSConfig(os.Getenv("USER"), tlsKeyFile)
+	securityConfig.SSHKey = security.NewSSHKeyConfig(filepath.Join(homeDir, ".ssh"), os.Getenv("SSH_AUTH_SOCK"))
 
 	return &Config{
 		Port:                    getEnvOrDefaultInt("JMUX_PORT", 12345),
@@ -43,6 +58,11 @@ func DefaultConfig() *Config {
 		SetSizeScript:          filepath.Join(configDir, "setsize.sh"),
 		MessagesDir:            filepath.Join(sharedDir, "messages"),
 		UsersFile:              filepath.Join(sharedDir, "users.db"),
+		AuditFile:              filepath.Join(sharedDir, "audit.jsonl"),
+		CADir:                  caDir,
+		TLSKeyFile:             tlsKeyFile,
+		InvitesDir:             filepath.Join(configDir, "invites"),
+		InviteBoxesDir:         filepath.Join(sharedDir, "invites"),
 		SessionsDir:            filepath.Join(sharedDir, "sessions"),
 		PortMapFile:            filepath.Join(sharedDir, "port_sessions.db"),
 		RealtimeEnabled:        getEnvOrDefaultBool("JMUX_REALTIME", true),
@@ -50,8 +70,12 @@ func DefaultConfig() *Config {
 		WatcherPIDFile:         filepath.Join(configDir, "watcher.pid"),
 		MonitorPIDFile:         filepath.Join("/tmp", "dmux-monitor-"+os.Getenv("USER")+".pid"),
 		MonitorLogFile:         filepath.Join(configDir, "monitor.log"),
+		RecordingsDir:          filepath.Join(configDir, "recordings"),
 		MessageDisplayMethod:   getEnvOrDefault("DMUX_MESSAGE_DISPLAY", "auto"),
-		Security:               security.DefaultSecurityConfig(),
+		BindAddress:            os.Getenv("JMUX_BIND"),
+		AllowFrom:              getEnvList("JMUX_ALLOW_FROM"),
+		Shell:                  os.Getenv("JMUX_SHELL"),
+		Security:               securityConfig,
 	}
 }
 
@@ -114,6 +138,7 @@ func (c *Config) isSetSizeScriptCurrent() bool {
 
 	hasProfile := false
 	hasMode := false
+	hasSessionName := false
 	
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -124,8 +149,11 @@ func (c *Config) isSetSizeScriptCurrent() bool {
 		if strings.Contains(line, "JCAT_MODE") {
 			hasMode = true
 		}
+		if strings.Contains(line, "JMUX_SESSION_NAME") {
+			hasSessionName = true
+		}
 	}
-	return hasProfile && hasMode
+	return hasProfile && hasMode && hasSessionName
 }
 
 // createSetSizeScript creates the setsize.sh script
@@ -138,9 +166,9 @@ if [[ -f "$HOME/.config/jmux/profile.sh" ]]; then
     source "$HOME/.config/jmux/profile.sh"
 fi
 
-# Determine session name from port mapping or fallback to hostname
-SESSION_NAME=""
-if [[ -n "${SOCAT_SOCKPORT:-}" ]]; then
+# Determine session name from the server, the port mapping, or fallback to hostname
+SESSION_NAME="${JMUX_SESSION_NAME:-}"
+if [[ -z "$SESSION_NAME" && -n "${SOCAT_SOCKPORT:-}" ]]; then
     # Get session name from port mapping
     PORT_MAP_FILE="${JMUX_SHARED_DIR:-/projects/common/work/dory/jmux}/port_sessions.db"
     if [[ -f "$PORT_MAP_FILE" ]]; then
@@ -249,6 +277,17 @@ func getEnvOrDefaultInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvList returns the comma-separated values of an environment variable
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func getEnvOrDefaultBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
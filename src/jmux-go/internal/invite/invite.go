@@ -0,0 +1,222 @@
+// Package invite keeps the invitations to a share. Each invitation carries
+// a random token scoped to one user, one session and an expiry, which the
+// share's server accepts a limited number of times. Only a hash of every
+// token is kept, in a file only the host can read.
+package invite
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long an invitation stays good by default
+const DefaultTTL = 24 * time.Hour
+
+// Invite is an invitation as the host keeps it
+type Invite struct {
+	ID       string       `json:"id"`   // short, non-secret name for the invitation
+	Hash     string       `json:"hash"` // SHA-256 of the token
+	User     string       `json:"user"` // who it was sent to
+	Session  string       `json:"session"`
+	Expires  time.Time    `json:"expires"`
+	Uses     int          `json:"uses"` // joins it is good for, not counting resumes or commands
+	Redeemed []Redemption `json:"redeemed,omitempty"`
+}
+
+// Redemption records a connection let in by an invitation
+type Redemption struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`   // guest, as the server knew it
+	Remote string    `json:"remote"` // guest address
+}
+
+// Store is the file a share's invitations are kept in
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStore returns the store kept at path
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Issue creates an invitation to session for user that is good for uses
+// connections until ttl has passed, and returns its token
+func (s *Store) Issue(user, session string, ttl time.Duration, uses int) (string, Invite, error) {
+	if uses < 1 {
+		uses = 1
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", Invite{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	hash := hashToken(token)
+	invite := Invite{
+		ID:      hash[:8],
+		Hash:    hash,
+		User:    user,
+		Session: session,
+		Expires: time.Now().Add(ttl).Round(time.Second),
+		Uses:    uses,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites, err := s.load()
+	if err != nil {
+		return "", Invite{}, err
+	}
+	if err := s.save(append(invites, invite)); err != nil {
+		return "", Invite{}, err
+	}
+	return token, invite, nil
+}
+
+// Redeem lets user, connecting from remote, in to session with token,
+// recording it, and returns the invitation. It fails if the token is
+// unknown, for someone else or another session, expired or used up.
+func (s *Store) Redeem(token, user, session, remote string) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites, err := s.load()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	hash := hashToken(token)
+	for i := range invites {
+		invite := &invites[i]
+		if invite.Hash != hash {
+			continue
+		}
+		switch {
+		case invite.Session != session:
+			return Invite{}, fmt.Errorf("the invite is for another session")
+		case invite.User != user:
+			return Invite{}, fmt.Errorf("the invite is for %s", invite.User)
+		case time.Now().After(invite.Expires):
+			return Invite{}, fmt.Errorf("the invite expired at %s", invite.Expires.Local().Format("2006-01-02 15:04"))
+		case len(invite.Redeemed) >= invite.Uses:
+			return Invite{}, fmt.Errorf("the invite has already been used")
+		}
+		invite.Redeemed = append(invite.Redeemed, Redemption{Time: time.Now(), User: user, Remote: remote})
+		if err := s.save(invites); err != nil {
+			return Invite{}, err
+		}
+		return *invite, nil
+	}
+	return Invite{}, fmt.Errorf("unknown invite")
+}
+
+// Unredeem gives back a use of the invitation token stands for, taking
+// away redemption, for a guest Redeem let in that never got connected
+func (s *Store) Unredeem(token string, redemption Redemption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	hash := hashToken(token)
+	for i := range invites {
+		invite := &invites[i]
+		if invite.Hash != hash {
+			continue
+		}
+		for j, r := range invite.Redeemed {
+			if r.Time.Equal(redemption.Time) && r.User == redemption.User && r.Remote == redemption.Remote {
+				invite.Redeemed = append(invite.Redeemed[:j], invite.Redeemed[j+1:]...)
+				return s.save(invites)
+			}
+		}
+	}
+	return fmt.Errorf("no such redemption")
+}
+
+// Admitted returns the invitation token stands for if user already
+// redeemed it for session and it has not expired, without using it again
+func (s *Store) Admitted(token, user, session string) (Invite, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites, err := s.load()
+	if err != nil {
+		return Invite{}, false
+	}
+
+	hash := hashToken(token)
+	for _, invite := range invites {
+		if invite.Hash != hash || invite.Session != session || invite.User != user || time.Now().After(invite.Expires) {
+			continue
+		}
+		for _, redemption := range invite.Redeemed {
+			if redemption.User == user {
+				return invite, true
+			}
+		}
+	}
+	return Invite{}, false
+}
+
+// List returns the invitations in the store
+func (s *Store) List() ([]Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// load reads the invitations, none if the store does not exist yet
+func (s *Store) load() ([]Invite, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var invites []Invite
+	if err := json.Unmarshal(data, &invites); err != nil {
+		return nil, fmt.Errorf("invalid invite store %s: %v", s.path, err)
+	}
+	return invites, nil
+}
+
+// save replaces the store with invites, readable by the host alone
+func (s *Store) save(invites []Invite) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(invites, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".invites-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// hashToken returns the hex SHA-256 of token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
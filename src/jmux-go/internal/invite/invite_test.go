@@ -0,0 +1,104 @@
+package invite
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedeem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites", "demo.json")
+	store := NewStore(path)
+
+	token, issued, err := store.Issue("bob", "demo", time.Hour, 2)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("store = %v, %v; want a file only the host can read", info, err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), token) {
+		t.Error("the store keeps the token itself")
+	}
+
+	refusals := []struct {
+		token, user, session, want string
+	}{
+		{"guessed", "bob", "demo", "unknown invite"},
+		{token, "mallory", "demo", "for bob"},
+		{token, "bob", "other", "another session"},
+	}
+	for _, r := range refusals {
+		if _, err := store.Redeem(r.token, r.user, r.session, "10.0.0.2:4000"); err == nil || !strings.Contains(err.Error(), r.want) {
+			t.Errorf("Redeem(%s, %s) = %v, want %q", r.user, r.session, err, r.want)
+		}
+	}
+
+	if _, ok := store.Admitted(token, "bob", "demo"); ok {
+		t.Error("Admitted before bob redeemed the invite")
+	}
+
+	// The invite is good for the connection and one reconnect
+	for i := 0; i < 2; i++ {
+		redeemed, err := store.Redeem(token, "bob", "demo", "10.0.0.2:4000")
+		if err != nil {
+			t.Fatalf("Redeem #%d failed: %v", i+1, err)
+		}
+		if redeemed.ID != issued.ID || len(redeemed.Redeemed) != i+1 {
+			t.Errorf("Redeem #%d = %+v", i+1, redeemed)
+		}
+	}
+	if _, err := store.Redeem(token, "bob", "demo", "10.0.0.2:4000"); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Errorf("third Redeem = %v, want the invite used up", err)
+	}
+
+	if admitted, ok := store.Admitted(token, "bob", "demo"); !ok || admitted.ID != issued.ID {
+		t.Errorf("Admitted = %+v, %v; want bob let in again", admitted, ok)
+	}
+	if _, ok := store.Admitted(token, "mallory", "demo"); ok {
+		t.Error("Admitted mallory with bob's invite")
+	}
+
+	invites, err := store.List()
+	if err != nil || len(invites) != 1 || invites[0].Redeemed[0].User != "bob" {
+		t.Errorf("List = %+v, %v; want bob's redemptions recorded", invites, err)
+	}
+
+	expired, _, err := store.Issue("bob", "demo", -time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Redeem(expired, "bob", "demo", "10.0.0.2:4000"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Redeem of an expired invite = %v", err)
+	}
+}
+
+func TestUnredeem(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "demo.json"))
+	token, _, err := store.Issue("bob", "demo", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redeemed, err := store.Redeem(token, "bob", "demo", "10.0.0.2:4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redemption := redeemed.Redeemed[len(redeemed.Redeemed)-1]
+	if err := store.Unredeem(token, redemption); err != nil {
+		t.Fatalf("Unredeem failed: %v", err)
+	}
+	if _, ok := store.Admitted(token, "bob", "demo"); ok {
+		t.Error("bob is still admitted by a use given back")
+	}
+	if err := store.Unredeem(token, redemption); err == nil {
+		t.Error("the same use was given back twice")
+	}
+
+	// The use is good again
+	if _, err := store.Redeem(token, "bob", "demo", "10.0.0.2:4001"); err != nil {
+		t.Errorf("Redeem after Unredeem = %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package jcat
+
+import (
+	"os"
+	"time"
+
+	"jmux/internal/audit"
+)
+
+// auditEvent adds r to the audit log, if the server keeps one, filling in
+// which share it is about
+func (s *Server) auditEvent(r audit.Record) {
+	if s.audit == nil {
+		return
+	}
+	r.Host = os.Getenv("USER")
+	r.Machine, _ = os.Hostname()
+	r.Session = s.sessionName
+	if err := s.audit.Log(r); err != nil {
+		s.logger.Printf("[%s] audit log error: %v", r.Remote, err)
+	}
+}
+
+// auditLeave records that guest disconnected, with how long it stayed and
+// how much it moved
+func (s *Server) auditLeave(guest *guestConn, exec bool) {
+	s.auditEvent(audit.Record{
+		Event:    audit.EventLeave,
+		User:     guest.user,
+		Remote:   guest.remote,
+		Mode:     guest.mode,
+		Exec:     exec,
+		Duration: time.Since(guest.connected).Round(time.Millisecond).Seconds(),
+		BytesIn:  guest.stats.in.Load(),
+		BytesOut: guest.stats.out.Load(),
+	})
+}
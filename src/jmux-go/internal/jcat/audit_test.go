@@ -0,0 +1,57 @@
+package jcat
+
+import (
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jmux/internal/audit"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// Two servers share the log, as shares on one machine do
+	addr := startScriptServer(t, "stty -echo\necho hello\nexit 0\n", ServerOptions{AuditPath: path, SessionName: "demo"})
+	var wire atomic.Int64
+	catSession(t, addr, ClientOptions{User: "bob", Mode: ModeView, NoReconnect: true}, &wire, 0)
+
+	waitForRecords(t, path, 2)
+
+	networks, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	closed := startScriptServer(t, "exit 0\n", ServerOptions{AuditPath: path, AllowFrom: networks})
+	NewClientWithOptions(closed, ClientOptions{NoReconnect: true}).dial()
+
+	records := waitForRecords(t, path, 3)
+	if len(records) != 3 {
+		t.Fatalf("got %d audit records, want join, leave and refused: %+v", len(records), records)
+	}
+	join, leave, refused := records[0], records[1], records[2]
+	if join.Event != audit.EventJoin || join.User != "bob" || join.Mode != ModeView || join.Session != "demo" {
+		t.Errorf("join record = %+v", join)
+	}
+	if leave.Event != audit.EventLeave || leave.BytesOut == 0 || leave.Duration <= 0 {
+		t.Errorf("leave record = %+v", leave)
+	}
+	if refused.Event != audit.EventRefused || !strings.Contains(refused.Reason, "not allowed") {
+		t.Errorf("refused record = %+v", refused)
+	}
+	if count, _, err := audit.Verify(path); err != nil || count != 3 {
+		t.Errorf("Verify = %d, %v", count, err)
+	}
+}
+
+// waitForRecords waits until the audit log at path has n records, the last
+// of which may be written after the guest has gone
+func waitForRecords(t *testing.T, path string, n int) []audit.Record {
+	t.Helper()
+	var records []audit.Record
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if records, _ = audit.Read(path); len(records) >= n {
+			break
+		}
+	}
+	return records
+}
@@ -0,0 +1,64 @@
+package jcat
+
+import (
+	"compress/flate"
+	"io"
+	"strings"
+	"time"
+)
+
+// CompressionDeflate compresses the shell output sent to the guest with
+// DEFLATE. Guest input is a trickle of keystrokes and is never compressed.
+const CompressionDeflate = "deflate"
+
+// compressionWait bounds how long a client that asked for compression
+// waits for the server's answer once output arrives. Only servers that
+// advertise FeatureCompress are asked, and they answer before any output,
+// so the wait only guards against one that breaks that promise.
+const compressionWait = 500 * time.Millisecond
+
+// negotiateCompression picks the compression to use from the comma
+// separated list a client offered, or "" for none
+func negotiateCompression(offered string, allowed bool) string {
+	if !allowed {
+		return ""
+	}
+	for _, name := range strings.Split(offered, ",") {
+		if strings.TrimSpace(name) == CompressionDeflate {
+			return CompressionDeflate
+		}
+	}
+	return ""
+}
+
+// compressionOffer returns the compression the client asks the server for:
+// deflate if it wants compression and the server advertised it, else ""
+func (c *Client) compressionOffer() string {
+	if c.compress && c.peer.Supports(FeatureCompress) {
+		return CompressionDeflate
+	}
+	return ""
+}
+
+// compressWriter compresses everything written through it, flushing after
+// every write so the guest sees output without delay
+type compressWriter struct {
+	zw *flate.Writer
+}
+
+// newCompressWriter compresses into w
+func newCompressWriter(w io.Writer) *compressWriter {
+	// BestSpeed keeps up with a fast shell and still shrinks logs severalfold
+	zw, _ := flate.NewWriter(w, flate.BestSpeed)
+	return &compressWriter{zw: zw}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if _, err := c.zw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.zw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,196 @@
+package jcat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered string
+		allowed bool
+		want    string
+	}{
+		{"deflate", true, CompressionDeflate},
+		{"zstd, deflate", true, CompressionDeflate},
+		{"zstd", true, ""},
+		{"", true, ""},
+		{"deflate", false, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateCompression(tt.offered, tt.allowed); got != tt.want {
+			t.Errorf("negotiateCompression(%q, %v) = %q, want %q", tt.offered, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionOffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+		peer     Hello
+		want     string
+	}{
+		{"advertised", true, Hello{Protocol: 3, Features: []string{FeatureCompress}}, CompressionDeflate},
+		{"not wanted", false, Hello{Protocol: 3, Features: []string{FeatureCompress}}, ""},
+		{"not advertised", true, Hello{Protocol: 3}, ""},
+		{"old server", true, Hello{Protocol: 2}, ""},
+	}
+	for _, tt := range tests {
+		c := &Client{compress: tt.compress, peer: tt.peer}
+		if got := c.compressionOffer(); got != tt.want {
+			t.Errorf("%s: compressionOffer() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// startScriptServer runs a plain server whose guest shell runs script
+func startScriptServer(tb testing.TB, script string, opts ServerOptions) string {
+	tb.Helper()
+
+	rcfile := filepath.Join(tb.TempDir(), "rc.sh")
+	if err := os.WriteFile(rcfile, []byte(script), 0755); err != nil {
+		tb.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	server := NewServerWithOptions(ln.Addr().String(), rcfile, opts)
+	go server.serve(ln, server.handle)
+	return ln.Addr().String()
+}
+
+// wireConn counts the bytes read off the wire, before any decompression
+type wireConn struct {
+	net.Conn
+	n    *atomic.Int64
+	rate int // bytes per second the link carries, unlimited if zero
+
+	start time.Time
+	read  int64
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	if c.rate > 0 {
+		// Pace against the total so many small reads add up correctly
+		if c.start.IsZero() {
+			c.start = time.Now()
+		}
+		c.read += int64(n)
+		time.Sleep(time.Until(c.start.Add(time.Duration(c.read) * time.Second / time.Duration(c.rate))))
+	}
+	return n, err
+}
+
+// catSession connects a client to addr and returns its output once the
+// shell exits
+func catSession(tb testing.TB, addr string, opts ClientOptions, wire *atomic.Int64, rate int) string {
+	tb.Helper()
+
+	client := NewClientWithOptions(addr, opts)
+	conn, err := client.dial()
+	if err != nil {
+		tb.Fatalf("failed to connect: %v", err)
+	}
+	conn = &wireConn{Conn: conn, n: wire, rate: rate}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+
+	if err := client.run(conn, readInput(stdinReader), output, sizes); err != nil {
+		tb.Fatalf("run returned error: %v", err)
+	}
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	return output.buf.String()
+}
+
+func TestCompressedOutput(t *testing.T) {
+	// Through a pipe the log reaches the PTY in large writes, as a build's
+	// output would, rather than a flush per line
+	script := "stty -echo\nseq -f 'line %g of the build log' 1 500 | cat\necho done\nexit 0\n"
+
+	tests := []struct {
+		name           string
+		server, client bool
+		compressed     bool
+	}{
+		{"both", true, true, true},
+		{"server only", true, false, false},
+		{"client only", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startScriptServer(t, script, ServerOptions{Compress: tt.server})
+
+			var wire atomic.Int64
+			out := catSession(t, addr, ClientOptions{Compress: tt.client, NoReconnect: true}, &wire, 0)
+			if !strings.Contains(out, "line 500 of the build log") || !strings.Contains(out, "done") {
+				t.Fatalf("output incomplete: %q", out)
+			}
+
+			// Compressed, the repetitive log is far smaller on the wire
+			if small := wire.Load() < int64(len(out))/2; small != tt.compressed {
+				t.Fatalf("%d wire bytes for %d bytes of output, compressed = %v", wire.Load(), len(out), tt.compressed)
+			}
+		})
+	}
+}
+
+// BenchmarkCat compares the throughput of a large cat with and without
+// compression, on loopback and on a link limited to 4MB/s
+func BenchmarkCat(b *testing.B) {
+	var log strings.Builder
+	for i := 0; log.Len() < 4<<20; i++ {
+		fmt.Fprintf(&log, "2024-05-01T12:%02d:%02d INFO worker-%d processed request %d in %dms\n", i/60%60, i%60, i%8, i, i%97)
+	}
+	logFile := filepath.Join(b.TempDir(), "build.log")
+	if err := os.WriteFile(logFile, []byte(log.String()), 0644); err != nil {
+		b.Fatalf("failed to write log: %v", err)
+	}
+	script := fmt.Sprintf("stty -echo\ncat %s\nexit 0\n", logFile)
+
+	links := []struct {
+		name string
+		rate int
+	}{
+		{"loopback", 0},
+		{"4MBps", 4 << 20},
+	}
+	for _, link := range links {
+		for _, compress := range []bool{false, true} {
+			name := link.name + "/plain"
+			if compress {
+				name = link.name + "/deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				addr := startScriptServer(b, script, ServerOptions{Compress: compress})
+				b.SetBytes(int64(log.Len()))
+				b.ResetTimer()
+
+				var wire atomic.Int64
+				for i := 0; i < b.N; i++ {
+					catSession(b, addr, ClientOptions{Compress: compress, NoReconnect: true}, &wire, link.rate)
+				}
+				b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
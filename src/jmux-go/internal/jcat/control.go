@@ -0,0 +1,146 @@
+package jcat
+
+import (
+	"encoding/gob"
+	"io"
+	"log"
+	"sync"
+)
+
+// ControlVersion is the control channel protocol version this build speaks.
+// Messages without a version come from 2.0.0 peers, which only ever send
+// window sizes.
+const ControlVersion = 1
+
+// ControlKind says what a control message is about
+type ControlKind string
+
+const (
+	// KindHello is the first message in each direction
+	KindHello ControlKind = "hello"
+	// KindResize reports a new client window size
+	KindResize ControlKind = "resize"
+	// KindPing asks the peer for a KindPong with the same Seq
+	KindPing ControlKind = "ping"
+	// KindPong answers a KindPing
+	KindPong ControlKind = "pong"
+	// KindNotice carries text to show the guest
+	KindNotice ControlKind = "notice"
+	// KindKick disconnects the guest for good; Text says why
+	KindKick ControlKind = "kick"
+	// KindMode tells the guest its sharing mode changed
+	KindMode ControlKind = "mode"
+	// KindError reports a problem with the session; Text says what
+	KindError ControlKind = "error"
+	// KindExit tells the guest its shell exited
+	KindExit ControlKind = "exit"
+)
+
+// ControlMessage is the envelope of every control channel message. Peers
+// ignore kinds they do not know. Rows and Cols sit at the top level, where
+// a 2.0.0 peer reads a bare window size, so hellos and resizes reach it
+// unchanged.
+type ControlMessage struct {
+	Version int
+	Kind    ControlKind
+
+	Rows, Cols int // hello, resize
+
+	CanResume bool   // client hello: keep the shell alive if the connection drops
+	Resume    string // client hello: token of the shell to reattach to
+	Offset    int64  // client hello: output bytes received from that shell so far
+	Token     string // server hello: token for resuming this shell
+
+	// Compression is offered by the client hello as a comma separated list
+	// and chosen by the server hello; empty means none
+	Compression string
+
+	Seq  uint64 // ping, pong
+	Text string // notice, kick, error
+	Mode string // hello from the server, mode
+}
+
+// controlConn exchanges control messages over a stream. Sends are
+// serialized since replies and notices go out from several goroutines.
+type controlConn struct {
+	dec *gob.Decoder
+
+	mu          sync.Mutex
+	enc         *gob.Encoder
+	peerVersion int // latest version the peer has shown, zero for 2.0.0
+}
+
+// newControlConn wraps a control stream
+func newControlConn(rw io.ReadWriter) *controlConn {
+	return &controlConn{
+		dec: gob.NewDecoder(rw),
+		enc: gob.NewEncoder(rw),
+	}
+}
+
+// send writes msg stamped with this build's version
+func (c *controlConn) send(msg ControlMessage) error {
+	msg.Version = ControlVersion
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(msg)
+}
+
+// sendVersioned sends msg only if the peer speaks the envelope. A 2.0.0
+// peer would take any message for a window size.
+func (c *controlConn) sendVersioned(msg ControlMessage) error {
+	if !c.versioned() {
+		return nil
+	}
+	return c.send(msg)
+}
+
+// versioned reports whether the peer has sent a versioned message
+func (c *controlConn) versioned() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerVersion > 0
+}
+
+// receive reads the next message, reading a 2.0.0 window size as a resize
+func (c *controlConn) receive() (ControlMessage, error) {
+	var msg ControlMessage
+	if err := c.dec.Decode(&msg); err != nil {
+		return msg, err
+	}
+	if msg.Version == 0 {
+		msg.Kind = KindResize
+	} else {
+		c.mu.Lock()
+		c.peerVersion = msg.Version
+		c.mu.Unlock()
+	}
+	return msg, nil
+}
+
+// serveControl handles a guest's control messages after its hello until
+// the stream ends, passing window sizes to resize and logging to logger
+func serveControl(control *controlConn, logger *log.Logger, remote string, stats *connStats, resize func(rows, cols int) error) {
+	for {
+		msg, err := control.receive()
+		if err != nil {
+			return
+		}
+		switch msg.Kind {
+		case KindResize:
+			if msg.Rows <= 0 || msg.Cols <= 0 {
+				continue
+			}
+			if err := resize(msg.Rows, msg.Cols); err != nil {
+				logger.Printf("[%s] setsize error: %v", remote, err)
+				return
+			}
+		case KindPing:
+			control.send(ControlMessage{Kind: KindPong, Seq: msg.Seq})
+		case KindPong:
+			stats.pong(msg.Seq)
+		case KindError:
+			logger.Printf("[%s] client error: %s", remote, msg.Text)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package jcat
+
+import (
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestServeControlIgnoresUnknownKinds(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	resized := make(chan [2]int, 1)
+	go serveControl(newControlConn(server), log.Default(), "test", newConnStats(), func(rows, cols int) error {
+		resized <- [2]int{rows, cols}
+		return nil
+	})
+
+	control := newControlConn(client)
+	if err := control.send(ControlMessage{Kind: "from-the-future", Text: "ignore me"}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if err := control.send(ControlMessage{Kind: KindPing, Seq: 7}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	pong, err := control.receive()
+	if err != nil || pong.Kind != KindPong || pong.Seq != 7 {
+		t.Fatalf("expected pong 7, got %+v (%v)", pong, err)
+	}
+
+	if err := control.send(ControlMessage{Kind: KindResize, Rows: 30, Cols: 100}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if got := <-resized; got != [2]int{30, 100} {
+		t.Fatalf("resized to %v, want [30 100]", got)
+	}
+}
+
+func TestServerAcceptsLegacyWindowSizes(t *testing.T) {
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	if err := os.WriteFile(rcfile, []byte("stty -echo\nsleep 0.2\nstty size\nexec cat\n"), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	server := NewServer(ln.Addr().String(), rcfile)
+	go server.serve(ln, server.handle)
+
+	// Speak the protocol exactly as a 2.0.0 client does, which gives up
+	// on any banner but its own
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	banner := make([]byte, len("JCAT/2.0.0\n"))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if string(banner) != "JCAT/2.0.0\n" {
+		t.Fatalf("invalid handshake: %s", banner)
+	}
+	conn.Write([]byte("MODE:pair\n"))
+
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		t.Fatalf("yamux error: %v", err)
+	}
+	controlChannel, err := session.Open()
+	if err != nil {
+		t.Fatalf("control channel error: %v", err)
+	}
+	if err := gob.NewEncoder(controlChannel).Encode(struct{ Rows, Cols int }{33, 101}); err != nil {
+		t.Fatalf("failed to send window size: %v", err)
+	}
+	dataChannel, err := session.Open()
+	if err != nil {
+		t.Fatalf("data channel error: %v", err)
+	}
+
+	output := &syncBuffer{}
+	go io.Copy(output, dataChannel)
+	output.waitFor(t, "33 101")
+
+	dataChannel.Write([]byte("hello\n"))
+	output.waitFor(t, "hello")
+}
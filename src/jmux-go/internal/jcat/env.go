@@ -0,0 +1,143 @@
+package jcat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxEnvValue bounds the value of a variable a guest sends
+const maxEnvValue = 128
+
+// terminalEnvAllowed reports whether name is a terminal setting a guest may
+// pass to its shell: TERM, COLORTERM and the locale
+func terminalEnvAllowed(name string) bool {
+	switch name {
+	case "TERM", "COLORTERM", "LANG", "LANGUAGE":
+		return true
+	}
+	rest, ok := strings.CutPrefix(name, "LC_")
+	if !ok || rest == "" {
+		return false
+	}
+	for _, r := range rest {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// validEnvValue reports whether value is plausible for a terminal setting.
+// Paths are never needed, and a TERM with a slash could point terminfo
+// lookups anywhere.
+func validEnvValue(value string) bool {
+	if value == "" || len(value) > maxEnvValue {
+		return false
+	}
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("._-@+=:,", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// terminalEnv returns the terminal settings of this process that a client
+// sends in its hello
+func terminalEnv() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if terminalEnvAllowed(name) && validEnvValue(value) {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// guestEnv returns the terminal settings from a guest's hello that its
+// shell gets, as NAME=value entries, or nil if the guest sent none. A TERM
+// this machine has no terminfo for is dropped, since tmux would refuse it.
+func (s *Server) guestEnv(remote string, requested map[string]string) []string {
+	if len(requested) == 0 {
+		return nil
+	}
+	env := []string{}
+	for name, value := range requested {
+		if !terminalEnvAllowed(name) || !validEnvValue(value) {
+			s.logger.Printf("[%s] ignoring environment variable %q from guest", remote, name)
+			continue
+		}
+		if name == "TERM" && !hasTerminfo(value) {
+			s.logger.Printf("[%s] no terminfo for TERM=%s, keeping the host's", remote, value)
+			continue
+		}
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// withGuestEnv returns base with the guest's terminal settings applied. A
+// guest that sent any replaces all of the host's, so that, for example, the
+// host's LC_ALL or COLORTERM cannot override what the guest's terminal
+// supports.
+func withGuestEnv(base, guest []string) []string {
+	if guest == nil {
+		return base
+	}
+	var env []string
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		// The host's TERM stays when the guest's was dropped
+		if terminalEnvAllowed(name) && (name != "TERM" || hasGuestVar(guest, "TERM")) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, guest...)
+}
+
+// hasGuestVar reports whether env sets name
+func hasGuestVar(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTerminfo reports whether a terminfo entry for term can be found in the
+// usual places
+func hasTerminfo(term string) bool {
+	var dirs []string
+	if dir := os.Getenv("TERMINFO"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".terminfo"))
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("TERMINFO_DIRS")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, "/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo", "/usr/lib/terminfo", "/usr/share/lib/terminfo")
+
+	for _, dir := range dirs {
+		// Entries live under their first letter, or its hex code on macOS
+		for _, sub := range []string{term[:1], fmt.Sprintf("%02x", term[0])} {
+			if _, err := os.Stat(filepath.Join(dir, sub, term)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
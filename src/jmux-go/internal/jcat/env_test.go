@@ -0,0 +1,64 @@
+package jcat
+
+import (
+	"log"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestGuestEnv(t *testing.T) {
+	got := (&Server{logger: log.Default()}).guestEnv("test", map[string]string{
+		"TERM":        "xterm-256color",
+		"COLORTERM":   "truecolor",
+		"LANG":        "fr_FR.UTF-8",
+		"LC_CTYPE":    "en_US.UTF-8",
+		"LD_PRELOAD":  "evil.so",
+		"LC_MESSAGES": "../../etc",
+		"PATH":        "/tmp",
+	})
+	want := []string{"COLORTERM=truecolor", "LANG=fr_FR.UTF-8", "LC_CTYPE=en_US.UTF-8"}
+	if hasTerminfo("xterm-256color") {
+		want = append(want, "TERM=xterm-256color")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("guestEnv = %q, want %q", got, want)
+	}
+
+	if got := (&Server{logger: log.Default()}).guestEnv("test", map[string]string{"TERM": "no-such-terminal"}); len(got) != 0 {
+		t.Errorf("TERM without terminfo kept: %q", got)
+	}
+	if got := (&Server{logger: log.Default()}).guestEnv("test", nil); got != nil {
+		t.Errorf("guestEnv(nil) = %q, want nil for clients that send none", got)
+	}
+}
+
+func TestShellCommandEnv(t *testing.T) {
+	server := NewServerWithOptions("127.0.0.1:0", "", ServerOptions{Shell: "sh"})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	t.Setenv("TERM", "screen")
+	t.Setenv("LC_ALL", "C")
+	t.Setenv("COLORTERM", "truecolor")
+	env := server.shellCommand(conn, ModePair, []string{"LANG=de_DE.UTF-8"}).Env
+
+	// The guest's locale wins, and settings it did not send are not the host's
+	for _, kv := range []string{"LANG=de_DE.UTF-8", "TERM=screen", "JCAT_MODE=pair"} {
+		if !slices.Contains(env, kv) {
+			t.Errorf("shell env lacks %s", kv)
+		}
+	}
+	for _, kv := range []string{"LC_ALL=C", "COLORTERM=truecolor"} {
+		if slices.Contains(env, kv) {
+			t.Errorf("shell env kept the host's %s", kv)
+		}
+	}
+
+	// Clients that send nothing leave the host's settings alone
+	if env := server.shellCommand(conn, ModePair, nil).Env; !slices.Contains(env, "LC_ALL=C") {
+		t.Errorf("host LC_ALL dropped for a client that sent no settings")
+	}
+}
@@ -0,0 +1,261 @@
+package jcat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Channels of the chunks a host sends back on an exec stream. Each chunk is
+// the channel byte, a big-endian 32-bit length and that many bytes.
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+	execExit   byte = 3 // the command's exit code, a big-endian int32
+)
+
+// maxExecChunk bounds one chunk of command output
+const maxExecChunk = 32 * 1024
+
+// ExitRemoteFailure is the exit code Exec reports, like ssh, when the
+// command could not be run at all
+const ExitRemoteFailure = 255
+
+// mayExec reports why a client in mode may not run commands, or nil if it
+// may
+func (s *Server) mayExec(mode string) error {
+	if !s.allowExec {
+		return fmt.Errorf("the host does not allow dmux exec for this share")
+	}
+	if mode == ModeView {
+		return fmt.Errorf("view-only guests cannot run commands")
+	}
+	return nil
+}
+
+// serveExec serves a client that came to run a command rather than attach
+// a terminal, until it hangs up or is kicked. Opening the exec stream ends
+// its handshake, stopping attaching.
+func (s *Server) serveExec(session *yamux.Session, remote, mode string, attaching *time.Timer, kicked <-chan string) {
+	stream, err := session.Accept()
+	if err != nil {
+		return
+	}
+	attaching.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.serveStream(session, stream, remote, mode)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case reason := <-kicked:
+		s.logger.Printf("[%s] exec cut short: %s", remote, reason)
+		session.Close()
+		<-done
+	}
+}
+
+// runExec runs the command an exec stream asks for with the guest shell,
+// in the shared session's working directory, and streams its output and
+// exit code back. The rest of the stream is the command's input.
+func (s *Server) runExec(stream net.Conn, req StreamRequest, remote, mode string) {
+	if err := s.mayExec(mode); err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	if req.Command == "" {
+		writeFrame(stream, StreamReply{Error: "no command given"})
+		return
+	}
+
+	cmd := exec.Command(s.shell, "-c", req.Command)
+	cmd.Dir = s.transferDir()
+	cmd.Env = append(os.Environ(), "JCAT_MODE="+mode)
+	if s.sessionName != "" {
+		cmd.Env = append(cmd.Env, "JMUX_SESSION_NAME="+s.sessionName)
+	}
+	// Its own process group, so the whole pipeline goes if the client does
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	out := &execWriter{w: stream}
+	cmd.Stdout = out.channel(execStdout)
+	cmd.Stderr = out.channel(execStderr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	s.logger.Printf("[%s] exec: %s", remote, req.Command)
+	if err := writeFrame(stream, StreamReply{}); err != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+		return
+	}
+
+	// A client that hangs up takes the command with it
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		io.Copy(stdin, stream)
+		stdin.Close()
+		select {
+		case <-finished:
+		case <-streamClosed(stream):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+
+	code := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			code = ExitRemoteFailure
+		} else if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		} else {
+			code = exitErr.ExitCode()
+		}
+	}
+	s.logger.Printf("[%s] exec exited with %d", remote, code)
+
+	exit := binary.BigEndian.AppendUint32(nil, uint32(int32(code)))
+	out.write(execExit, exit)
+}
+
+// streamClosed returns a channel closed once stream is closed, or nil if
+// that cannot be told
+func streamClosed(stream net.Conn) <-chan struct{} {
+	if s, ok := stream.(*yamux.Stream); ok {
+		return s.Session().CloseChan()
+	}
+	return nil
+}
+
+// execWriter writes the chunks of an exec stream, one at a time
+type execWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// write sends p as one or more chunks on channel
+func (e *execWriter) write(channel byte, p []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for {
+		n := min(len(p), maxExecChunk)
+		header := []byte{channel, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], uint32(n))
+		if _, err := e.w.Write(append(header, p[:n]...)); err != nil {
+			return err
+		}
+		if p = p[n:]; len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// channel returns a writer that sends its writes on channel
+func (e *execWriter) channel(channel byte) io.Writer {
+	return execChannel{e, channel}
+}
+
+type execChannel struct {
+	e       *execWriter
+	channel byte
+}
+
+func (c execChannel) Write(p []byte) (int, error) {
+	if err := c.e.write(c.channel, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Exec runs command with the host's shell over a connection of its own,
+// without a terminal, feeding it stdin if that is not nil and copying its
+// output to stdout and stderr. It returns the command's exit code.
+func (c *Client) Exec(command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	c.exec = true
+	conn, err := c.dial()
+	if err != nil {
+		return ExitRemoteFailure, err
+	}
+	defer conn.Close()
+	if !c.peer.Supports(FeatureExec) {
+		return ExitRemoteFailure, fmt.Errorf("the host does not support dmux exec; it needs a newer dmux")
+	}
+
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		return ExitRemoteFailure, err
+	}
+	defer session.Close()
+
+	stream, err := requestStream(session, StreamRequest{Kind: StreamExec, Command: command})
+	if err != nil {
+		return ExitRemoteFailure, err
+	}
+	defer stream.Close()
+
+	go func() {
+		if stdin != nil {
+			io.Copy(stream, stdin)
+		}
+		closeWrite(stream)
+	}()
+	return readExecOutput(stream, stdout, stderr)
+}
+
+// readExecOutput copies the output chunks of an exec stream to stdout and
+// stderr until the exit code arrives
+func readExecOutput(r io.Reader, stdout, stderr io.Writer) (int, error) {
+	header := make([]byte, 5)
+	buf := make([]byte, maxExecChunk)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return ExitRemoteFailure, fmt.Errorf("connection lost before the command finished: %v", err)
+		}
+		n := binary.BigEndian.Uint32(header[1:])
+		if n > maxExecChunk {
+			return ExitRemoteFailure, fmt.Errorf("exec chunk of %d bytes is too large", n)
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return ExitRemoteFailure, fmt.Errorf("connection lost before the command finished: %v", err)
+		}
+
+		switch header[0] {
+		case execStdout:
+			stdout.Write(chunk)
+		case execStderr:
+			stderr.Write(chunk)
+		case execExit:
+			if n != 4 {
+				return ExitRemoteFailure, fmt.Errorf("malformed exit code")
+			}
+			return int(int32(binary.BigEndian.Uint32(chunk))), nil
+		}
+	}
+}
+
+// Exec runs command on the secure host like Client.Exec, authenticating
+// for sessionName with password
+func (c *SecureClient) Exec(sessionName, password, command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	c.authenticate(sessionName, password)
+	return c.Client.Exec(command, stdin, stdout, stderr)
+}
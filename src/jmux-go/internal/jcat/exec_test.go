@@ -0,0 +1,54 @@
+package jcat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	addr := startScriptServer(t, "exec cat\n", ServerOptions{AllowExec: true})
+
+	var stdout, stderr bytes.Buffer
+	client := NewClientWithOptions(addr, ClientOptions{NoReconnect: true})
+	code, err := client.Exec("echo out; echo err >&2; cat; exit 3", strings.NewReader("in\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if stdout.String() != "out\nin\n" {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	if stderr.String() != "err\n" {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+}
+
+func TestExecRefusals(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+		mode string
+		want string
+	}{
+		{"host did not allow exec", ServerOptions{}, ModePair, "does not allow dmux exec"},
+		{"view guests cannot run commands", ServerOptions{AllowExec: true}, ModeView, "view-only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startScriptServer(t, "exec cat\n", tt.opts)
+
+			var out bytes.Buffer
+			client := NewClientWithOptions(addr, ClientOptions{Mode: tt.mode, NoReconnect: true})
+			code, err := client.Exec("touch ran", nil, &out, &out)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Exec error = %v, want %q", err, tt.want)
+			}
+			if code != ExitRemoteFailure {
+				t.Fatalf("exit code = %d, want %d", code, ExitRemoteFailure)
+			}
+		})
+	}
+}
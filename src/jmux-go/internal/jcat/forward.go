@@ -0,0 +1,290 @@
+package jcat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// forwardDialTimeout bounds how long either side tries to reach a
+// forwarding target
+const forwardDialTimeout = 10 * time.Second
+
+// Forward is a TCP port forwarding: connections accepted on Listen are
+// carried over the session and connected to Target on the other side
+type Forward struct {
+	Listen string // host:port to listen on
+	Target string // host:port to connect to at the other end
+}
+
+func (f Forward) String() string {
+	return f.Listen + " -> " + f.Target
+}
+
+// ParseForward parses an ssh style forwarding spec,
+// [bind_address:]port:host:hostport. Without a bind address only loopback
+// connections are accepted. IPv6 addresses go in brackets.
+func ParseForward(spec string) (Forward, error) {
+	parts, err := splitForward(spec)
+	if err != nil {
+		return Forward{}, err
+	}
+
+	var bind, port, host, hostPort string
+	switch len(parts) {
+	case 3:
+		bind, port, host, hostPort = "localhost", parts[0], parts[1], parts[2]
+	case 4:
+		bind, port, host, hostPort = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return Forward{}, fmt.Errorf("invalid forward %q: want [bind_address:]port:host:hostport", spec)
+	}
+	for _, p := range []string{port, hostPort} {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+			return Forward{}, fmt.Errorf("invalid port %q in forward %q", p, spec)
+		}
+	}
+	if host == "" {
+		return Forward{}, fmt.Errorf("missing host in forward %q", spec)
+	}
+	return Forward{
+		Listen: net.JoinHostPort(bind, port),
+		Target: net.JoinHostPort(host, hostPort),
+	}, nil
+}
+
+// splitForward splits spec on the colons outside brackets, dropping the
+// brackets
+func splitForward(spec string) ([]string, error) {
+	var parts []string
+	var part strings.Builder
+	bracketed := false
+	for _, r := range spec {
+		switch {
+		case r == '[' && !bracketed:
+			bracketed = true
+		case r == ']' && bracketed:
+			bracketed = false
+		case r == ':' && !bracketed:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	if bracketed {
+		return nil, fmt.Errorf("unclosed bracket in forward %q", spec)
+	}
+	return append(parts, part.String()), nil
+}
+
+// mayForward reports why a guest in mode may not forward ports, or nil if
+// it may
+func (s *Server) mayForward(mode string) error {
+	if !s.allowForward {
+		return fmt.Errorf("port forwarding is turned off for this share")
+	}
+	if mode == ModeView {
+		return fmt.Errorf("view-only guests cannot forward ports")
+	}
+	return nil
+}
+
+// serveForward connects a guest's forwarded connection to its target on
+// the host
+func (s *Server) serveForward(stream net.Conn, req StreamRequest, remote, mode string) {
+	if err := s.mayForward(mode); err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	target, err := net.DialTimeout("tcp", req.Addr, forwardDialTimeout)
+	if err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	defer target.Close()
+	if err := writeFrame(stream, StreamReply{}); err != nil {
+		return
+	}
+	join(stream, target)
+}
+
+// serveListen listens on the host for a guest's reverse forwarding until
+// the guest closes the stream that asked for it, carrying each connection
+// to the guest over a stream of its own
+func (s *Server) serveListen(session *yamux.Session, stream net.Conn, req StreamRequest, remote, mode string) {
+	if err := s.mayForward(mode); err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	ln, err := net.Listen("tcp", req.Addr)
+	if err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	defer ln.Close()
+	if err := writeFrame(stream, StreamReply{Addr: ln.Addr().String()}); err != nil {
+		return
+	}
+	s.logger.Printf("[%s] forwarding %s to the guest", remote, ln.Addr())
+
+	go func() {
+		io.Copy(io.Discard, stream)
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			back, err := requestStream(session, StreamRequest{Kind: StreamForward, Addr: req.Addr})
+			if err != nil {
+				s.logger.Printf("[%s] reverse forward of %s failed: %v", remote, req.Addr, err)
+				return
+			}
+			defer back.Close()
+			join(conn, back)
+		}()
+	}
+}
+
+// listenForwards starts listening for the client's local forwardings and
+// returns a function that stops them
+func (c *Client) listenForwards() (func(), error) {
+	var listeners []net.Listener
+	stop := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for _, fwd := range c.localForwards {
+		ln, err := net.Listen("tcp", fwd.Listen)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("cannot forward %s: %v", fwd, err)
+		}
+		listeners = append(listeners, ln)
+		go c.forwardLocal(ln, fwd.Target)
+	}
+	return stop, nil
+}
+
+// forwardLocal carries each connection accepted on ln to target on the host
+// over the current connection
+func (c *Client) forwardLocal(ln net.Listener, target string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			live := c.live.Load()
+			if live == nil || !live.peer.Supports(FeatureForward) {
+				return
+			}
+			stream, err := requestStream(live.session, StreamRequest{Kind: StreamForward, Addr: target})
+			if err != nil {
+				c.logger.Printf("forward to %s failed: %v", target, err)
+				return
+			}
+			defer stream.Close()
+			join(conn, stream)
+		}()
+	}
+}
+
+// requestRemoteForwards asks the host to listen for the client's reverse
+// forwardings for as long as session lasts
+func (c *Client) requestRemoteForwards(session *yamux.Session, out io.Writer) {
+	for _, fwd := range c.remoteForwards {
+		go func() {
+			stream, err := requestStream(session, StreamRequest{Kind: StreamListen, Addr: fwd.Listen})
+			if err != nil {
+				notice(out, "cannot forward %s: %v", fwd, err)
+				return
+			}
+			defer stream.Close()
+			<-session.CloseChan()
+		}()
+	}
+}
+
+// acceptStreams serves the streams the host opens, which carry connections
+// to the client's reverse forwardings
+func (c *Client) acceptStreams(session *yamux.Session) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go c.serveForward(stream)
+	}
+}
+
+// serveForward connects a connection the host accepted for a reverse
+// forwarding to the target the client set up for it
+func (c *Client) serveForward(stream net.Conn) {
+	defer stream.Close()
+
+	var req StreamRequest
+	if err := readFrame(stream, &req); err != nil {
+		return
+	}
+	target := ""
+	for _, fwd := range c.remoteForwards {
+		if req.Kind == StreamForward && fwd.Listen == req.Addr {
+			target = fwd.Target
+		}
+	}
+	if target == "" {
+		writeFrame(stream, StreamReply{Error: fmt.Sprintf("no forwarding for %s", req.Addr)})
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", target, forwardDialTimeout)
+	if err != nil {
+		writeFrame(stream, StreamReply{Error: err.Error()})
+		return
+	}
+	defer conn.Close()
+	if err := writeFrame(stream, StreamReply{}); err != nil {
+		return
+	}
+	join(stream, conn)
+}
+
+// join copies a and b to each other until both directions end, passing
+// each end of input on as a half close
+func join(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		closeWrite(a)
+		close(done)
+	}()
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+}
+
+// closeWrite ends the sending side of conn, keeping it open for reading
+// where the connection allows it
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+	case *yamux.Stream:
+		// Closing a yamux stream only ends our side of it
+		c.Close()
+	default:
+		conn.Close()
+	}
+}
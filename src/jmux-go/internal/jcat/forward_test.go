@@ -0,0 +1,172 @@
+package jcat
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Forward
+		err  string
+	}{
+		{"3000:localhost:3000", Forward{"localhost:3000", "localhost:3000"}, ""},
+		{"0.0.0.0:8080:db:5432", Forward{"0.0.0.0:8080", "db:5432"}, ""},
+		{"[::1]:2222:[fe80::1]:22", Forward{"[::1]:2222", "[fe80::1]:22"}, ""},
+		{"3000:localhost", Forward{}, "want [bind_address:]port:host:hostport"},
+		{"3000::3000", Forward{}, "missing host"},
+		{"http:localhost:80", Forward{}, "invalid port"},
+		{"[::1:2222:host:22", Forward{}, "unclosed bracket"},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseForward(%q) error = %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseForward(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+// startEcho starts a TCP server that echoes each line back in upper case
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					io.WriteString(conn, strings.ToUpper(scanner.Text())+"\n")
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// joinWithForwards connects a guest with the forwards in clientOpts to a
+// server started with opts
+func joinWithForwards(t *testing.T, opts ServerOptions, clientOpts ClientOptions) {
+	t.Helper()
+	addr := startScriptServer(t, "stty -echo\necho ready\nexec cat\n", opts)
+
+	clientOpts.NoReconnect = true
+	client := NewClientWithOptions(addr, clientOpts)
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	stop, err := client.listenForwards()
+	if err != nil {
+		t.Fatalf("failed to listen for forwards: %v", err)
+	}
+	t.Cleanup(stop)
+
+	stdinReader, stdinWriter := io.Pipe()
+	t.Cleanup(func() { stdinWriter.Close() })
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+	go client.run(conn, readInput(stdinReader), output, sizes)
+	output.waitFor(t, "ready")
+}
+
+// echoThrough sends a line to addr, retrying until something listens there,
+// and returns the reply
+func echoThrough(t *testing.T, addr string) (string, error) {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("nothing listens on %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "ping\n")
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestLocalForward(t *testing.T) {
+	target := startEcho(t)
+	listen := freeAddr(t)
+	joinWithForwards(t, ServerOptions{AllowForward: true}, ClientOptions{
+		Mode:          ModePair,
+		LocalForwards: []Forward{{Listen: listen, Target: target}},
+	})
+
+	if reply, err := echoThrough(t, listen); err != nil || reply != "PING\n" {
+		t.Fatalf("reply through -L = %q, %v", reply, err)
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	target := startEcho(t)
+	listen := freeAddr(t)
+	joinWithForwards(t, ServerOptions{AllowForward: true}, ClientOptions{
+		Mode:           ModeRogue,
+		RemoteForwards: []Forward{{Listen: listen, Target: target}},
+	})
+
+	if reply, err := echoThrough(t, listen); err != nil || reply != "PING\n" {
+		t.Fatalf("reply through -R = %q, %v", reply, err)
+	}
+}
+
+func TestForwardRefusals(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+		mode string
+	}{
+		{"host did not allow forwarding", ServerOptions{}, ModePair},
+		{"view guests cannot forward", ServerOptions{AllowForward: true}, ModeView},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := startEcho(t)
+			listen := freeAddr(t)
+			joinWithForwards(t, tt.opts, ClientOptions{
+				Mode:          tt.mode,
+				LocalForwards: []Forward{{Listen: listen, Target: target}},
+			})
+			if reply, err := echoThrough(t, listen); err == nil {
+				t.Fatalf("forward was carried, got %q", reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package jcat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"jmux/internal/version"
+)
+
+// ProtocolVersion is the handshake protocol this build speaks. Protocol 1 is
+// the standalone jcat binary, whose clients start yamux right away;
+// protocol 2 clients send a MODE: line; protocol 3 clients and servers
+// exchange framed hellos. Plain protocol 3 servers announce themselves with
+// the protocol 2 banner, which older clients insist on, and say protocol 3
+// in their hello; secure servers announce protocol 3 in their banner.
+const ProtocolVersion = 3
+
+// Features a client may offer in its hello. The server answers with the
+// ones it supports and allows.
+const (
+	FeatureControl  = "control"  // versioned control channel messages
+	FeatureResume   = "resume"   // shells survive a dropped connection
+	FeatureCompress = "compress" // compressed shell output
+	FeatureFiles    = "files"    // file transfer streams
+	FeatureForward  = "forward"  // TCP port forwarding streams
+	FeatureExec     = "exec"     // commands run without a terminal
+)
+
+// helloMagic starts every frame: the handshake hellos and the headers of
+// extra streams. It cannot be mistaken for the M of a MODE: line or for the
+// zero version byte of a yamux frame.
+var helloMagic = [2]byte{'J', 'H'}
+
+// refusedBanner starts the line a server sends in place of its banner when
+// it turns a client away, followed by the reason
+const refusedBanner = "JCAT/refused "
+
+// maxBannerLine bounds the banner line, or the refusal sent instead of it
+const maxBannerLine = 256
+
+// maxFrameSize bounds a frame
+const maxFrameSize = 16 * 1024
+
+// Hello is the handshake frame each side sends once the banner is out
+type Hello struct {
+	Protocol int      `json:"protocol"`
+	Version  string   `json:"version"`            // dmux version of the sender
+	User     string   `json:"user,omitempty"`     // client: who is joining
+	Mode     string   `json:"mode,omitempty"`     // mode asked for, or granted by the server
+	Features []string `json:"features,omitempty"` // offered by the client, accepted by the server
+	Error    string   `json:"error,omitempty"`    // server: why the client was refused
+	Exec     bool     `json:"exec,omitempty"`     // client: runs a command instead of attaching a terminal
+	Invite   string   `json:"invite,omitempty"`   // client: token of its invitation to the share
+	Resume   string   `json:"resume,omitempty"`   // client: resume token of the session it reconnects to
+
+	// Env holds the client's terminal settings, TERM, COLORTERM and the
+	// locale, for the server to give its shell
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// Supports reports whether feature is in the hello's feature list
+func (h Hello) Supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBanner reads the protocol version from a server banner such as
+// "JCAT/3.0.0" or "JCAT/3.0.0+SEC", and whether the server is secure
+func parseBanner(line string) (protocol int, secure bool, err error) {
+	line = strings.TrimSpace(line)
+	if reason, ok := strings.CutPrefix(line, refusedBanner); ok {
+		return 0, false, fmt.Errorf("server refused connection: %s", reason)
+	}
+	rest, ok := strings.CutPrefix(line, "JCAT/")
+	if !ok {
+		return 0, false, fmt.Errorf("not a jcat server (it sent %q)", line)
+	}
+	rest, secure = strings.CutSuffix(rest, "+SEC")
+	major, _, _ := strings.Cut(rest, ".")
+	protocol, err = strconv.Atoi(major)
+	if err != nil || protocol < 1 {
+		return 0, false, fmt.Errorf("unrecognized jcat server version %q", rest)
+	}
+	if protocol > ProtocolVersion {
+		return 0, false, fmt.Errorf("server speaks jcat protocol %d but this dmux only speaks up to %d; upgrade dmux (this is %s) to join",
+			protocol, ProtocolVersion, version.GetVersion())
+	}
+	return protocol, secure, nil
+}
+
+// writeFrame sends v as a frame: magic, big-endian length, JSON
+func writeFrame(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 0, len(helloMagic)+4+len(body))
+	frame = append(frame, helloMagic[:]...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = append(frame, body...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrameBody reads the rest of a frame after its magic into v
+func readFrameBody(r io.Reader, v any) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("malformed frame: %v", err)
+	}
+	return nil
+}
+
+// readFrame reads a frame into v
+func readFrame(r io.Reader, v any) error {
+	var magic [2]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if magic != helloMagic {
+		return fmt.Errorf("expected a frame, got %q", magic[:])
+	}
+	return readFrameBody(r, v)
+}
+
+// readClientHello reads what a client sends after the banner: a hello, or
+// the MODE: line of a protocol 2 client. A protocol 1 client starts yamux
+// straight away; the bytes read from it are returned in pending and must be
+// replayed to yamux.
+func readClientHello(r io.Reader) (hello Hello, pending []byte, err error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return hello, nil, err
+	}
+
+	switch first[0] {
+	case helloMagic[0]:
+		second := make([]byte, 1)
+		if _, err := io.ReadFull(r, second); err != nil {
+			return hello, nil, err
+		}
+		if second[0] != helloMagic[1] {
+			return hello, nil, fmt.Errorf("unrecognized handshake %q", append(first, second...))
+		}
+		err = readFrameBody(r, &hello)
+		if err == nil && hello.Protocol < 3 {
+			err = fmt.Errorf("hello claims protocol %d", hello.Protocol)
+		}
+		return hello, nil, err
+	case 'M':
+		// Read no further than the line, since yamux frames follow it
+		line, err := readLine(r, 256)
+		if err != nil {
+			return hello, nil, err
+		}
+		mode, ok := strings.CutPrefix("M"+line, "MODE:")
+		if !ok {
+			return hello, nil, fmt.Errorf("unrecognized handshake %q", "M"+line)
+		}
+		return Hello{Protocol: 2, Mode: strings.TrimSpace(mode)}, nil, nil
+	case 0:
+		// The version byte of a yamux frame header
+		return Hello{Protocol: 1}, first, nil
+	default:
+		return hello, nil, fmt.Errorf("unrecognized handshake byte %#x", first[0])
+	}
+}
+
+// clientHello builds the hello a client sends
+func (c *Client) clientHello() Hello {
+	return Hello{
+		Protocol: ProtocolVersion,
+		Version:  version.GetVersion(),
+		User:     c.user,
+		Mode:     c.mode,
+		Features: []string{FeatureControl, FeatureResume, FeatureCompress, FeatureFiles, FeatureForward, FeatureExec},
+		Exec:     c.exec,
+		Invite:   c.invite,
+		Resume:   c.resume,
+		Env:      terminalEnv(),
+	}
+}
+
+// handshake tells the server who is joining and how, once its banner says
+// which protocol it speaks, and returns the server's answer
+func (c *Client) handshake(conn io.ReadWriter, protocol int) (Hello, error) {
+	if protocol == 1 {
+		// The standalone jcat binary grants nothing and is told nothing
+		return Hello{Protocol: 1}, nil
+	}
+
+	if err := writeFrame(conn, c.clientHello()); err != nil {
+		return Hello{}, fmt.Errorf("failed to send hello: %v", err)
+	}
+	var reply Hello
+	if err := readFrame(conn, &reply); err != nil {
+		if protocol == 2 {
+			return Hello{}, fmt.Errorf("failed to read server hello: %v; a host on dmux 2.0.0 must upgrade before this dmux can join it", err)
+		}
+		return Hello{}, fmt.Errorf("failed to read server hello: %v", err)
+	}
+	if reply.Protocol < 3 {
+		return Hello{}, fmt.Errorf("server hello claims protocol %d", reply.Protocol)
+	}
+	if reply.Error != "" {
+		return reply, fmt.Errorf("server refused connection: %s", reply.Error)
+	}
+	return reply, nil
+}
+
+// features returns the features the server allows a guest in mode
+func (s *Server) features(mode string) []string {
+	features := []string{FeatureControl}
+	if s.resumeGrace > 0 {
+		features = append(features, FeatureResume)
+	}
+	if s.compress {
+		features = append(features, FeatureCompress)
+	}
+	if !s.noFiles {
+		features = append(features, FeatureFiles)
+	}
+	if s.mayForward(mode) == nil {
+		features = append(features, FeatureForward)
+	}
+	if s.mayExec(mode) == nil {
+		features = append(features, FeatureExec)
+	}
+	return features
+}
+
+// acceptHello answers a client's hello with the mode granted to it and the
+// features both sides support, or refuses it with refusal. Clients older
+// than protocol 3 are not answered.
+func (s *Server) acceptHello(conn io.Writer, hello Hello, grantedMode string, refusal error) error {
+	if hello.Protocol < 3 {
+		return nil
+	}
+	reply := Hello{Protocol: ProtocolVersion, Version: version.GetVersion()}
+	if refusal != nil {
+		reply.Error = refusal.Error()
+		return writeFrame(conn, reply)
+	}
+	reply.Mode = grantedMode
+	for _, feature := range s.features(grantedMode) {
+		if hello.Supports(feature) {
+			reply.Features = append(reply.Features, feature)
+		}
+	}
+	return writeFrame(conn, reply)
+}
+
+// prefixConn replays bytes read during the handshake before the rest of
+// the connection
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// newPrefixConn returns conn with pending put back in front of it
+func newPrefixConn(conn net.Conn, pending []byte) net.Conn {
+	return &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(pending), conn)}
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
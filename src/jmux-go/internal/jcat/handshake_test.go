@@ -0,0 +1,192 @@
+package jcat
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestParseBanner(t *testing.T) {
+	tests := []struct {
+		banner   string
+		protocol int
+		secure   bool
+		err      string
+	}{
+		{"JCAT/3.0.0\n", 3, false, ""},
+		{"JCAT/3.1.4+SEC\n", 3, true, ""},
+		{"JCAT/2.0.0\n", 2, false, ""},
+		{"JCAT/1.0.0\n", 1, false, ""},
+		{"JCAT/4.0.0\n", 0, false, "upgrade dmux"},
+		{"JCAT/banana\n", 0, false, "unrecognized"},
+		{"SSH-2.0-OpenSSH_9.6\n", 0, false, "not a jcat server"},
+		{"JCAT/refused the share is full (at most 4 guests)\n", 0, false, "server refused connection: the share is full"},
+	}
+	for _, tt := range tests {
+		protocol, secure, err := parseBanner(tt.banner)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseBanner(%q) error = %v, want %q", tt.banner, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || protocol != tt.protocol || secure != tt.secure {
+			t.Errorf("parseBanner(%q) = %d, %v, %v", tt.banner, protocol, secure, err)
+		}
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	var framed bytes.Buffer
+	writeFrame(&framed, Hello{Protocol: 3, User: "alice", Mode: ModeView, Features: []string{FeatureResume}})
+	framed.WriteString("yamux")
+
+	hello, pending, err := readClientHello(&framed)
+	if err != nil || pending != nil {
+		t.Fatalf("framed hello: %v, pending %q", err, pending)
+	}
+	if hello.User != "alice" || hello.Mode != ModeView || !hello.Supports(FeatureResume) {
+		t.Fatalf("framed hello = %+v", hello)
+	}
+	if framed.String() != "yamux" {
+		t.Fatalf("read past the hello, left %q", framed.String())
+	}
+
+	legacy := strings.NewReader("MODE:rogue\nyamux")
+	hello, _, err = readClientHello(legacy)
+	if err != nil || hello.Protocol != 2 || hello.Mode != ModeRogue {
+		t.Fatalf("MODE line = %+v, %v", hello, err)
+	}
+	if rest, _ := io.ReadAll(legacy); string(rest) != "yamux" {
+		t.Fatalf("read past the MODE line, left %q", rest)
+	}
+
+	hello, pending, err = readClientHello(strings.NewReader("\x00\x01"))
+	if err != nil || hello.Protocol != 1 || !bytes.Equal(pending, []byte{0}) {
+		t.Fatalf("protocol 1 client = %+v, pending %q, %v", hello, pending, err)
+	}
+
+	if _, _, err := readClientHello(strings.NewReader("GET / HTTP/1.1\r\n")); err == nil {
+		t.Fatalf("accepted an HTTP request as a hello")
+	}
+}
+
+func TestServerRefusesWithReason(t *testing.T) {
+	addr := startScriptServer(t, "exec cat\n", ServerOptions{})
+
+	client := NewClientWithOptions(addr, ClientOptions{Mode: "bogus"})
+	_, err := client.dial()
+	if err == nil || !strings.Contains(err.Error(), `unknown mode "bogus"`) {
+		t.Fatalf("dial error = %v, want the server's reason", err)
+	}
+}
+
+func TestClientJoinsProtocol1Server(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// Serve one guest the way the standalone jcat binary does
+	sizes := make(chan [2]int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("JCAT/1.0.0\n"))
+		session, err := yamux.Server(conn, yamuxConfig())
+		if err != nil {
+			return
+		}
+		controlChannel, err := session.Accept()
+		if err != nil {
+			return
+		}
+		var win struct{ Rows, Cols int }
+		if gob.NewDecoder(controlChannel).Decode(&win) == nil {
+			sizes <- [2]int{win.Rows, win.Cols}
+		}
+		dataChannel, err := session.Accept()
+		if err != nil {
+			return
+		}
+		dataChannel.Write([]byte("hello from jcat 1.0.0\n"))
+		dataChannel.Close()
+		session.Close()
+	}()
+
+	client := NewClientWithOptions(ln.Addr().String(), ClientOptions{NoReconnect: true})
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	winSizes := make(chan WinSize, 1)
+	winSizes <- WinSize{Rows: 40, Cols: 120}
+
+	go client.run(conn, readInput(stdinReader), output, winSizes)
+	output.waitFor(t, "hello from jcat 1.0.0")
+	if got := <-sizes; got != [2]int{40, 120} {
+		t.Fatalf("server got window size %v, want [40 120]", got)
+	}
+}
+
+func TestServerAcceptsStandaloneClients(t *testing.T) {
+	addr := startScriptServer(t, "stty -echo\nstty size\nexec cat\n", ServerOptions{Standalone: true})
+
+	// Speak the protocol exactly as the standalone jcat client does, which
+	// gives up on any banner but its own
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	banner := make([]byte, len("JCAT/1.0.0\n"))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if string(banner) != "JCAT/1.0.0\n" {
+		t.Fatalf("invalid handshake: %s", banner)
+	}
+
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		t.Fatalf("yamux error: %v", err)
+	}
+	controlChannel, err := session.Open()
+	if err != nil {
+		t.Fatalf("control channel error: %v", err)
+	}
+	if err := gob.NewEncoder(controlChannel).Encode(struct{ Rows, Cols int }{27, 91}); err != nil {
+		t.Fatalf("failed to send window size: %v", err)
+	}
+	dataChannel, err := session.Open()
+	if err != nil {
+		t.Fatalf("data channel error: %v", err)
+	}
+
+	output := &syncBuffer{}
+	go io.Copy(output, dataChannel)
+	output.waitFor(t, "27 91")
+	dataChannel.Write([]byte("hello\n"))
+	output.waitFor(t, "hello")
+
+	// dmux clients join such a server as they would the binary
+	var wire atomic.Int64
+	out := catSession(t, startScriptServer(t, "echo joined\nexit 0\n", ServerOptions{Standalone: true}), ClientOptions{NoReconnect: true}, &wire, 0)
+	if !strings.Contains(out, "joined") {
+		t.Errorf("output = %q", out)
+	}
+}
@@ -0,0 +1,446 @@
+package jcat
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/hashicorp/yamux"
+	"jmux/internal/recording"
+)
+
+// hubGuestBacklog is how many output chunks may queue up for one guest
+// before it is considered too slow and disconnected
+const hubGuestBacklog = 256
+
+// InputPolicy decides what happens to the keystrokes of a hub guest
+type InputPolicy int
+
+const (
+	// InputShared forwards everything the guest types to the shared PTY
+	InputShared InputPolicy = iota
+	// InputNone drops the guest's input so it can only watch
+	InputNone
+)
+
+// inputPolicyForMode maps a sharing mode to the input policy of its guests
+func inputPolicyForMode(mode string) InputPolicy {
+	if mode == ModeView {
+		return InputNone
+	}
+	return InputShared
+}
+
+// Hub owns a single shell PTY and fans its output out to every attached
+// guest, merging guest input according to each guest's policy
+type Hub struct {
+	command  func(conn net.Conn, mode string, env []string) *exec.Cmd
+	record   func() *recording.Recorder
+	compress bool          // compress output for guests that ask for it
+	grace    time.Duration // how long a guest's resume token outlives its connection
+	logger   *log.Logger   // where the hub logs guests and errors
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	pty      *os.File
+	recorder *recording.Recorder
+	guests   map[*hubGuest]struct{}
+	tokens   map[string]*hubToken // resume tokens handed to guests
+
+	inputMu sync.Mutex // serializes guest writes so chunks never interleave
+}
+
+// hubToken is a resume token the hub gave a guest
+type hubToken struct {
+	user    string    // guest it was given to
+	expires time.Time // zero while the guest is attached
+}
+
+// hubGuest is one connection attached to a hub
+type hubGuest struct {
+	remote string
+	out    chan []byte
+
+	mu          sync.Mutex
+	policy      InputPolicy
+	rows, cols  int
+	shellExited bool // left because the shared shell exited
+
+	gone     chan struct{}
+	goneOnce sync.Once
+}
+
+// newHub creates a hub that starts its shell with command on first use and
+// opens a recording from record each time the shell starts
+func newHub(command func(conn net.Conn, mode string, env []string) *exec.Cmd, record func() *recording.Recorder) *Hub {
+	return &Hub{
+		command: command,
+		record:  record,
+		guests:  make(map[*hubGuest]struct{}),
+		tokens:  make(map[string]*hubToken),
+	}
+}
+
+// issueToken returns a new resume token for user, good until it is
+// released and its grace has passed
+func (h *Hub) issueToken(user string) (string, error) {
+	token, err := newResumeToken()
+	if err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	h.tokens[token] = &hubToken{user: user}
+	h.mu.Unlock()
+	return token, nil
+}
+
+// releaseToken starts the grace after which token, whose guest has gone,
+// stops letting it back in
+func (h *Hub) releaseToken(token string, grace time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tokens[token]
+	switch {
+	case !ok:
+	case grace <= 0:
+		delete(h.tokens, token)
+	default:
+		t.expires = time.Now().Add(grace)
+	}
+}
+
+// resumable reports whether token is one the hub gave user to reconnect
+// with and is still good
+func (h *Hub) resumable(token, user string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tokens[token]
+	if !ok {
+		return false
+	}
+	if !t.expires.IsZero() && time.Now().After(t.expires) {
+		delete(h.tokens, token)
+		return false
+	}
+	return t.user == user
+}
+
+// leave marks the guest as disconnected
+func (g *hubGuest) leave() {
+	g.goneOnce.Do(func() { close(g.gone) })
+}
+
+// inputPolicy returns the guest's current input policy
+func (g *hubGuest) inputPolicy() InputPolicy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.policy
+}
+
+// setInputPolicy changes the guest's input policy
+func (g *hubGuest) setInputPolicy(policy InputPolicy) {
+	g.mu.Lock()
+	g.policy = policy
+	g.mu.Unlock()
+}
+
+// serve attaches user's guest to the hub until it disconnects or the shared
+// shell exits, calling streams once the guest may open extra streams. A
+// reason received from kicked disconnects the guest for good.
+func (h *Hub) serve(session *yamux.Session, conn net.Conn, user, mode string, env []string, stats *connStats, streams func(), kicked <-chan string) {
+	remote := conn.RemoteAddr().String()
+
+	// Control channel for window size updates
+	controlChannel, err := session.Accept()
+	if err != nil {
+		h.logger.Printf("[%s] control channel accept error: %v", remote, err)
+		return
+	}
+	control := newControlConn(controlChannel)
+
+	hello, err := control.receive()
+	if err != nil {
+		h.logger.Printf("[%s] control read error: %v", remote, err)
+		return
+	}
+
+	// The shared shell outlives any one guest, so a guest that reconnects
+	// simply attaches again; the token lets it back in for a while after
+	// it drops, and is traded for a fresh one when it does
+	reply := ControlMessage{
+		Kind:        KindHello,
+		Mode:        mode,
+		Compression: negotiateCompression(hello.Compression, h.compress),
+	}
+	h.releaseToken(hello.Resume, 0)
+	if hello.CanResume {
+		if reply.Token, err = h.issueToken(user); err != nil {
+			h.logger.Printf("[%s] resume token error: %v", remote, err)
+		}
+	}
+	grace := h.grace
+	defer func() { h.releaseToken(reply.Token, grace) }()
+	if err := control.sendVersioned(reply); err != nil {
+		h.logger.Printf("[%s] control write error: %v", remote, err)
+	}
+
+	// Data channel for I/O
+	dataChannel, err := session.Accept()
+	if err != nil {
+		h.logger.Printf("[%s] data channel accept error: %v", remote, err)
+		return
+	}
+	streams()
+
+	guest := &hubGuest{
+		remote: remote,
+		out:    make(chan []byte, hubGuestBacklog),
+		policy: inputPolicyForMode(mode),
+		rows:   hello.Rows,
+		cols:   hello.Cols,
+		gone:   make(chan struct{}),
+	}
+	if err := h.attach(guest, conn, env); err != nil {
+		h.logger.Printf("[%s] hub error: %v", remote, err)
+		return
+	}
+	defer h.detach(guest)
+	h.logger.Printf("[%s] attached to shared hub (%d guests)", remote, h.guestCount())
+	h.resize()
+
+	go stats.measure(control, guest.gone)
+	go func() {
+		defer guest.leave()
+		serveControl(control, h.logger, remote, stats, func(rows, cols int) error {
+			guest.mu.Lock()
+			guest.rows, guest.cols = rows, cols
+			guest.mu.Unlock()
+			h.resize()
+			return nil
+		})
+	}()
+
+	var out io.Writer = &countingWriter{w: dataChannel, n: &stats.out}
+	if reply.Compression != "" {
+		out = newCompressWriter(out)
+	}
+
+	go func() {
+		defer guest.leave()
+		for {
+			select {
+			case chunk := <-guest.out:
+				if _, err := out.Write(chunk); err != nil {
+					return
+				}
+			case <-guest.gone:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer guest.leave()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := dataChannel.Read(buf)
+			if n > 0 {
+				stats.in.Add(int64(n))
+				h.input(guest, buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-guest.gone:
+	case reason := <-kicked:
+		grace = 0
+		notifyEnd(session, control, dataChannel, ControlMessage{Kind: KindKick, Text: reason})
+		return
+	}
+
+	guest.mu.Lock()
+	shellExited := guest.shellExited
+	guest.mu.Unlock()
+	if shellExited {
+		grace = 0
+		notifyEnd(session, control, dataChannel, ControlMessage{Kind: KindExit})
+	}
+}
+
+// attach registers a guest, starting the shared shell if it is not running.
+// The shell gets the terminal settings in env of whoever starts it.
+func (h *Hub) attach(guest *hubGuest, conn net.Conn, env []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pty == nil {
+		// The hub's own tmux client always runs in pair mode; view guests
+		// are restricted by their input policy instead
+		cmd := h.command(conn, ModePair, env)
+		shellPty, err := pty.Start(cmd)
+		if err != nil {
+			return err
+		}
+		h.cmd = cmd
+		h.pty = shellPty
+		h.recorder = h.record()
+		go h.pump(cmd, shellPty, h.recorder)
+	}
+
+	h.guests[guest] = struct{}{}
+
+	// A resize makes tmux redraw, giving the newcomer a full screen
+	if h.cmd.Process != nil {
+		syscall.Kill(h.cmd.Process.Pid, syscall.SIGWINCH)
+	}
+	return nil
+}
+
+// detach removes a guest and stops the shared shell once nobody is left
+func (h *Hub) detach(guest *hubGuest) {
+	guest.leave()
+
+	h.mu.Lock()
+	delete(h.guests, guest)
+	var idlePty *os.File
+	if len(h.guests) == 0 && h.pty != nil {
+		idlePty = h.pty
+		h.pty = nil
+		h.cmd = nil
+		h.recorder = nil
+	}
+	h.mu.Unlock()
+
+	if idlePty != nil {
+		idlePty.Close()
+	} else {
+		h.resize()
+	}
+}
+
+// kill kills the shared shell, if it is running
+func (h *Hub) kill() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cmd != nil && h.cmd.Process != nil {
+		h.cmd.Process.Kill()
+	}
+}
+
+// guestCount returns the number of attached guests
+func (h *Hub) guestCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.guests)
+}
+
+// pump reads the shared PTY and queues its output for every guest
+func (h *Hub) pump(cmd *exec.Cmd, shellPty *os.File, recorder *recording.Recorder) {
+	defer recorder.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := shellPty.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			recorder.Write(chunk)
+
+			h.mu.Lock()
+			for guest := range h.guests {
+				select {
+				case guest.out <- chunk:
+				default:
+					h.logger.Printf("[%s] guest too slow, disconnecting", guest.remote)
+					guest.leave()
+				}
+			}
+			h.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		h.logger.Printf("hub shell exited: %v", err)
+	}
+
+	// The shell is gone, so every guest still attached to it is done
+	h.mu.Lock()
+	if h.pty == shellPty {
+		h.pty = nil
+		h.cmd = nil
+		h.recorder = nil
+		for guest := range h.guests {
+			guest.mu.Lock()
+			guest.shellExited = true
+			guest.mu.Unlock()
+			guest.leave()
+		}
+	}
+	h.mu.Unlock()
+	shellPty.Close()
+}
+
+// input merges a chunk of guest input into the shared PTY
+func (h *Hub) input(guest *hubGuest, p []byte) {
+	if guest.inputPolicy() == InputNone {
+		return
+	}
+
+	h.mu.Lock()
+	shellPty := h.pty
+	h.mu.Unlock()
+	if shellPty == nil {
+		return
+	}
+
+	h.inputMu.Lock()
+	defer h.inputMu.Unlock()
+	shellPty.Write(p)
+}
+
+// resize sizes the shared PTY to the smallest window among the guests so
+// that everyone sees the whole screen
+func (h *Hub) resize() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pty == nil {
+		return
+	}
+
+	rows, cols := 0, 0
+	for guest := range h.guests {
+		guest.mu.Lock()
+		if guest.rows > 0 && (rows == 0 || guest.rows < rows) {
+			rows = guest.rows
+		}
+		if guest.cols > 0 && (cols == 0 || guest.cols < cols) {
+			cols = guest.cols
+		}
+		guest.mu.Unlock()
+	}
+	if rows == 0 || cols == 0 {
+		return
+	}
+
+	if err := setSize(h.pty, rows, cols); err != nil {
+		h.logger.Printf("hub setsize error: %v", err)
+		return
+	}
+	h.recorder.Resize(rows, cols)
+	if h.cmd != nil && h.cmd.Process != nil {
+		syscall.Kill(h.cmd.Process.Pid, syscall.SIGWINCH)
+	}
+}
@@ -0,0 +1,216 @@
+package jcat
+
+import (
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"jmux/internal/recording"
+)
+
+// hubScript answers each line with the shared terminal's size and the
+// line, and exits on "quit"
+const hubScript = "stty -echo\necho ready\nwhile read line; do\n  [ \"$line\" = quit ] && exit 0\n  echo \"size:$(stty size) got:$line\"\ndone\n"
+
+// hubTestGuest is a client attached to a hub share
+type hubTestGuest struct {
+	input  *io.PipeWriter
+	output *syncBuffer
+	sizes  chan WinSize
+	done   chan struct{} // closed once the client stops
+}
+
+// joinHub attaches a guest in mode with a rows by cols window
+func joinHub(t *testing.T, addr, mode string, rows, cols int) *hubTestGuest {
+	t.Helper()
+	client := NewClientWithOptions(addr, ClientOptions{Mode: mode})
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+
+	inputReader, input := io.Pipe()
+	guest := &hubTestGuest{
+		input:  input,
+		output: &syncBuffer{},
+		sizes:  make(chan WinSize, 4),
+		done:   make(chan struct{}),
+	}
+	t.Cleanup(func() { input.Close() })
+	guest.sizes <- WinSize{Rows: rows, Cols: cols}
+	go func() {
+		defer close(guest.done)
+		client.run(conn, readInput(inputReader), guest.output, guest.sizes)
+	}()
+	return guest
+}
+
+// String returns everything written so far
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// send types line into the guest's terminal
+func (g *hubTestGuest) send(line string) {
+	g.input.Write([]byte(line + "\n"))
+}
+
+func TestHubFansOutOutputAndDropsViewInput(t *testing.T) {
+	addr := startScriptServer(t, hubScript, ServerOptions{Hub: true})
+	pair := joinHub(t, addr, ModePair, 24, 80)
+	pair.output.waitFor(t, "ready")
+	view := joinHub(t, addr, ModeView, 24, 80)
+	time.Sleep(200 * time.Millisecond)
+
+	pair.send("one")
+	pair.output.waitFor(t, "got:one")
+	view.output.waitFor(t, "got:one")
+
+	// What the view guest types never reaches the shell
+	view.send("two")
+	time.Sleep(200 * time.Millisecond)
+	pair.send("three")
+	pair.output.waitFor(t, "got:three")
+	view.output.waitFor(t, "got:three")
+	for name, guest := range map[string]*hubTestGuest{"pair": pair, "view": view} {
+		if got := guest.output.String(); strings.Contains(got, "got:two") {
+			t.Errorf("%s guest saw the view guest's input: %q", name, got)
+		}
+	}
+}
+
+func TestHubSizesToSmallestGuest(t *testing.T) {
+	addr := startScriptServer(t, hubScript, ServerOptions{Hub: true})
+	big := joinHub(t, addr, ModePair, 40, 120)
+	big.output.waitFor(t, "ready")
+	small := joinHub(t, addr, ModePair, 24, 80)
+	time.Sleep(200 * time.Millisecond)
+
+	big.send("a")
+	big.output.waitFor(t, "size:24 80 got:a")
+
+	small.sizes <- WinSize{Rows: 20, Cols: 100}
+	time.Sleep(200 * time.Millisecond)
+	big.send("b")
+	big.output.waitFor(t, "size:20 100 got:b")
+
+	// Once the small guest leaves, the big one gets its whole window back
+	small.input.Close()
+	select {
+	case <-small.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the small guest did not leave")
+	}
+	time.Sleep(200 * time.Millisecond)
+	big.send("c")
+	big.output.waitFor(t, "size:40 120 got:c")
+}
+
+func TestHubTellsEveryGuestTheShellExited(t *testing.T) {
+	addr := startScriptServer(t, hubScript, ServerOptions{Hub: true})
+	first := joinHub(t, addr, ModePair, 24, 80)
+	first.output.waitFor(t, "ready")
+	second := joinHub(t, addr, ModePair, 24, 80)
+	time.Sleep(200 * time.Millisecond)
+
+	// Both guests could resume, so only the exit notice keeps them from
+	// reconnecting to a new shell
+	first.send("quit")
+	for name, guest := range map[string]*hubTestGuest{"first": first, "second": second} {
+		select {
+		case <-guest.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the %s guest was not told the shell exited: %q", name, guest.output.String())
+		}
+	}
+}
+
+func TestHubDisconnectsSlowGuests(t *testing.T) {
+	hub := newHub(func(_ net.Conn, _ string, _ []string) *exec.Cmd {
+		return exec.Command("sh", "-c", "sleep 0.2; head -c 1000000 /dev/zero; sleep 0.5")
+	}, func() *recording.Recorder { return nil })
+	hub.logger = log.New(io.Discard, "", 0)
+
+	// The fast guest has room for all the output, the slow one for a chunk
+	newGuest := func(backlog int) *hubGuest {
+		return &hubGuest{remote: "guest", out: make(chan []byte, backlog), policy: InputShared, gone: make(chan struct{})}
+	}
+	slow, fast := newGuest(1), newGuest(1<<16)
+	for _, guest := range []*hubGuest{slow, fast} {
+		if err := hub.attach(guest, nil, nil); err != nil {
+			t.Fatalf("attach failed: %v", err)
+		}
+	}
+
+	select {
+	case <-slow.gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a guest that reads nothing was never disconnected")
+	}
+	slow.mu.Lock()
+	if slow.shellExited {
+		t.Error("the slow guest was only let go when the shell exited")
+	}
+	slow.mu.Unlock()
+	hub.detach(slow)
+
+	select {
+	case <-fast.gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shell exiting did not let the fast guest go")
+	}
+	fast.mu.Lock()
+	if !fast.shellExited {
+		t.Error("the fast guest was disconnected before the shell exited")
+	}
+	fast.mu.Unlock()
+}
+
+func TestHubResumeTokens(t *testing.T) {
+	hub := newHub(nil, nil)
+	hub.grace = 100 * time.Millisecond
+
+	token, err := hub.issueToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hub.resumable(token, "bob") {
+		t.Error("bob cannot resume with his token")
+	}
+	if hub.resumable(token, "mallory") {
+		t.Error("mallory resumed with bob's token")
+	}
+	if hub.resumable("", "bob") || hub.resumable("guessed", "bob") {
+		t.Error("a token the hub never gave out was taken")
+	}
+
+	// Attached guests keep their token; once they drop, it lasts the grace
+	time.Sleep(2 * hub.grace)
+	if !hub.resumable(token, "bob") {
+		t.Error("the token of an attached guest expired")
+	}
+	hub.releaseToken(token, hub.grace)
+	if !hub.resumable(token, "bob") {
+		t.Error("the token expired as soon as bob dropped")
+	}
+	time.Sleep(2 * hub.grace)
+	if hub.resumable(token, "bob") {
+		t.Error("the token outlived the grace")
+	}
+
+	// Kicked guests and exited shells leave nothing to resume
+	kicked, err := hub.issueToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.releaseToken(kicked, 0)
+	if hub.resumable(kicked, "bob") {
+		t.Error("a token released without grace still works")
+	}
+}
@@ -0,0 +1,43 @@
+package jcat
+
+import "fmt"
+
+// redeemInvite lets a guest in by the invitation in its hello and returns
+// the invitation's ID, or "" for guests without one, who are let in unless
+// the share requires an invitation. The invitation must be for hello.User,
+// which the transport has already replaced with the guest's account, TLS
+// certificate or SSH key wherever it authenticates guests. Calling the
+// returned unredeem gives the use back if the guest never gets connected.
+func (s *Server) redeemInvite(hello Hello, remote string) (id string, unredeem func(), err error) {
+	unredeem = func() {}
+	if hello.Invite == "" || s.invites == nil {
+		if s.requireInvite {
+			return "", unredeem, fmt.Errorf("this session is by invitation only")
+		}
+		return "", unredeem, nil
+	}
+
+	// Guests resuming their session, and commands run by guests already in,
+	// used the invitation when they joined; it need only still be good
+	if hello.Exec || s.resuming(hello.Resume, hello.User) {
+		if admitted, ok := s.invites.Admitted(hello.Invite, hello.User, s.sessionName); ok {
+			s.logger.Printf("[%s] %s is back by invite %s", remote, hello.User, admitted.ID)
+			return admitted.ID, unredeem, nil
+		}
+	}
+
+	redeemed, err := s.invites.Redeem(hello.Invite, hello.User, s.sessionName, remote)
+	if err != nil {
+		return "", unredeem, err
+	}
+	s.logger.Printf("[%s] %s redeemed invite %s (%d of %d uses)", remote, hello.User, redeemed.ID, len(redeemed.Redeemed), redeemed.Uses)
+	redemption := redeemed.Redeemed[len(redeemed.Redeemed)-1]
+	unredeem = func() {
+		if err := s.invites.Unredeem(hello.Invite, redemption); err != nil {
+			s.logger.Printf("[%s] failed to give back invite %s: %v", remote, redeemed.ID, err)
+			return
+		}
+		s.logger.Printf("[%s] gave back the use of invite %s", remote, redeemed.ID)
+	}
+	return redeemed.ID, unredeem, nil
+}
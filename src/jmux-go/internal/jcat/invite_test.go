@@ -0,0 +1,186 @@
+package jcat
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jmux/internal/audit"
+	"jmux/internal/invite"
+)
+
+func TestInvitations(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	store := invite.NewStore(filepath.Join(dir, "invites", "demo.json"))
+	token, issued, err := store.Issue("bob", "demo", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startScriptServer(t, "exec cat\n", ServerOptions{
+		SessionName:   "demo",
+		AuditPath:     auditPath,
+		InvitePath:    filepath.Join(dir, "invites", "demo.json"),
+		RequireInvite: true,
+	})
+
+	conn, err := NewClientWithOptions(addr, ClientOptions{User: "bob", Invite: token, NoReconnect: true}).dial()
+	if err != nil {
+		t.Fatalf("joining with an invite failed: %v", err)
+	}
+	conn.Close()
+	records := waitForRecords(t, auditPath, 1)
+	if records[0].Event != audit.EventJoin || records[0].Invite != issued.ID {
+		t.Errorf("audit record = %+v, want bob joining with invite %s", records[0], issued.ID)
+	}
+
+	refusals := []struct {
+		name string
+		opts ClientOptions
+		want string
+	}{
+		{"invite used up", ClientOptions{User: "bob", Invite: token}, "already been used"},
+		{"no invite", ClientOptions{User: "bob"}, "by invitation only"},
+	}
+	for _, r := range refusals {
+		r.opts.NoReconnect = true
+		if _, err := NewClientWithOptions(addr, r.opts).dial(); err == nil || !strings.Contains(err.Error(), r.want) {
+			t.Errorf("%s: dial error = %v, want %q", r.name, err, r.want)
+		}
+	}
+}
+
+func TestInvitedGuestResumesAndRunsCommands(t *testing.T) {
+	dir := t.TempDir()
+	store := invite.NewStore(filepath.Join(dir, "demo.json"))
+	token, _, err := store.Issue("bob", "demo", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "stty -echo\necho ready\nwhile read line; do\n  sleep 0.3\n  echo \"got:$line\"\ndone\n"
+	addr := startScriptServer(t, script, ServerOptions{
+		SessionName:   "demo",
+		InvitePath:    filepath.Join(dir, "demo.json"),
+		RequireInvite: true,
+		ResumeGrace:   10 * time.Second,
+		AllowExec:     true,
+	})
+
+	client := NewClientWithOptions(addr, ClientOptions{User: "bob", Invite: token})
+	dialer := &gatedDialer{client: client, gate: make(chan struct{})}
+	client.dial = dialer.dial
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("joining with an invite failed: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+	go client.run(conn, readInput(stdinReader), output, sizes)
+	output.waitFor(t, "ready")
+
+	// The single use went on joining; resuming takes none
+	stdinWriter.Write([]byte("one\n"))
+	time.Sleep(50 * time.Millisecond)
+	dialer.drop()
+	output.waitFor(t, "reconnecting")
+	close(dialer.gate)
+	output.waitFor(t, "got:one")
+
+	// Nor does a command bob runs alongside
+	var stdout bytes.Buffer
+	runner := NewClientWithOptions(addr, ClientOptions{User: "bob", Invite: token, NoReconnect: true})
+	if code, err := runner.Exec("echo ran", nil, &stdout, io.Discard); err != nil || code != 0 || stdout.String() != "ran\n" {
+		t.Errorf("Exec = %d, %v, %q; want bob's command run", code, err, stdout.String())
+	}
+
+	invites, err := store.List()
+	if err != nil || len(invites) != 1 || len(invites[0].Redeemed) != 1 {
+		t.Errorf("invites = %+v, %v; want the invite used once", invites, err)
+	}
+
+	// A fresh join finds the invite used up
+	if _, err := NewClientWithOptions(addr, ClientOptions{User: "bob", Invite: token, NoReconnect: true}).dial(); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Errorf("second join = %v, want the invite used up", err)
+	}
+}
+
+func TestResumeNeedsAGoodInvitation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.json")
+	store := invite.NewStore(path)
+	token, issued, err := store.Issue("bob", "demo", time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithOptions("127.0.0.1:0", "", ServerOptions{
+		SessionName:   "demo",
+		InvitePath:    path,
+		RequireInvite: true,
+		Hub:           true,
+	})
+	if _, _, err := s.redeemInvite(Hello{User: "bob", Invite: token}, "10.0.0.2:4000"); err != nil {
+		t.Fatalf("joining with the invite failed: %v", err)
+	}
+	resume, err := s.hub.issueToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.redeemInvite(Hello{User: "bob", Invite: token, Resume: resume}, "10.0.0.2:4001"); err != nil {
+		t.Errorf("resuming with the used invite failed: %v", err)
+	}
+	refusals := []struct {
+		name  string
+		hello Hello
+		want  string
+	}{
+		{"someone else's resume token", Hello{User: "mallory", Invite: token, Resume: resume}, "for bob"},
+		{"no invite", Hello{User: "bob", Resume: resume}, "by invitation only"},
+	}
+	for _, r := range refusals {
+		if _, _, err := s.redeemInvite(r.hello, "10.0.0.2:4002"); err == nil || !strings.Contains(err.Error(), r.want) {
+			t.Errorf("%s: redeemInvite = %v, want %q", r.name, err, r.want)
+		}
+	}
+
+	// The resume token cannot outlast the invitation
+	time.Sleep(time.Until(issued.Expires) + 10*time.Millisecond)
+	if _, _, err := s.redeemInvite(Hello{User: "bob", Invite: token, Resume: resume}, "10.0.0.2:4003"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("resuming after the invite expired = %v, want it refused", err)
+	}
+}
+
+func TestFailedHandshakeKeepsTheInvitation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.json")
+	store := invite.NewStore(path)
+	token, _, err := store.Issue("bob", "demo", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithOptions("127.0.0.1:0", "", ServerOptions{
+		SessionName:   "demo",
+		InvitePath:    path,
+		RequireInvite: true,
+		Logger:        log.New(io.Discard, "", 0),
+	})
+
+	// The guest hangs up before the server can accept it
+	server, client := net.Pipe()
+	client.Close()
+	s.serveConn(server, Hello{Protocol: ProtocolVersion, User: "bob", Invite: token})
+
+	if invites, err := store.List(); err != nil || len(invites) != 1 || len(invites[0].Redeemed) != 0 {
+		t.Fatalf("invites after a failed handshake = %+v, %v; want the use given back", invites, err)
+	}
+	if _, err := store.Redeem(token, "bob", "demo", "10.0.0.2:4000"); err != nil {
+		t.Errorf("the invite was spent by a guest that never got in: %v", err)
+	}
+}
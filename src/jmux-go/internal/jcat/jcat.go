@@ -1,7 +1,9 @@
 package jcat
 
 import (
-	"encoding/gob"
+	"bytes"
+	"compress/flate"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -9,151 +11,767 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
-	"github.com/creack/pty"
 	"github.com/hashicorp/yamux"
 	"golang.org/x/term"
+	"jmux/internal/audit"
+	"jmux/internal/invite"
+	"jmux/internal/recording"
 )
 
+// Server banners. Plain servers keep announcing 2.0.0, the only banner
+// dmux 2.0.0 clients accept, and tell newer clients they speak protocol 3
+// in their hello.
 const (
 	JcatVersion  = "2.0.0"
 	HandshakeMsg = "JCAT/" + JcatVersion + "\n"
+
+	// StandaloneHandshakeMsg is the banner of the standalone jcat binary,
+	// the only one its clients accept
+	StandaloneHandshakeMsg = "JCAT/1.0.0\n"
+)
+
+// Client reconnect timing
+const (
+	dialTimeout       = 10 * time.Second
+	reconnectTimeout  = 2 * time.Minute
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 10 * time.Second
 )
 
 // Server represents a jcat server
 type Server struct {
 	listenAddr string
 	rcfile     string
+	shell      string // guest shell, also running dmux exec commands
+	command    string // program shared instead of the rcfile and shell, if any
+	mode       string // most a guest may get: "pair", "view", or "rogue"
+	hub        *Hub   // shared PTY for all guests, nil when each guest gets its own
+
+	recordPath string // asciicast file for PTY output, empty when not recording
+	recordMu   sync.Mutex
+	recordings int
+
+	socket      string      // extra Unix socket to listen on, if any
+	socketMode  os.FileMode // permissions of Unix socket files
+	sessionName string      // tmux session guests attach to, if known
+	banner      string      // sent to every guest before its hello
+
+	resumeGrace time.Duration // how long a disconnected guest's shell is kept
+	shellsMu    sync.Mutex
+	shells      map[string]*guestShell // running guest shells by resume token
+
+	compress     bool   // compress output for guests that ask for it
+	noFiles      bool   // refuse file transfers
+	allowForward bool   // let pair and rogue guests forward ports
+	allowExec    bool   // let pair and rogue guests run commands without a terminal
+	statsPath    string // file the connected guests' stats are written to, if any
+	guestsMu     sync.Mutex
+	guests       map[*guestConn]struct{}
+
+	maxGuests        int           // connections served at once, unlimited if zero
+	maxConnsPerIP    int           // connections from one IP at once, unlimited if zero
+	handshakeTimeout time.Duration // bound on each handshake phase
+	allowFrom        []*net.IPNet  // networks TCP guests may come from, any if empty
+	allowedUsers     []string      // guests that may join, anyone if empty
+	invites          *invite.Store // invitations guests may redeem, if any
+	requireInvite    bool          // turn away guests without an invitation
+	audit            *audit.Logger // where connection events are recorded, if anywhere
+	logger           *log.Logger   // where the server logs what it does
+
+	lifeMu    sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]string // accepted connections still being served, to their IP
+	closed    chan struct{}       // closed once Shutdown is called
+	closeOnce sync.Once
+}
+
+// ServerOptions holds optional jcat server settings
+type ServerOptions struct {
+	// Mode is the sharing mode the host registered; guests asking for more
+	// are downgraded to it. Defaults to pair.
+	Mode string
+
+	// Hub runs a single shared PTY and fans its output out to every guest
+	// instead of spawning a shell per connection
+	Hub bool
+
+	// RecordPath is an asciicast v2 file that PTY output and resizes are
+	// recorded to. Without a hub every guest's PTY is recorded separately,
+	// the second one to "<name>-2.cast" and so on.
+	RecordPath string
+
+	// ResumeGrace is how long a guest's shell is kept after its connection
+	// drops so the guest can reconnect and resume it. Zero uses
+	// DefaultResumeGrace; a negative value closes the shell right away.
+	ResumeGrace time.Duration
+
+	// Socket is a Unix socket path to listen on besides the listen address,
+	// letting guests on the same machine skip TCP
+	Socket string
+
+	// SocketMode is the permission of the server's Unix socket files.
+	// Defaults to DefaultSocketMode.
+	SocketMode os.FileMode
+
+	// Standalone announces the standalone jcat binary's banner so its
+	// clients can join. dmux clients then join as they would the binary,
+	// and dmux 2.0.0 clients cannot.
+	Standalone bool
+
+	// SessionName is the tmux session guests attach to. It is passed to the
+	// guest shell as JMUX_SESSION_NAME, which the setsize script prefers
+	// over looking the session up by port.
+	SessionName string
+
+	// StatsPath is a file the server keeps up to date with the latency and
+	// throughput of every connected guest, for dmux status to show
+	StatsPath string
+
+	// Compress lets guests that ask for it receive the shell output
+	// compressed
+	Compress bool
+
+	// NoFiles refuses guests' file transfers
+	NoFiles bool
+
+	// AllowForward lets guests that can run commands forward TCP ports
+	// to and from the host. View-only guests never can.
+	AllowForward bool
+
+	// AllowExec lets guests that can run commands use dmux exec, which runs
+	// a command without a terminal and returns its output and exit code
+	AllowExec bool
+
+	// MaxGuests caps the guests connected at once, counting those still
+	// handshaking. Zero means no limit.
+	MaxGuests int
+
+	// MaxConnsPerIP caps the connections from one IP address at once. Zero
+	// uses DefaultMaxConnsPerIP; a negative value means no limit. Guests
+	// on the Unix socket are not counted.
+	MaxConnsPerIP int
+
+	// HandshakeTimeout bounds each phase of a guest's handshake. Zero uses
+	// DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// AuditPath is a log that every guest joining, leaving or being turned
+	// away is recorded in, shared with other servers. See package audit.
+	AuditPath string
+
+	// Shell is the shell guests get when the rcfile does not exec anything
+	// else, and that runs shared and dmux exec commands. Defaults to
+	// DefaultShell().
+	Shell string
+
+	// Command is a program to share instead of the rcfile and shell. It is
+	// run with Shell -c.
+	Command string
+
+	// AllowFrom lists the networks guests may connect from over TCP; others
+	// are turned away before any shell is started. Empty allows any.
+	// Guests on the Unix socket are always allowed.
+	AllowFrom []*net.IPNet
+
+	// AllowedUsers lists the only guests a private share lets in, by the
+	// name they join as. Empty lets anyone in. Only the tls and sshkey
+	// methods verify that name; otherwise it is whatever the guest says.
+	AllowedUsers []string
+
+	// InvitePath is the store of the invitations to the share, which
+	// guests present in their hello. See package invite.
+	InvitePath string
+
+	// RequireInvite turns away guests that do not present an invitation
+	// from InvitePath
+	RequireInvite bool
+
+	// Logger is where the server logs connections and errors. Defaults to
+	// the standard logger.
+	Logger *log.Logger
 }
 
 // Client represents a jcat client
 type Client struct {
 	connectAddr string
 	mode        string // "pair", "view", or "rogue"
+	user        string // who is joining, as told to the server
+	invite      string // invitation token presented to the server, if any
+	resume      string // resume token of the session being reconnected to
+	reconnect   bool   // reconnect and resume when the connection drops
+	showStats   bool   // draw the stats overlay
+	compress    bool   // ask for compressed output
+	exec        bool   // run a command instead of attaching a terminal
+	logger      *log.Logger // where the client logs reconnects and errors
+
+	transport func() (net.Conn, error) // opens a raw connection to the server
+	dial      func() (net.Conn, error) // opens a connection ready for yamux
+	peer      Hello                    // the server's hello from the latest handshake
+	overlay   *overlay                 // stats overlay on the local terminal, if shown
+
+	localSocket string                      // Unix socket local dmux commands reach the host through
+	live        atomic.Pointer[liveSession] // current connection, nil while disconnected
+
+	localForwards  []Forward // guest ports carried to the host
+	remoteForwards []Forward // host ports carried to the guest
+}
+
+// ClientOptions holds optional jcat client settings
+type ClientOptions struct {
+	// Mode is the sharing mode to ask for. Defaults to pair.
+	Mode string
+
+	// User is who is joining, as told to the server. Defaults to $USER.
+	User string
+
+	// Invite is the token of an invitation to the share, presented on
+	// every connection, reconnects included
+	Invite string
+
+	// NoReconnect makes the client give up as soon as the connection drops
+	// instead of reconnecting and resuming the session
+	NoReconnect bool
+
+	// ShowStats draws the connection's latency and throughput in the top
+	// right corner of the terminal
+	ShowStats bool
+
+	// Compress asks the server to compress the shell output. Servers that
+	// do not allow or support it send it uncompressed.
+	Compress bool
+
+	// LocalSocket is a Unix socket on which local dmux commands, such as
+	// send-file, reach the host over this client's connection
+	LocalSocket string
+
+	// LocalForwards listen on the guest and connect to targets on the host
+	LocalForwards []Forward
+	// RemoteForwards listen on the host and connect to targets on the guest
+	RemoteForwards []Forward
+
+	// Logger is where the client logs reconnects and errors. Defaults to
+	// the standard logger.
+	Logger *log.Logger
+
+	// Dial opens the connection to the server, for every reconnect too,
+	// instead of dialing the client's address. It lets the client run over
+	// any transport, such as one end of a pipe.
+	Dial func() (net.Conn, error)
 }
 
 // NewServer creates a new jcat server
 func NewServer(listenAddr, rcfile string) *Server {
-	return &Server{
-		listenAddr: listenAddr,
-		rcfile:     rcfile,
+	return NewServerWithOptions(listenAddr, rcfile, ServerOptions{})
+}
+
+// NewServerWithOptions creates a new jcat server with the given options
+func NewServerWithOptions(listenAddr, rcfile string, opts ServerOptions) *Server {
+	s := &Server{
+		listenAddr:   listenAddr,
+		rcfile:       rcfile,
+		shell:        opts.Shell,
+		command:      opts.Command,
+		mode:         opts.Mode,
+		recordPath:   opts.RecordPath,
+		socket:       opts.Socket,
+		socketMode:   opts.SocketMode,
+		sessionName:  opts.SessionName,
+		resumeGrace:  opts.ResumeGrace,
+		shells:       make(map[string]*guestShell),
+		statsPath:    opts.StatsPath,
+		compress:     opts.Compress,
+		noFiles:      opts.NoFiles,
+		allowForward: opts.AllowForward,
+		allowExec:    opts.AllowExec,
+		maxGuests:    opts.MaxGuests,
+		allowFrom:    opts.AllowFrom,
+		allowedUsers: opts.AllowedUsers,
+		logger:       opts.Logger,
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]string),
+		closed:       make(chan struct{}),
+		guests:       make(map[*guestConn]struct{}),
+	}
+	if s.mode == "" {
+		s.mode = ModePair
+	}
+	s.banner = HandshakeMsg
+	if opts.Standalone {
+		s.banner = StandaloneHandshakeMsg
 	}
+	if s.shell == "" {
+		s.shell = DefaultShell()
+	}
+	if s.logger == nil {
+		s.logger = log.Default()
+	}
+	if opts.AuditPath != "" {
+		s.audit = audit.NewLogger(opts.AuditPath)
+	}
+	if opts.InvitePath != "" {
+		s.invites = invite.NewStore(opts.InvitePath)
+	}
+	s.requireInvite = opts.RequireInvite
+	if s.resumeGrace == 0 {
+		s.resumeGrace = DefaultResumeGrace
+	}
+	switch {
+	case opts.MaxConnsPerIP == 0:
+		s.maxConnsPerIP = DefaultMaxConnsPerIP
+	case opts.MaxConnsPerIP > 0:
+		s.maxConnsPerIP = opts.MaxConnsPerIP
+	}
+	s.handshakeTimeout = opts.HandshakeTimeout
+	if s.handshakeTimeout <= 0 {
+		s.handshakeTimeout = DefaultHandshakeTimeout
+	}
+	if opts.Hub {
+		s.hub = newHub(s.shellCommand, s.newRecorder)
+		s.hub.compress = s.compress
+		s.hub.grace = s.resumeGrace
+		s.hub.logger = s.logger
+	}
+	return s
 }
 
 // NewClient creates a new jcat client
 func NewClient(connectAddr string) *Client {
-	return &Client{
-		connectAddr: connectAddr,
-		mode:        "pair", // default mode
-	}
+	return NewClientWithOptions(connectAddr, ClientOptions{})
 }
 
 // NewClientWithMode creates a new jcat client with specified mode
 func NewClientWithMode(connectAddr, mode string) *Client {
-	return &Client{
+	return NewClientWithOptions(connectAddr, ClientOptions{Mode: mode})
+}
+
+// NewClientWithOptions creates a new jcat client with the given options
+func NewClientWithOptions(connectAddr string, opts ClientOptions) *Client {
+	c := &Client{
 		connectAddr: connectAddr,
-		mode:        mode,
+		mode:        opts.Mode,
+		user:        opts.User,
+		invite:      opts.Invite,
+		reconnect:   !opts.NoReconnect,
+		showStats:   opts.ShowStats,
+		compress:    opts.Compress,
+		localSocket: opts.LocalSocket,
+		logger:      opts.Logger,
+		transport:   opts.Dial,
+
+		localForwards:  opts.LocalForwards,
+		remoteForwards: opts.RemoteForwards,
+	}
+	if c.mode == "" {
+		c.mode = ModePair // default mode
+	}
+	if c.user == "" {
+		c.user = os.Getenv("USER")
 	}
+	if c.logger == nil {
+		c.logger = log.Default()
+	}
+	if c.transport == nil {
+		c.transport = func() (net.Conn, error) { return dial(connectAddr) }
+	}
+	c.dial = c.dialPlain
+	return c
 }
 
-// Start starts the jcat server
+// Start starts the jcat server and runs it until it fails
 func (s *Server) Start() error {
-	ln, err := net.Listen("tcp", s.listenAddr)
+	return s.Serve(context.Background())
+}
+
+// listenAndServe listens on the server's address, and on its Unix socket
+// if it has one, and hands every connection to handler until ctx is done
+// or the server is shut down
+func (s *Server) listenAndServe(ctx context.Context, name string, handler func(net.Conn)) error {
+	ln, err := listen(s.listenAddr, s.socketMode)
 	if err != nil {
 		return err
 	}
-	log.Printf("jcat server listening on %s", s.listenAddr)
+	s.logger.Printf("%s listening on %s", name, s.listenAddr)
 
-	for {
-		conn, err := ln.Accept()
+	if s.socket != "" {
+		sock, err := listen(UnixPrefix+s.socket, s.socketMode)
 		if err != nil {
-			log.Printf("accept error: %v", err)
-			continue
+			ln.Close()
+			return err
 		}
-		go s.handle(conn)
+		defer sock.Close()
+		s.logger.Printf("%s listening on %s%s", name, UnixPrefix, s.socket)
+		go s.serve(sock, handler)
+	}
+	return s.serveUntil(ctx, ln, handler)
+}
+
+// serveUntil hands every connection from ln to handler until ctx is done or
+// the server is shut down
+func (s *Server) serveUntil(ctx context.Context, ln net.Listener, handler func(net.Conn)) error {
+	defer ln.Close()
+	if s.statsPath != "" {
+		done := make(chan struct{})
+		defer close(done)
+		go s.writeStatsFile(s.statsPath, done)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ln, handler) }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
 	}
 }
 
 // Connect connects the jcat client
 func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.connectAddr)
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
+	return c.attach(conn)
+}
 
-	// Read handshake message
-	handshake := make([]byte, len(HandshakeMsg))
-	_, err = io.ReadFull(conn, handshake)
+// dialPlain connects to the server and performs the plain handshake
+func (c *Client) dialPlain() (net.Conn, error) {
+	conn, err := c.transport()
 	if err != nil {
-		return fmt.Errorf("handshake error: %v", err)
+		return nil, err
 	}
 
-	if string(handshake) == HandshakeMsg {
-		log.Printf("Connected to jcat server version %s", JcatVersion)
-	} else {
-		return fmt.Errorf("invalid handshake: %s", string(handshake))
+	// Read the banner without reading past it
+	line, err := readLine(conn, maxBannerLine)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake error: %v", err)
 	}
-
-	// Send mode information to server
-	modeMsg := fmt.Sprintf("MODE:%s\n", c.mode)
-	_, err = conn.Write([]byte(modeMsg))
+	protocol, secure, err := parseBanner(line)
 	if err != nil {
-		return fmt.Errorf("failed to send mode: %v", err)
+		conn.Close()
+		return nil, err
+	}
+	if secure {
+		conn.Close()
+		return nil, fmt.Errorf("server is a secure jcat server and needs a password")
 	}
 
-	// Configure yamux client
-	config := yamux.DefaultConfig()
-	config.EnableKeepAlive = true
-	config.KeepAliveInterval = 30 * time.Second
-	config.ConnectionWriteTimeout = 30 * time.Second
-
-	session, err := yamux.Client(conn, config)
+	// A dmux 2.0.0 server never answers a hello, so do not wait for
+	// it forever
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	peer, err := c.handshake(conn, protocol)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+	c.connected(peer)
+	return conn, nil
+}
 
+// connected notes the server's hello after a successful handshake
+func (c *Client) connected(peer Hello) {
+	c.peer = peer
+	if peer.Version != "" {
+		c.logger.Printf("Connected to jcat server (dmux %s, protocol %d)", peer.Version, peer.Protocol)
+	} else {
+		c.logger.Printf("Connected to jcat server (protocol %d)", peer.Protocol)
+	}
+}
+
+// WinSize is a terminal window size, as sent on the control channel
+type WinSize struct {
+	Rows, Cols int
+}
+
+// defaultWinSize is the size reported for terminals that do not tell
+var defaultWinSize = WinSize{Rows: 24, Cols: 80}
+
+// attach puts the local terminal in raw mode and runs the session over conn
+func (c *Client) attach(conn net.Conn) error {
 	stdin := int(os.Stdin.Fd())
 	if !term.IsTerminal(stdin) {
+		conn.Close()
 		return fmt.Errorf("not on a terminal")
 	}
 
 	oldState, err := term.MakeRaw(stdin)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	defer term.Restore(stdin, oldState)
 
-	done := make(chan struct{})
+	// Report the current size and every change signalled by SIGWINCH
+	sizes := make(chan WinSize, 1)
+	go func() {
+		defer close(sizes)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGWINCH)
+		defer signal.Stop(sig)
+		for {
+			cols, rows, err := term.GetSize(stdin)
+			if err != nil {
+				c.logger.Printf("getsize error: %v", err)
+				return
+			}
+			sizes <- WinSize{Rows: rows, Cols: cols}
+			<-sig
+		}
+	}()
+
+	return c.runTerminal(conn, os.Stdin, os.Stdout, sizes)
+}
 
-	// Control channel for window size
-	controlChannel, err := session.Open()
+// ConnectTerminal connects the client and runs the session with in and out
+// as the guest's terminal instead of the process's own. sizes reports the
+// terminal's size, its current one first; if it is nil the terminal is
+// taken to be 80x24. It returns when the shell exits, in ends or the
+// connection is lost for good.
+func (c *Client) ConnectTerminal(in io.Reader, out io.Writer, sizes <-chan WinSize) error {
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
+	if sizes == nil {
+		fixed := make(chan WinSize, 1)
+		fixed <- defaultWinSize
+		close(fixed)
+		sizes = fixed
+	}
+	return c.runTerminal(conn, in, out, sizes)
+}
+
+// runTerminal serves local commands and forwarded ports while it streams
+// the session over conn between the terminal in and out
+func (c *Client) runTerminal(conn net.Conn, in io.Reader, out io.Writer, sizes <-chan WinSize) error {
+	// Local commands such as send-file reach the host through this socket
+	if c.localSocket != "" {
+		ln, err := listen(UnixPrefix+c.localSocket, 0600)
+		if err != nil {
+			c.logger.Printf("local command socket error: %v", err)
+		} else {
+			defer ln.Close()
+			go c.serveLocal(ln)
+		}
+	}
 
+	stopForwards, err := c.listenForwards()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer stopForwards()
+
+	if c.showStats {
+		c.overlay = &overlay{out: out}
+		out = c.overlay
+	}
+	return c.run(conn, readInput(in), out, sizes)
+}
+
+// readInput pumps in into a channel so that a single reader outlives the
+// connections it is sent over
+func readInput(in io.Reader) <-chan []byte {
+	input := make(chan []byte, 64)
 	go func() {
-		w := gob.NewEncoder(controlChannel)
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGWINCH)
+		defer close(input)
 		for {
-			cols, rows, err := term.GetSize(stdin)
+			buf := make([]byte, 4096)
+			n, err := in.Read(buf)
+			if n > 0 {
+				input <- buf[:n]
+			}
 			if err != nil {
-				log.Printf("getsize error: %v", err)
-				break
+				return
 			}
-			win := struct {
-				Rows, Cols int
-			}{Rows: rows, Cols: cols}
-			if err := w.Encode(win); err != nil {
-				break
+		}
+	}()
+	return input
+}
+
+// resumeState is what a client carries from one connection to the next to
+// resume its session
+type resumeState struct {
+	mu       sync.Mutex
+	token    string  // resume token issued by the server
+	offset   int64   // output bytes received from the shell behind token
+	size     WinSize // last window size reported
+	mode     string  // mode the server granted
+	finished bool    // the shell exited or the local side quit
+}
+
+// run streams the session over conn and, whenever the connection drops,
+// reconnects and resumes it until the shell exits or input ends
+func (c *Client) run(conn net.Conn, input <-chan []byte, out io.Writer, sizes <-chan WinSize) error {
+	state := &resumeState{}
+	for {
+		err := c.stream(conn, input, out, sizes, state)
+
+		state.mu.Lock()
+		resumable := c.reconnect && state.token != "" && !state.finished
+		state.mu.Unlock()
+		if !resumable {
+			return err
+		}
+
+		// Reconnect asking for the mode the server granted last time, and
+		// say which session it resumes so the invitation is not used again
+		state.mu.Lock()
+		if state.mode != "" && state.mode != c.mode {
+			c.mode = state.mode
+		}
+		c.resume = state.token
+		state.mu.Unlock()
+
+		notice(out, "connection lost, reconnecting...")
+		conn, err = c.redial(input, out)
+		if err != nil {
+			return err
+		}
+		notice(out, "reconnected")
+	}
+}
+
+// redial reconnects with exponential backoff until it succeeds, the time
+// limit runs out, or the user presses Ctrl+C. Other input typed while
+// disconnected is discarded rather than sent blind.
+func (c *Client) redial(input <-chan []byte, out io.Writer) (net.Conn, error) {
+	deadline := time.Now().Add(reconnectTimeout)
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dial()
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("giving up reconnecting: %v", err)
+		}
+		notice(out, "attempt %d failed: %v; retrying in %s (Ctrl+C to give up)", attempt, err, delay)
+
+		timer := time.NewTimer(delay)
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case p, ok := <-input:
+				if !ok || bytes.IndexByte(p, 0x03) >= 0 {
+					timer.Stop()
+					return nil, fmt.Errorf("reconnect cancelled")
+				}
 			}
-			<-c
 		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// stream runs the yamux control and data channels over an established
+// connection until either side hangs up, updating state so that a later
+// connection can resume where this one stopped
+func (c *Client) stream(conn net.Conn, input <-chan []byte, out io.Writer, sizes <-chan WinSize, state *resumeState) error {
+	// Configure yamux client
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer session.Close()
+
+	done := make(chan struct{}, 3)
+	finish := func() {
+		state.mu.Lock()
+		state.finished = true
+		state.mu.Unlock()
 		done <- struct{}{}
+	}
+
+	// Control channel for window size and resume information
+	controlChannel, err := session.Open()
+	if err != nil {
+		return err
+	}
+
+	// The first message carries the window size, waiting for it if this is
+	// the first connection
+	state.mu.Lock()
+	hello := ControlMessage{
+		Kind:        KindHello,
+		Rows:        state.size.Rows,
+		Cols:        state.size.Cols,
+		CanResume:   c.reconnect,
+		Resume:      state.token,
+		Offset:      state.offset,
+		Compression: c.compressionOffer(),
+	}
+	state.mu.Unlock()
+	if hello.Rows == 0 {
+		if win, ok := <-sizes; ok {
+			hello.Rows, hello.Cols = win.Rows, win.Cols
+			state.mu.Lock()
+			state.size = win
+			state.mu.Unlock()
+		}
+	}
+
+	control := newControlConn(controlChannel)
+	if err := control.send(hello); err != nil {
+		return err
+	}
+	cc := &clientConn{
+		control:  control,
+		stats:    newConnStats(),
+		hello:    hello,
+		answered: make(chan struct{}),
+	}
+
+	controlDone := make(chan struct{})
+	go func() {
+		defer close(controlDone)
+		for {
+			msg, err := control.receive()
+			if err != nil {
+				return
+			}
+			c.handleControl(cc, msg, out, state)
+		}
+	}()
+
+	go cc.stats.measure(control, session.CloseChan())
+	if c.overlay != nil {
+		go c.overlay.show(cc.stats, state, session.CloseChan())
+	}
+
+	go func() {
+		for {
+			select {
+			case win, ok := <-sizes:
+				if !ok {
+					sizes = nil
+					continue
+				}
+				state.mu.Lock()
+				state.size = win
+				state.mu.Unlock()
+				if err := control.send(ControlMessage{Kind: KindResize, Rows: win.Rows, Cols: win.Cols}); err != nil {
+					done <- struct{}{}
+					return
+				}
+			case <-session.CloseChan():
+				return
+			}
+		}
 	}()
 
 	// Data channel for I/O
@@ -162,60 +780,326 @@ func (c *Client) Connect() error {
 		return err
 	}
 
-	cp := func(dst io.Writer, src io.Reader) {
-		io.Copy(dst, src)
-		done <- struct{}{}
+	// Local commands and forwarded ports reach the host over this
+	// connection until it ends
+	c.live.Store(&liveSession{session: session, peer: c.peer})
+	defer c.live.Store(nil)
+	if len(c.localForwards)+len(c.remoteForwards) > 0 && !c.peer.Supports(FeatureForward) {
+		notice(out, "the host does not allow port forwarding")
+	} else {
+		c.requestRemoteForwards(session, out)
 	}
-	go cp(dataChannel, os.Stdin)
-	go cp(os.Stdout, dataChannel)
+	go c.acceptStreams(session)
+
+	go func() {
+		for {
+			select {
+			case p, ok := <-input:
+				if !ok {
+					finish()
+					return
+				}
+				n, err := dataChannel.Write(p)
+				cc.stats.out.Add(int64(n))
+				if err != nil {
+					done <- struct{}{}
+					return
+				}
+			case <-session.CloseChan():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		src := cc.output(&countingReader{r: dataChannel, n: &cc.stats.in})
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				cc.received.Add(int64(n))
+				if _, err := out.Write(buf[:n]); err != nil {
+					finish()
+					return
+				}
+			}
+			if err != nil {
+				done <- struct{}{}
+				return
+			}
+		}
+	}()
 
 	<-done
+
+	// Let the control reader drain what arrived before the hangup, such as
+	// an exit notice, before deciding whether to resume
 	session.Close()
+	select {
+	case <-controlDone:
+	case <-time.After(time.Second):
+	}
+	state.mu.Lock()
+	state.offset = cc.base.Load() + cc.received.Load()
+	state.mu.Unlock()
 	return nil
 }
 
-// handle handles a server connection
+// clientConn is what the goroutines of one client connection share
+type clientConn struct {
+	control  *controlConn
+	stats    *connStats
+	hello    ControlMessage // the hello the client sent
+	base     atomic.Int64   // output offset the server resumed the shell from
+	received atomic.Int64   // shell output received, after decompression
+
+	answered    chan struct{} // closed when the server's hello arrives
+	answerOnce  sync.Once
+	compression string // chosen by the server, set before answered closes
+}
+
+// output returns the reader for the shell output arriving on data. If the
+// client asked for compression it waits for the server's choice, which is
+// sent before any output; output from a server that never answers is
+// taken as is.
+func (cc *clientConn) output(data io.Reader) io.Reader {
+	if cc.hello.Compression == "" {
+		return data
+	}
+
+	// Output arriving first means any answer is already on its way
+	first := make([]byte, 32*1024)
+	n, err := data.Read(first)
+	select {
+	case <-cc.answered:
+	case <-time.After(compressionWait):
+	}
+
+	src := io.MultiReader(bytes.NewReader(first[:n]), data)
+	if err != nil {
+		src = io.MultiReader(bytes.NewReader(first[:n]), errReader{err})
+	}
+	select {
+	case <-cc.answered:
+		if cc.compression == CompressionDeflate {
+			return flate.NewReader(src)
+		}
+	default:
+	}
+	return src
+}
+
+// errReader returns err from every read
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// handleControl acts on a message from the server. Kinds this client does
+// not know are ignored.
+func (c *Client) handleControl(cc *clientConn, msg ControlMessage, out io.Writer, state *resumeState) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	switch msg.Kind {
+	case KindHello:
+		cc.answerOnce.Do(func() {
+			cc.compression = msg.Compression
+			close(cc.answered)
+		})
+
+		// Output counts from zero unless the server resumed the shell we
+		// asked for
+		if msg.Token != "" {
+			if msg.Token == cc.hello.Resume {
+				cc.base.Store(cc.hello.Offset)
+			}
+			state.token = msg.Token
+		}
+		if msg.Mode != "" {
+			if msg.Mode != c.mode {
+				notice(out, "asked for %s mode, the host granted %s mode", c.mode, msg.Mode)
+			}
+			state.mode = msg.Mode
+		}
+	case KindMode:
+		if msg.Mode != "" {
+			notice(out, "the host switched you to %s mode", msg.Mode)
+			state.mode = msg.Mode
+		}
+	case KindPing:
+		go cc.control.send(ControlMessage{Kind: KindPong, Seq: msg.Seq})
+	case KindPong:
+		cc.stats.pong(msg.Seq)
+	case KindNotice:
+		notice(out, "%s", msg.Text)
+	case KindError:
+		notice(out, "error: %s", msg.Text)
+	case KindKick:
+		notice(out, "disconnected by the host: %s", msg.Text)
+		state.finished = true
+	case KindExit:
+		state.finished = true
+	}
+}
+
+// notice prints a status line for the guest between the session's output
+func notice(out io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(out, "\r\n[jcat] "+format+"\r\n", args...)
+}
+
+// yamuxConfig returns the yamux settings shared by clients and servers
+func yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = true
+	config.KeepAliveInterval = 30 * time.Second
+	config.ConnectionWriteTimeout = 30 * time.Second
+	return config
+}
+
+// handle handles a server connection. Guests on a Unix socket are the
+// account their process runs as, not whoever their hello claims to be.
 func (s *Server) handle(conn net.Conn) {
+	s.handleAs(conn, peerUser(conn))
+}
+
+// handleAs handles a connection whose guest is known to be user, whatever
+// its hello says, or is trusted to say who it is if user is empty
+func (s *Server) handleAs(conn net.Conn, user string) {
 	remote := conn.RemoteAddr().String()
-	local := conn.LocalAddr().String()
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
 
 	// Send handshake message first
-	_, err := conn.Write([]byte(HandshakeMsg))
+	_, err := conn.Write([]byte(s.banner))
 	if err != nil {
-		log.Printf("[%s] handshake error: %v", remote, err)
+		s.logger.Printf("[%s] handshake error: %v", remote, err)
+		conn.Close()
 		return
 	}
 
-	// Read mode information from client
-	modeBuffer := make([]byte, 256)
-	n, err := conn.Read(modeBuffer)
+	hello, pending, err := readClientHello(conn)
 	if err != nil {
-		log.Printf("[%s] mode read error: %v", remote, err)
+		s.logger.Printf("[%s] handshake error: %v", remote, err)
+		conn.Close()
 		return
 	}
-	
-	// Parse mode from "MODE:value\n" format
-	modeStr := string(modeBuffer[:n])
-	clientMode := "pair" // default
-	if strings.HasPrefix(modeStr, "MODE:") && strings.Contains(modeStr, "\n") {
-		clientMode = strings.TrimSpace(strings.Split(modeStr, ":")[1])
-		clientMode = strings.TrimSpace(strings.Split(clientMode, "\n")[0])
+	if pending != nil {
+		conn = newPrefixConn(conn, pending)
+	}
+	if user != "" {
+		hello.User = user
 	}
-	log.Printf("[%s] client joining in %s mode", remote, clientMode)
 
-	// Configure yamux server
-	config := yamux.DefaultConfig()
-	config.EnableKeepAlive = true
-	config.KeepAliveInterval = 30 * time.Second
-	config.ConnectionWriteTimeout = 30 * time.Second
+	s.serveConn(conn, hello)
+}
+
+// serveConn answers the client's hello and runs the yamux control and data
+// channels over an established connection, attaching the guest to the hub or
+// to a shell of its own
+func (s *Server) serveConn(conn net.Conn, hello Hello) {
+	remote := conn.RemoteAddr().String()
 
-	session, err := yamux.Server(conn, config)
+	clientMode := hello.Mode
+	if clientMode == "" {
+		clientMode = ModePair
+	}
+	who := "client"
+	if hello.User != "" {
+		who = hello.User
+	}
+	s.logger.Printf("[%s] %s joining in %s mode (protocol %d)", remote, who, clientMode, hello.Protocol)
+
+	// Never trust the mode the client asked for beyond what the host allowed
+	grantedMode, err := GrantMode(clientMode, s.mode)
+	if err == nil {
+		err = s.mayJoin(hello.User)
+	}
 	if err != nil {
-		log.Printf("[%s] session error: %v", remote, err)
+		s.logger.Printf("[%s] refusing client: %v", remote, err)
+		s.auditEvent(audit.Record{Event: audit.EventRefused, User: hello.User, Remote: remote, Mode: clientMode, Reason: err.Error()})
+		s.acceptHello(conn, hello, "", err)
+		conn.Close()
 		return
 	}
+	if grantedMode != clientMode {
+		s.logger.Printf("[%s] client asked for %s mode, downgraded to %s", remote, clientMode, grantedMode)
+	}
+	clientMode = grantedMode
 
-	done := make(chan struct{})
+	if hello.Exec {
+		if err := s.mayExec(clientMode); err != nil {
+			s.logger.Printf("[%s] refusing client: %v", remote, err)
+			s.auditEvent(audit.Record{Event: audit.EventRefused, User: hello.User, Remote: remote, Mode: clientMode, Exec: true, Reason: err.Error()})
+			s.acceptHello(conn, hello, "", err)
+			conn.Close()
+			return
+		}
+	}
+
+	inviteID, unredeem, err := s.redeemInvite(hello, remote)
+	if err != nil {
+		s.logger.Printf("[%s] refusing client: %v", remote, err)
+		s.auditEvent(audit.Record{Event: audit.EventRefused, User: hello.User, Remote: remote, Mode: clientMode, Exec: hello.Exec, Reason: err.Error()})
+		s.acceptHello(conn, hello, "", err)
+		conn.Close()
+		return
+	}
+
+	// A guest that never gets connected keeps its invitation
+	if err := s.acceptHello(conn, hello, clientMode, nil); err != nil {
+		s.logger.Printf("[%s] handshake error: %v", remote, err)
+		unredeem()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Configure yamux server
+	session, err := yamux.Server(conn, yamuxConfig())
+	if err != nil {
+		s.logger.Printf("[%s] session error: %v", remote, err)
+		unredeem()
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	guest := s.addGuest(remote, hello.User, clientMode)
+	defer s.removeGuest(guest)
+	s.auditEvent(audit.Record{Event: audit.EventJoin, User: hello.User, Remote: remote, Mode: clientMode, Exec: hello.Exec, Invite: inviteID})
+	defer s.auditLeave(guest, hello.Exec)
+
+	// The guest must open its control and data streams in time too. Streams
+	// it opens after those carry file transfers and forwarded ports.
+	attaching := time.AfterFunc(s.handshakeTimeout, func() {
+		s.logger.Printf("[%s] handshake timed out", remote)
+		session.Close()
+	})
+	defer attaching.Stop()
+	streams := func() {
+		attaching.Stop()
+		go s.acceptStreams(session, remote, clientMode)
+	}
+
+	// The guest's shell renders for the guest's terminal and locale
+	env := s.guestEnv(remote, hello.Env)
+
+	// Rogue guests need an independent tmux client, so they never share the hub
+	if hello.Exec {
+		s.serveExec(session, remote, clientMode, attaching, guest.kicked)
+	} else if s.hub != nil && clientMode != ModeRogue {
+		s.hub.serve(session, conn, hello.User, clientMode, env, guest.stats, streams, guest.kicked)
+	} else {
+		s.servePTY(session, conn, hello.User, clientMode, env, guest.stats, streams, guest.kicked)
+	}
+	s.logger.Printf("[%s] done", remote)
+}
+
+// shellCommand builds the guest's command: the shared command if there is
+// one, else the rcfile or the guest shell, with environment variables
+// describing the connection and the guest's terminal settings in env
+func (s *Server) shellCommand(conn net.Conn, clientMode string, env []string) *exec.Cmd {
+	remote := conn.RemoteAddr().String()
+	local := conn.LocalAddr().String()
 
 	// Extract ports and addresses for environment variables
 	var remoteHost, remotePort, localPort string
@@ -227,93 +1111,178 @@ func (s *Server) handle(conn net.Conn) {
 		localPort = port
 	}
 
-	// Create bash command with environment variables
 	var cmd *exec.Cmd
-	if s.rcfile != "" {
-		// Check if the rcfile exists before trying to source it
-		wrapperScript := fmt.Sprintf(`
-export SOCAT_SOCKPORT=%s
-export SOCAT_PEERADDR=%s
-export SOCAT_PEERPORT=%s
-export JCAT_MODE=%s
-if [[ -f "%s" ]]; then
-    source %s
-else
-    echo "Warning: setsize script not found at %s" >&2
-fi
-exec /bin/bash -i
-`, localPort, remoteHost, remotePort, clientMode, s.rcfile, s.rcfile, s.rcfile)
-		cmd = exec.Command("/bin/bash", "-c", wrapperScript)
-	} else {
-		wrapperScript := fmt.Sprintf(`
-export SOCAT_SOCKPORT=%s
-export SOCAT_PEERADDR=%s
-export SOCAT_PEERPORT=%s
-export JCAT_MODE=%s
-exec /bin/bash -i
-`, localPort, remoteHost, remotePort, clientMode)
-		cmd = exec.Command("/bin/bash", "-c", wrapperScript)
+	switch {
+	case s.command != "":
+		cmd = exec.Command(s.shell, "-c", s.command)
+	case s.rcfile != "":
+		cmd = exec.Command(bashPath(), "-c", rcfileWrapper, "jcat", s.rcfile, s.shell)
+	default:
+		cmd = exec.Command(s.shell, "-i")
+	}
+
+	cmd.Env = append(withGuestEnv(os.Environ(), env),
+		"SOCAT_SOCKPORT="+localPort,
+		"SOCAT_PEERADDR="+remoteHost,
+		"SOCAT_PEERPORT="+remotePort,
+		"JCAT_MODE="+clientMode,
+	)
+	// Guests on a Unix socket have no port to look the session up by
+	if s.sessionName != "" {
+		cmd.Env = append(cmd.Env, "JMUX_SESSION_NAME="+s.sessionName)
+	}
+	return cmd
+}
+
+// newRecorder opens the recording for a newly started PTY, or returns nil
+// when recording is off
+func (s *Server) newRecorder() *recording.Recorder {
+	if s.recordPath == "" {
+		return nil
 	}
 
-	shellPty, err := pty.Start(cmd)
+	s.recordMu.Lock()
+	s.recordings++
+	n := s.recordings
+	s.recordMu.Unlock()
+
+	path := s.recordPath
+	if n > 1 {
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), n, ext)
+	}
+
+	recorder, err := recording.NewRecorder(path, s.logger)
 	if err != nil {
-		log.Printf("[%s] pty error: %v", remote, err)
-		return
+		s.logger.Printf("recording error: %v", err)
+		return nil
 	}
+	s.logger.Printf("recording session to %s", path)
+	return recorder
+}
 
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("[%s] wait error: %v", remote, err)
+// readLine reads a newline-terminated line one byte at a time so nothing
+// after it is consumed, and returns it without the newline
+func readLine(r io.Reader, max int) (string, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) < max {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
 		}
-		done <- struct{}{}
-	}()
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("line too long")
+}
+
+// servePTY attaches user's guest to a shell of its own, or back to the shell
+// it had before its connection dropped, and copies the PTY to and from the
+// guest's data channel, until either side hangs up or the guest is kicked
+func (s *Server) servePTY(session *yamux.Session, conn net.Conn, user, clientMode string, env []string, stats *connStats, streams func(), kicked <-chan string) {
+	remote := conn.RemoteAddr().String()
 
 	// Control channel for window size updates
 	controlChannel, err := session.Accept()
 	if err != nil {
-		log.Printf("[%s] control channel accept error: %v", remote, err)
+		s.logger.Printf("[%s] control channel accept error: %v", remote, err)
 		return
 	}
+	control := newControlConn(controlChannel)
 
-	go func() {
-		r := gob.NewDecoder(controlChannel)
-		for {
-			var win struct {
-				Rows, Cols int
-			}
-			if err := r.Decode(&win); err != nil {
-				break
-			}
-			if err := setSize(shellPty, win.Rows, win.Cols); err != nil {
-				log.Printf("[%s] setsize error: %v", remote, err)
-				break
-			}
-			if err := syscall.Kill(cmd.Process.Pid, syscall.SIGWINCH); err != nil {
-				log.Printf("[%s] sigwinch error: %v", remote, err)
-				break
-			}
+	// The first message says whether the guest is resuming a shell
+	hello, err := control.receive()
+	if err != nil {
+		s.logger.Printf("[%s] control read error: %v", remote, err)
+		return
+	}
+
+	offset := hello.Offset
+	shell := s.resumeShell(hello.Resume, user)
+	if shell != nil {
+		s.logger.Printf("[%s] resuming the shell of %s", remote, shell.remote)
+	} else {
+		if hello.Resume != "" {
+			s.logger.Printf("[%s] shell to resume is gone, starting a new one", remote)
 		}
-		done <- struct{}{}
-	}()
+		if shell, err = s.startShell(conn, user, clientMode, env); err != nil {
+			s.logger.Printf("[%s] pty error: %v", remote, err)
+			return
+		}
+		offset = 0
+	}
+
+	grace := s.resumeGrace
+	if s.closing() {
+		grace = 0
+	}
+	reply := ControlMessage{
+		Kind:        KindHello,
+		Mode:        shell.mode,
+		Compression: negotiateCompression(hello.Compression, s.compress),
+	}
+	if hello.CanResume {
+		reply.Token = shell.token
+	} else {
+		grace = 0
+	}
+	if err := control.sendVersioned(reply); err != nil {
+		s.logger.Printf("[%s] control write error: %v", remote, err)
+	}
+
+	if err := shell.resize(hello.Rows, hello.Cols); err != nil {
+		s.logger.Printf("[%s] setsize error: %v", remote, err)
+	}
 
 	// Data channel for I/O
 	dataChannel, err := session.Accept()
 	if err != nil {
-		log.Printf("[%s] data channel accept error: %v", remote, err)
+		s.logger.Printf("[%s] data channel accept error: %v", remote, err)
+		shell.release(grace)
 		return
 	}
+	streams()
 
-	cp := func(dst io.Writer, src io.Reader) {
-		io.Copy(dst, src)
-		done <- struct{}{}
+	var out io.Writer = &countingWriter{w: dataChannel, n: &stats.out}
+	if reply.Compression != "" {
+		out = newCompressWriter(out)
 	}
-	go cp(dataChannel, shellPty)
-	go cp(shellPty, dataChannel)
+	replaced := shell.attach(out, session, offset)
+	done := make(chan struct{}, 2)
 
-	<-done
-	shellPty.Close()
-	session.Close()
-	log.Printf("[%s] done", remote)
+	go stats.measure(control, session.CloseChan())
+	go func() {
+		serveControl(control, s.logger, remote, stats, shell.resize)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		if shell.mode == ModeView {
+			// View-only guests never reach the shell, whatever tmux -r allows
+			io.Copy(&countingWriter{w: io.Discard, n: &stats.in}, dataChannel)
+		} else {
+			io.Copy(&countingWriter{w: shell.pty, n: &stats.in}, dataChannel)
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+		// Nobody is coming back to a server that is shutting down
+		if s.closing() {
+			grace = 0
+		}
+		shell.detach(out, grace)
+	case <-replaced:
+		s.logger.Printf("[%s] taken over by a resumed connection", remote)
+	case <-shell.exited:
+		notifyEnd(session, control, dataChannel, ControlMessage{Kind: KindExit})
+	case reason := <-kicked:
+		shell.detach(out, 0)
+		notifyEnd(session, control, dataChannel, ControlMessage{Kind: KindKick, Text: reason})
+	}
 }
 
 // setSize sets the terminal size
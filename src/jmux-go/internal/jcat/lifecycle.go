@@ -0,0 +1,223 @@
+package jcat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ShutdownTimeout is how long Serve gives guests and their shells to go
+// once its context is done
+const ShutdownTimeout = 10 * time.Second
+
+// shutdownPollInterval is how often Shutdown checks what is left running
+const shutdownPollInterval = 50 * time.Millisecond
+
+// shutdownReason is what guests are told when the share ends
+const shutdownReason = "the share has ended"
+
+// Serve runs the server until ctx is done, then shuts it down, giving
+// guests ShutdownTimeout to go
+func (s *Server) Serve(ctx context.Context) error {
+	return s.listenAndServe(ctx, "jcat server", s.handle)
+}
+
+// ServeListener serves guests from ln, which the caller created and the
+// server closes, until ctx is done, then shuts the server down like Serve
+func (s *Server) ServeListener(ctx context.Context, ln net.Listener) error {
+	return s.serveUntil(ctx, ln, s.handle)
+}
+
+// ServeConn serves a guest on conn, such as one end of a pipe or a
+// connection accepted elsewhere, and returns once the guest is gone
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveOne(conn, s.handle)
+}
+
+// Shutdown stops accepting guests, tells the connected ones that the share
+// has ended and hangs up their shells, then waits until they are all gone.
+// If ctx is done first, whatever is left is killed and ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	s.lifeMu.Lock()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.lifeMu.Unlock()
+
+	s.guestsMu.Lock()
+	if len(s.guests) > 0 {
+		s.logger.Printf("shutting down, disconnecting %d guests", len(s.guests))
+	}
+	for guest := range s.guests {
+		guest.kick(shutdownReason)
+	}
+	s.guestsMu.Unlock()
+
+	// Shells kept for guests that may resume have nobody left to wait for
+	s.shellsMu.Lock()
+	for _, shell := range s.shells {
+		shell.hangupDetached()
+	}
+	s.shellsMu.Unlock()
+
+	err := s.waitUntil(ctx, func() bool {
+		s.guestsMu.Lock()
+		defer s.guestsMu.Unlock()
+		s.shellsMu.Lock()
+		defer s.shellsMu.Unlock()
+		return len(s.guests) == 0 && len(s.shells) == 0
+	})
+	if err == nil {
+		// Whoever is left is still handshaking and has no session to end
+		s.closeConns()
+		err = s.waitUntil(ctx, func() bool {
+			s.lifeMu.Lock()
+			defer s.lifeMu.Unlock()
+			return len(s.conns) == 0
+		})
+	}
+	if err != nil {
+		s.logger.Printf("shutdown timed out, killing what is left")
+		s.kill()
+	}
+	return err
+}
+
+// waitUntil polls done until it reports true or ctx is done
+func (s *Server) waitUntil(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// closing reports whether the server is shutting down
+func (s *Server) closing() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill drops every connection and kills every shell still running
+func (s *Server) kill() {
+	s.closeConns()
+
+	s.shellsMu.Lock()
+	for _, shell := range s.shells {
+		shell.kill()
+	}
+	s.shellsMu.Unlock()
+
+	if s.hub != nil {
+		s.hub.kill()
+	}
+}
+
+// closeConns closes every connection still being served
+func (s *Server) closeConns() {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serve accepts connections from ln and hands each one to handler until ln
+// is closed
+func (s *Server) serve(ln net.Listener, handler func(net.Conn)) error {
+	s.lifeMu.Lock()
+	if s.closing() {
+		s.lifeMu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listeners[ln] = struct{}{}
+	s.lifeMu.Unlock()
+	defer func() {
+		s.lifeMu.Lock()
+		delete(s.listeners, ln)
+		s.lifeMu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.closing() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			delay = min(max(delay*2, acceptMinDelay), acceptMaxDelay)
+			s.logger.Printf("accept error: %v; retrying in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.closed:
+				return nil
+			}
+			continue
+		}
+		delay = 0
+
+		if !s.track(conn) {
+			if s.closing() {
+				return nil
+			}
+			continue
+		}
+		go func() {
+			defer s.untrack(conn)
+			handler(conn)
+		}()
+	}
+}
+
+// track admits conn, counting it against the limits until untrack, or
+// turns it away and reports false
+func (s *Server) track(conn net.Conn) bool {
+	ip := remoteIP(conn)
+	if !s.allowedFrom(ip) {
+		go s.refuse(conn, fmt.Sprintf("connections from %s are not allowed", ip))
+		return false
+	}
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.closing() {
+		conn.Close()
+		return false
+	}
+	if reason := s.admit(ip); reason != "" {
+		go s.refuse(conn, reason)
+		return false
+	}
+	s.conns[conn] = ip
+	return true
+}
+
+// untrack forgets a connection track admitted once it has been served
+func (s *Server) untrack(conn net.Conn) {
+	s.lifeMu.Lock()
+	delete(s.conns, conn)
+	s.lifeMu.Unlock()
+}
+
+// serveOne serves a single connection with handler, subject to the same
+// limits as connections accepted from a listener
+func (s *Server) serveOne(conn net.Conn, handler func(net.Conn)) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	handler(conn)
+}
@@ -0,0 +1,84 @@
+package jcat
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeShutsDownWhenContextEnds(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "shell.pid")
+	rcfile := filepath.Join(dir, "rc.sh")
+	script := "stty -echo\necho $$ > " + pidFile + "\necho ready\nexec cat\n"
+	if err := os.WriteFile(rcfile, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	addr := freeAddr(t)
+	server := NewServerWithOptions(addr, rcfile, ServerOptions{ResumeGrace: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+
+	// Reconnecting is on, so only the kick keeps the guest from coming back
+	client := NewClientWithOptions(addr, ClientOptions{})
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if conn, err = client.dial(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+	ran := make(chan error, 1)
+	go func() { ran <- client.run(conn, readInput(stdinReader), output, sizes) }()
+	output.waitFor(t, "ready")
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve returned %v", err)
+		}
+	case <-time.After(ShutdownTimeout):
+		t.Fatalf("Serve did not return after its context ended")
+	}
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatalf("client returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not stop")
+	}
+	output.waitFor(t, shutdownReason)
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("failed to read shell pid: %v", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Fatalf("guest shell %d still running", pid)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("server still accepts connections")
+	}
+}
@@ -0,0 +1,98 @@
+package jcat
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"jmux/internal/audit"
+)
+
+// DefaultHandshakeTimeout bounds each phase of a guest's handshake, from
+// the banner to opening its data stream
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxConnsPerIP is how many connections one IP address may have
+// open at once
+const DefaultMaxConnsPerIP = 8
+
+// Backoff after failed accepts, so a server out of file descriptors does
+// not spin
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// refusalWriteTimeout bounds how long a refused client gets to read why
+const refusalWriteTimeout = time.Second
+
+// admit reports why a new connection from ip must be turned away, or "" if
+// it may go on. Connections still handshaking count, since each may become
+// a guest with a shell. s.lifeMu must be held.
+func (s *Server) admit(ip string) string {
+	if s.maxGuests > 0 && len(s.conns) >= s.maxGuests {
+		return fmt.Sprintf("the share is full (at most %d guests)", s.maxGuests)
+	}
+	if ip != "" && s.maxConnsPerIP > 0 {
+		n := 0
+		for _, other := range s.conns {
+			if other == ip {
+				n++
+			}
+		}
+		if n >= s.maxConnsPerIP {
+			return fmt.Sprintf("too many connections from %s", ip)
+		}
+	}
+	return ""
+}
+
+// allowedFrom reports whether a connection from ip may be served. Those
+// that do not come over IP are local and always may.
+func (s *Server) allowedFrom(ip string) bool {
+	if ip == "" || len(s.allowFrom) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, network := range s.allowFrom {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayJoin fails unless user is one of the guests the share lets in
+func (s *Server) mayJoin(user string) error {
+	if len(s.allowedUsers) == 0 {
+		return nil
+	}
+	for _, allowed := range s.allowedUsers {
+		if allowed == user {
+			return nil
+		}
+	}
+	if user == "" {
+		return fmt.Errorf("this session is private")
+	}
+	return fmt.Errorf("this session is private and %s is not invited", user)
+}
+
+// refuse tells a client why it was turned away, in place of the banner,
+// and hangs up
+func (s *Server) refuse(conn net.Conn, reason string) {
+	defer conn.Close()
+	s.logger.Printf("[%s] refused: %s", conn.RemoteAddr(), reason)
+	s.auditEvent(audit.Record{Event: audit.EventRefused, Remote: conn.RemoteAddr().String(), Reason: reason})
+	conn.SetWriteDeadline(time.Now().Add(refusalWriteTimeout))
+	conn.Write([]byte(refusedBanner + reason + "\n"))
+}
+
+// remoteIP returns the IP address conn comes from, or "" for connections
+// that do not come over IP
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
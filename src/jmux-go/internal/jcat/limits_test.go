@@ -0,0 +1,81 @@
+package jcat
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// holdGuest connects a guest to addr and keeps it attached until the test
+// ends
+func holdGuest(t *testing.T, addr string) {
+	t.Helper()
+	client := NewClientWithOptions(addr, ClientOptions{NoReconnect: true})
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	stdinReader, stdinWriter := io.Pipe()
+	t.Cleanup(func() { stdinWriter.Close() })
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+	go client.run(conn, readInput(stdinReader), output, sizes)
+	output.waitFor(t, "ready")
+}
+
+func TestConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+		want string
+	}{
+		{"max guests", ServerOptions{MaxGuests: 1}, "the share is full (at most 1 guests)"},
+		{"per IP", ServerOptions{MaxConnsPerIP: 1}, "too many connections from 127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startScriptServer(t, "stty -echo\necho ready\nexec cat\n", tt.opts)
+			holdGuest(t, addr)
+
+			_, err := NewClientWithOptions(addr, ClientOptions{NoReconnect: true}).dial()
+			if err == nil || !strings.Contains(err.Error(), "server refused connection: "+tt.want) {
+				t.Fatalf("second guest's dial error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	addr := startScriptServer(t, "stty -echo\necho ready\nexec cat\n", ServerOptions{
+		MaxGuests:        1,
+		HandshakeTimeout: 200 * time.Millisecond,
+	})
+
+	// A client that reads the banner and then goes quiet is dropped
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err := readLine(conn, maxBannerLine); err != nil {
+		t.Fatalf("no banner: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle client read %v, want the server to hang up", err)
+	}
+
+	// and no longer holds the only guest slot
+	var dialErr error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var guest net.Conn
+		if guest, dialErr = NewClientWithOptions(addr, ClientOptions{NoReconnect: true}).dial(); dialErr == nil {
+			guest.Close()
+			return
+		}
+	}
+	t.Fatalf("slot still taken after the idle client was dropped: %v", dialErr)
+}
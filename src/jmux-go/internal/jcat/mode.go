@@ -0,0 +1,53 @@
+package jcat
+
+import "fmt"
+
+// Sharing modes a guest can join in
+const (
+	ModePair  = "pair"
+	ModeView  = "view"
+	ModeRogue = "rogue"
+)
+
+// modeRank orders the sharing modes by how much they let a guest do:
+// view < pair < rogue. Unknown modes rank below view.
+func modeRank(mode string) int {
+	switch mode {
+	case ModeView:
+		return 1
+	case ModePair:
+		return 2
+	case ModeRogue:
+		return 3
+	}
+	return 0
+}
+
+// validMode reports whether mode is a known sharing mode
+func validMode(mode string) bool {
+	return modeRank(mode) > 0
+}
+
+// GrantMode returns the mode a guest actually gets when it asks for
+// requested on a share the host registered with allowed: the lesser of the
+// two, so a guest may always ask for less than the host allows but never
+// for more.
+func GrantMode(requested, allowed string) (string, error) {
+	if allowed == "" {
+		allowed = ModePair // sessions without a mode default to pair
+	}
+	if !validMode(allowed) {
+		return "", fmt.Errorf("unknown mode %q", allowed)
+	}
+	if requested == "" {
+		return allowed, nil
+	}
+	if !validMode(requested) {
+		return "", fmt.Errorf("unknown mode %q", requested)
+	}
+
+	if modeRank(requested) < modeRank(allowed) {
+		return requested, nil
+	}
+	return allowed, nil
+}
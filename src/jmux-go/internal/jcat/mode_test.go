@@ -0,0 +1,51 @@
+package jcat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGrantMode(t *testing.T) {
+	tests := []struct {
+		requested, allowed string
+		want               string
+		err                string
+	}{
+		// Asking for nothing gets whatever the host allowed
+		{"", "", ModePair, ""},
+		{"", ModeView, ModeView, ""},
+		{"", ModeRogue, ModeRogue, ""},
+
+		// Asking for less than the host allows gets what was asked for
+		{ModeView, ModePair, ModeView, ""},
+		{ModeView, ModeRogue, ModeView, ""},
+		{ModePair, ModeRogue, ModePair, ""},
+		{ModeView, "", ModeView, ""},
+
+		// Asking for exactly what the host allows
+		{ModeView, ModeView, ModeView, ""},
+		{ModePair, ModePair, ModePair, ""},
+		{ModeRogue, ModeRogue, ModeRogue, ""},
+
+		// Asking for more is downgraded to the host's mode
+		{ModePair, ModeView, ModeView, ""},
+		{ModeRogue, ModeView, ModeView, ""},
+		{ModeRogue, ModePair, ModePair, ""},
+		{ModeRogue, "", ModePair, ""},
+
+		{"admin", ModePair, "", `unknown mode "admin"`},
+		{ModeView, "admin", "", `unknown mode "admin"`},
+	}
+	for _, tt := range tests {
+		got, err := GrantMode(tt.requested, tt.allowed)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("GrantMode(%q, %q) error = %v, want %q", tt.requested, tt.allowed, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("GrantMode(%q, %q) = %q, %v; want %q", tt.requested, tt.allowed, got, err, tt.want)
+		}
+	}
+}
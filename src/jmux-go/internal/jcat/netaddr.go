@@ -0,0 +1,109 @@
+package jcat
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenAddr returns the TCP address for port on host, which may be an IPv6
+// address. An empty host means every interface.
+func ListenAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ParseNetworks parses source networks, each a CIDR such as "10.0.0.0/8" or
+// "fd00::/8", or a single IPv4 or IPv6 address
+func ParseNetworks(specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(spec); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(spec, "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network %q: want an address or a CIDR such as 10.0.0.0/8", spec)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
+// ResolveBind returns the IP address to listen on for spec, which is an IP
+// address, the name of a network interface such as "eth0", a CIDR, which
+// picks this machine's address within it, or a host name. An empty spec
+// returns "", meaning every interface.
+func ResolveBind(spec string) (string, error) {
+	spec = strings.Trim(strings.TrimSpace(spec), "[]")
+	if spec == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(spec); ip != nil {
+		return ip.String(), nil
+	}
+	if iface, err := net.InterfaceByName(spec); err == nil {
+		return interfaceAddr(iface)
+	}
+	if _, network, err := net.ParseCIDR(spec); err == nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && network.Contains(ipnet.IP) {
+				return ipnet.IP.String(), nil
+			}
+		}
+		return "", fmt.Errorf("no address of this machine is in %s", spec)
+	}
+
+	ips, err := net.LookupIP(spec)
+	if err != nil {
+		return "", fmt.Errorf("cannot bind to %q: not an address, interface or CIDR, and %v", spec, err)
+	}
+	return ips[0].String(), nil
+}
+
+// interfaceAddr picks the address of iface to listen on, preferring IPv4
+// and then global IPv6 over link-local addresses, which only work with
+// their zone
+func interfaceAddr(iface *net.Interface) (string, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var v6, linkLocal string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		switch ip := ipnet.IP; {
+		case ip.To4() != nil:
+			return ip.String(), nil
+		case ip.IsLinkLocalUnicast():
+			if linkLocal == "" {
+				linkLocal = ip.String() + "%" + iface.Name
+			}
+		case v6 == "":
+			v6 = ip.String()
+		}
+	}
+	switch {
+	case v6 != "":
+		return v6, nil
+	case linkLocal != "":
+		return linkLocal, nil
+	}
+	return "", fmt.Errorf("interface %s has no IP address", iface.Name)
+}
@@ -0,0 +1,95 @@
+package jcat
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8", "[::1]"})
+	if err != nil {
+		t.Fatalf("ParseNetworks failed: %v", err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"fd12::1", true},
+		{"::1", true},
+		{"2001:db8::1", false},
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		s := &Server{allowFrom: networks}
+		if got := s.allowedFrom(tt.ip); got != tt.want {
+			t.Errorf("allowedFrom(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("ParseNetworks accepted a bad CIDR")
+	}
+}
+
+func TestResolveBind(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", ""},
+		{"127.0.0.1", "127.0.0.1"},
+		{"[::1]", "::1"},
+		{"127.0.0.0/8", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		got, err := ResolveBind(tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("ResolveBind(%q) = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+
+	if _, err := ResolveBind("198.51.100.0/24"); err == nil || !strings.Contains(err.Error(), "no address of this machine") {
+		t.Errorf("binding to a CIDR without a local address: %v", err)
+	}
+	if got := ListenAddr("fd00::5", 12345); got != "[fd00::5]:12345" {
+		t.Errorf("ListenAddr = %q", got)
+	}
+}
+
+func TestAllowFromRefusesOtherNetworks(t *testing.T) {
+	networks, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	addr := startScriptServer(t, "stty -echo\necho ready\nexec cat\n", ServerOptions{AllowFrom: networks})
+
+	_, err := NewClientWithOptions(addr, ClientOptions{NoReconnect: true}).dial()
+	if err == nil || !strings.Contains(err.Error(), "connections from 127.0.0.1 are not allowed") {
+		t.Fatalf("dial error = %v, want the connection refused", err)
+	}
+}
+
+func TestIPv6Guest(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	networks, _ := ParseNetworks([]string{"::1"})
+	server := NewServerWithOptions(addr, "", ServerOptions{AllowFrom: networks})
+	ln, err = listen(server.listenAddr, 0)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.serve(ln, server.handle)
+
+	conn, err := NewClientWithOptions(addr, ClientOptions{NoReconnect: true}).dial()
+	if err != nil {
+		t.Fatalf("failed to connect over IPv6: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,78 @@
+package jcat
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// overlayQuiet is how long output must pause before the overlay is drawn,
+// so it never lands in the middle of an escape sequence
+const overlayQuiet = 200 * time.Millisecond
+
+// overlay passes session output through to the terminal and draws a status
+// line in its top right corner whenever the output pauses
+type overlay struct {
+	out io.Writer
+
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+// Write passes output through to the terminal
+func (o *overlay) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastWrite = time.Now()
+	return o.out.Write(p)
+}
+
+// draw writes text at the top right corner, leaving the cursor where it
+// was. It reports false without drawing if output arrived too recently.
+func (o *overlay) draw(text string, cols int) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.lastWrite) < overlayQuiet {
+		return false
+	}
+
+	width := utf8.RuneCountInString(text)
+	if cols < width {
+		return true
+	}
+	// Save cursor, move to row 1, draw in reverse video, restore cursor
+	fmt.Fprintf(o.out, "\x1b7\x1b[1;%dH\x1b[7m%s\x1b[0m\x1b8", cols-width+1, text)
+	return true
+}
+
+// show redraws the connection's stats every statsInterval, waiting for a
+// pause in the output each time, until done is closed
+func (o *overlay) show(stats *connStats, state *resumeState, done <-chan struct{}) {
+	ticker := time.NewTicker(overlayQuiet)
+	defer ticker.Stop()
+
+	next := time.Now().Add(statsInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			if now.Before(next) {
+				continue
+			}
+			state.mu.Lock()
+			cols := state.size.Cols
+			state.mu.Unlock()
+			if o.draw(statsLine(stats.snapshot()), cols) {
+				next = now.Add(statsInterval)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// statsLine formats stats for the overlay
+func statsLine(stats Stats) string {
+	return fmt.Sprintf(" rtt %s  ↓%s  ↑%s ", FormatRTT(stats.RTT), FormatRate(stats.InRate), FormatRate(stats.OutRate))
+}
@@ -0,0 +1,358 @@
+package jcat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/hashicorp/yamux"
+	"jmux/internal/recording"
+)
+
+// DefaultResumeGrace is how long a guest's shell outlives a dropped
+// connection, waiting for the guest to come back
+const DefaultResumeGrace = time.Minute
+
+// resumeBacklog is how much recent output a shell keeps for replaying to a
+// guest that resumes
+const resumeBacklog = 256 * 1024
+
+// exitNoticeTimeout bounds how long the server waits for a client to hang up
+// after telling it that its shell exited
+const exitNoticeTimeout = 5 * time.Second
+
+// newResumeToken returns a random token identifying a resumable shell
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// outputLog keeps the tail of a shell's output, addressed by the offset of
+// each byte since the shell started
+type outputLog struct {
+	buf   []byte
+	total int64
+}
+
+// write appends p, dropping the oldest output beyond resumeBacklog
+func (l *outputLog) write(p []byte) {
+	l.total += int64(len(p))
+	l.buf = append(l.buf, p...)
+	if over := len(l.buf) - resumeBacklog; over > 0 {
+		copy(l.buf, l.buf[over:])
+		l.buf = l.buf[:resumeBacklog]
+	}
+}
+
+// since returns the output after offset and whether all of it is still kept
+func (l *outputLog) since(offset int64) ([]byte, bool) {
+	start := l.total - int64(len(l.buf))
+	if offset < start || offset > l.total {
+		return append([]byte(nil), l.buf...), false
+	}
+	return append([]byte(nil), l.buf[offset-start:]...), true
+}
+
+// guestShell is a shell started for one guest. It keeps running while the
+// guest is disconnected so the guest can resume it.
+type guestShell struct {
+	token    string
+	user     string // guest it was started for
+	remote   string
+	mode     string
+	recorder *recording.Recorder
+	exited   chan struct{} // closed once the shell has exited and pty is closed
+	logger   *log.Logger
+
+	writeMu sync.Mutex // keeps replayed and live output in order
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd // its Process is only signalled while the shell runs
+	pty      *os.File  // only resized while the shell runs
+	output   outputLog
+	out      io.Writer     // data channel of the attached guest, nil while detached
+	conn     io.Closer     // session of the attached guest
+	replaced chan struct{} // closed when another connection takes over
+	expiry   *time.Timer
+}
+
+// startShell spawns a resumable shell for user's guest
+func (s *Server) startShell(conn net.Conn, user, mode string, env []string) (*guestShell, error) {
+	token, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := s.shellCommand(conn, mode, env)
+	shellPty, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	shell := &guestShell{
+		token:    token,
+		user:     user,
+		remote:   conn.RemoteAddr().String(),
+		mode:     mode,
+		cmd:      cmd,
+		pty:      shellPty,
+		recorder: s.newRecorder(),
+		exited:   make(chan struct{}),
+		logger:   s.logger,
+	}
+
+	s.shellsMu.Lock()
+	s.shells[token] = shell
+	s.shellsMu.Unlock()
+
+	go shell.pump()
+	go func() {
+		<-shell.exited
+		s.shellsMu.Lock()
+		delete(s.shells, token)
+		s.shellsMu.Unlock()
+	}()
+	return shell, nil
+}
+
+// resumeShell returns the running shell issued token to user, or nil
+func (s *Server) resumeShell(token, user string) *guestShell {
+	if token == "" {
+		return nil
+	}
+	s.shellsMu.Lock()
+	defer s.shellsMu.Unlock()
+	if shell := s.shells[token]; shell != nil && shell.user == user {
+		return shell
+	}
+	return nil
+}
+
+// resuming reports whether token lets user back into a session it was
+// already let into
+func (s *Server) resuming(token, user string) bool {
+	if s.resumeShell(token, user) != nil {
+		return true
+	}
+	return s.hub != nil && s.hub.resumable(token, user)
+}
+
+// pump records the shell's output and forwards it to the attached guest
+// until the shell exits
+func (g *guestShell) pump() {
+	defer g.recorder.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := g.pty.Read(buf)
+		if n > 0 {
+			g.emit(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err := g.cmd.Wait(); err != nil {
+		g.logger.Printf("[%s] wait error: %v", g.remote, err)
+	}
+
+	// Resizes and signals check exited under g.mu, so none of them reach
+	// the closed PTY or the reaped process
+	g.mu.Lock()
+	close(g.exited)
+	g.pty.Close()
+	if g.expiry != nil {
+		g.expiry.Stop()
+	}
+	g.mu.Unlock()
+}
+
+// emit logs a chunk of output and writes it to the attached guest, if any.
+// A failed write is left for the connection handler to notice.
+func (g *guestShell) emit(p []byte) {
+	g.recorder.Write(p)
+
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+
+	g.mu.Lock()
+	g.output.write(p)
+	out := g.out
+	g.mu.Unlock()
+
+	if out != nil {
+		out.Write(p)
+	}
+}
+
+// attach makes out the shell's output after replaying everything the guest
+// missed since offset. A connection still attached is closed, since a
+// resuming guest means its old connection is dead. The returned channel is
+// closed if yet another connection takes over.
+func (g *guestShell) attach(out io.Writer, conn io.Closer, offset int64) <-chan struct{} {
+	g.mu.Lock()
+	if g.expiry != nil {
+		g.expiry.Stop()
+		g.expiry = nil
+	}
+	stale := g.conn
+	if g.replaced != nil {
+		close(g.replaced)
+	}
+	g.out, g.conn, g.replaced = nil, nil, nil
+	g.mu.Unlock()
+
+	// Closing the old session unblocks a live write stuck on it
+	if stale != nil {
+		stale.Close()
+	}
+
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	missed, complete := g.output.since(offset)
+	if len(missed) > 0 {
+		out.Write(missed)
+	}
+	if !complete {
+		// Part of the gap is lost, so have the application redraw
+		g.signal(syscall.SIGWINCH)
+	}
+	g.out, g.conn = out, conn
+	g.replaced = make(chan struct{})
+	return g.replaced
+}
+
+// detach disconnects out from the shell and hangs the shell up unless the
+// guest resumes within grace
+func (g *guestShell) detach(out io.Writer, grace time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.out != out {
+		return
+	}
+	g.out, g.conn, g.replaced = nil, nil, nil
+	g.orphan(grace)
+}
+
+// release lets go of a shell that never got attached to the connection
+// that started or resumed it
+func (g *guestShell) release(grace time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.out == nil && g.expiry == nil {
+		g.orphan(grace)
+	}
+}
+
+// orphan hangs up a shell nobody is attached to unless it is resumed
+// within grace. g.mu must be held.
+func (g *guestShell) orphan(grace time.Duration) {
+	if grace <= 0 {
+		g.hangup()
+		return
+	}
+	g.logger.Printf("[%s] connection lost, keeping shell for %s", g.remote, grace)
+	g.expiry = time.AfterFunc(grace, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.out == nil {
+			g.logger.Printf("[%s] not resumed in time, closing shell", g.remote)
+			g.hangup()
+		}
+	})
+}
+
+// hangupDetached hangs up the shell now if no guest is attached to it,
+// rather than when its resume grace runs out
+func (g *guestShell) hangupDetached() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.out != nil {
+		return
+	}
+	if g.expiry != nil {
+		g.expiry.Stop()
+		g.expiry = nil
+	}
+	g.hangup()
+}
+
+// hangup closes the PTY, which sends SIGHUP to the shell. g.mu must be
+// held.
+func (g *guestShell) hangup() {
+	if g.done() {
+		return
+	}
+	g.signal(syscall.SIGHUP)
+	g.pty.Close()
+}
+
+// kill kills the shell process if it is still running
+func (g *guestShell) kill() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.signal(syscall.SIGKILL)
+}
+
+// signal sends sig to the shell process unless it has exited. g.mu must be
+// held.
+func (g *guestShell) signal(sig syscall.Signal) {
+	if !g.done() && g.cmd.Process != nil {
+		g.cmd.Process.Signal(sig)
+	}
+}
+
+// done reports whether the shell has exited
+func (g *guestShell) done() bool {
+	select {
+	case <-g.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// resize sets the PTY window size and lets the shell know
+func (g *guestShell) resize(rows, cols int) error {
+	if rows <= 0 || cols <= 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done() {
+		return nil
+	}
+	if err := setSize(g.pty, rows, cols); err != nil {
+		return err
+	}
+	g.recorder.Resize(rows, cols)
+	g.signal(syscall.SIGWINCH)
+	return nil
+}
+
+// notifyEnd tells the client with msg, a KindExit or KindKick, that its
+// session is over, so it does not reconnect, then gives it a moment to read
+// the rest of the output and hang up
+func notifyEnd(session *yamux.Session, control *controlConn, data io.Closer, msg ControlMessage) {
+	control.sendVersioned(msg)
+	data.Close()
+	select {
+	case <-session.CloseChan():
+	case <-time.After(exitNoticeTimeout):
+	}
+}
@@ -0,0 +1,163 @@
+package jcat
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startResumeServer runs a plain server whose guest shell answers each line
+// after a short delay, so output can be produced while a guest is away
+func startResumeServer(t *testing.T) string {
+	t.Helper()
+
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	script := "stty -echo\necho ready\nwhile read line; do\n  [ \"$line\" = quit ] && exit 0\n  sleep 0.3\n  echo \"got:$line\"\ndone\n"
+	if err := os.WriteFile(rcfile, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	server := NewServerWithOptions(ln.Addr().String(), rcfile, ServerOptions{ResumeGrace: 10 * time.Second})
+	go server.serve(ln, server.handle)
+	return ln.Addr().String()
+}
+
+// gatedDialer hands out connections to the client, holding reconnects back
+// until open is called
+type gatedDialer struct {
+	client *Client
+	gate   chan struct{}
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *gatedDialer) dial() (net.Conn, error) {
+	d.mu.Lock()
+	first := len(d.conns) == 0
+	d.mu.Unlock()
+	if !first {
+		<-d.gate
+	}
+
+	conn, err := d.client.dialPlain()
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	return conn, nil
+}
+
+func (d *gatedDialer) drop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[len(d.conns)-1].Close()
+}
+
+func TestClientResumesAfterDrop(t *testing.T) {
+	addr := startResumeServer(t)
+
+	client := NewClient(addr)
+	dialer := &gatedDialer{client: client, gate: make(chan struct{})}
+	client.dial = dialer.dial
+
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+
+	go client.run(conn, readInput(stdinReader), output, sizes)
+	output.waitFor(t, "ready")
+
+	// The answer arrives while the guest is disconnected
+	stdinWriter.Write([]byte("one\n"))
+	time.Sleep(50 * time.Millisecond)
+	dialer.drop()
+	output.waitFor(t, "reconnecting")
+	time.Sleep(600 * time.Millisecond)
+	close(dialer.gate)
+
+	output.waitFor(t, "got:one")
+	stdinWriter.Write([]byte("two\n"))
+	output.waitFor(t, "got:two")
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	if n := strings.Count(output.buf.String(), "got:one"); n != 1 {
+		t.Fatalf("missed output replayed %d times, want once: %q", n, output.buf.String())
+	}
+}
+
+func TestClientStopsWhenShellExits(t *testing.T) {
+	addr := startResumeServer(t)
+
+	client := NewClient(addr)
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+
+	result := make(chan error, 1)
+	go func() { result <- client.run(conn, readInput(stdinReader), output, sizes) }()
+	output.waitFor(t, "ready")
+
+	stdinWriter.Write([]byte("quit\n"))
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("run returned error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("client kept running after the shell exited")
+	}
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	if strings.Contains(output.buf.String(), "reconnecting") {
+		t.Fatalf("client tried to reconnect to an exited shell: %q", output.buf.String())
+	}
+}
+
+func TestOutputLogSince(t *testing.T) {
+	var l outputLog
+	l.write([]byte("hello "))
+	l.write([]byte("world"))
+
+	if got, complete := l.since(6); string(got) != "world" || !complete {
+		t.Fatalf("since(6) = %q, %v", got, complete)
+	}
+
+	l.write(bytes.Repeat([]byte("x"), resumeBacklog))
+	if _, complete := l.since(6); complete {
+		t.Fatalf("since(6) should report output that was dropped")
+	}
+	if got, complete := l.since(l.total); len(got) != 0 || !complete {
+		t.Fatalf("since(total) = %d bytes, %v", len(got), complete)
+	}
+}
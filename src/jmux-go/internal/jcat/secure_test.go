@@ -0,0 +1,211 @@
+package jcat
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"jmux/internal/security"
+)
+
+// testSecurityConfig returns a security config with cheap Argon2 parameters
+func testSecurityConfig() *security.SecurityConfig {
+	config := security.DefaultSecurityConfig()
+	config.Enabled = true
+	config.SessionPasswords["demo"] = "s3cret"
+	config.Argon2Params.Memory = 8 * 1024
+	config.Argon2Params.Iterations = 1
+	return config
+}
+
+// syncBuffer collects output written by the client from another goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) waitFor(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		got := b.buf.String()
+		b.mu.Unlock()
+		if strings.Contains(got, want) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t.Fatalf("timed out waiting for %q, got %q", want, b.buf.String())
+}
+
+// startSecureServer runs a secure server on a loopback port whose guest
+// shell echoes its input back through cat
+func startSecureServer(t *testing.T) (*SecureServer, string) {
+	t.Helper()
+
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	script := "stty -echo\necho \"ready:$JCAT_MODE\"\nexec cat\n"
+	if err := os.WriteFile(rcfile, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	server := NewSecureServer(ln.Addr().String(), rcfile, testSecurityConfig())
+	go server.serve(ln, server.handleSecure)
+
+	return server, ln.Addr().String()
+}
+
+func TestSecureServerClientEndToEnd(t *testing.T) {
+	_, addr := startSecureServer(t)
+
+	client := NewSecureClientWithMode(addr, "pair", testSecurityConfig())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	encConn, err := client.performClientHandshake(conn, "demo", "")
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+
+	go client.stream(encConn, readInput(stdinReader), output, sizes, &resumeState{})
+
+	output.waitFor(t, "ready:pair")
+
+	if _, err := stdinWriter.Write([]byte("hello over the encrypted channel\n")); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	output.waitFor(t, "hello over the encrypted channel")
+}
+
+func TestSecureServerRejectsWrongPassword(t *testing.T) {
+	_, addr := startSecureServer(t)
+
+	client := NewSecureClientWithMode(addr, "pair", testSecurityConfig())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := client.performClientHandshake(conn, "demo", "wrong"); err == nil {
+		t.Fatalf("handshake should fail with the wrong password")
+	}
+}
+
+func TestSecureServerBindsPasswordsToSessions(t *testing.T) {
+	config := testSecurityConfig()
+	config.SessionPasswords["other"] = "hunter2"
+
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	if err := os.WriteFile(rcfile, []byte("exit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(sessionName string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		server := NewSecureServerWithOptions(ln.Addr().String(), rcfile, config, ServerOptions{SessionName: sessionName})
+		go server.serve(ln, server.handleSecure)
+		return ln.Addr().String()
+	}
+	handshake := func(addr, sessionName, password string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := NewSecureClientWithMode(addr, "pair", testSecurityConfig())
+		_, err = client.performClientHandshake(conn, sessionName, password)
+		return err
+	}
+
+	// A server for any session checks only the password of the one asked for
+	anySession := serve("")
+	if err := handshake(anySession, "demo", "s3cret"); err != nil {
+		t.Errorf("joining demo with its password failed: %v", err)
+	}
+	if err := handshake(anySession, "demo", "hunter2"); err == nil {
+		t.Error("other's password unlocked demo")
+	}
+	if err := handshake(anySession, "missing", "s3cret"); err == nil || !strings.Contains(err.Error(), "no session 'missing'") {
+		t.Errorf("joining an unknown session = %v, want it refused", err)
+	}
+
+	// A server for one session knows no other, even with the right password
+	demo := serve("demo")
+	if err := handshake(demo, "other", "hunter2"); err == nil || !strings.Contains(err.Error(), "no session 'other'") {
+		t.Errorf("joining another session = %v, want it refused", err)
+	}
+	if err := handshake(demo, "demo", "s3cret"); err != nil {
+		t.Errorf("joining demo with its password failed: %v", err)
+	}
+}
+
+// recordConn keeps what is written to it
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestEncryptedConnRejectsReplayedFrames(t *testing.T) {
+	var key [32]byte
+	wire := &recordConn{}
+	client, err := NewEncryptedConn(wire, key, security.SideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("rm -rf build\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone on the path sends the frame again
+	frame := wire.written.Bytes()
+	server, err := NewEncryptedConn(nil, key, security.SideServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.reader = bytes.NewReader(append(append([]byte{}, frame...), frame...))
+
+	buf := make([]byte, 64)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "rm -rf build\n" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	if n, err := server.Read(buf); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("Read of the replayed frame = %q, %v; want it rejected", buf[:n], err)
+	}
+}
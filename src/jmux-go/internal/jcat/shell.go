@@ -0,0 +1,87 @@
+package jcat
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// rcfileWrapper sources the rcfile, a bash script that normally execs tmux,
+// and falls back to the guest shell if it returns. The rcfile and shell are
+// its arguments $1 and $2, so no path is ever spliced into the script.
+const rcfileWrapper = `if [[ -f "$1" ]]; then
+    source "$1"
+else
+    echo "Warning: setsize script not found at $1" >&2
+fi
+exec "$2" -i
+`
+
+// DefaultShell returns the shell guests get when none is configured: the
+// user's login shell, else $SHELL, else bash or sh from PATH
+func DefaultShell() string {
+	if shell := loginShell(); shell != "" {
+		return shell
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	for _, name := range []string{"bash", "sh"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return "/bin/sh"
+}
+
+// loginShell returns the current user's login shell from the password
+// database, asking getent first so directory services are covered, or ""
+// if it cannot be found
+func loginShell() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	if out, err := exec.Command("getent", "passwd", u.Username).Output(); err == nil {
+		if shell := passwdShell(strings.TrimSpace(string(out))); shell != "" {
+			return shell
+		}
+	}
+
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name, _, _ := strings.Cut(scanner.Text(), ":"); name == u.Username {
+			return passwdShell(scanner.Text())
+		}
+	}
+	return ""
+}
+
+// passwdShell returns the shell field of a passwd entry, if it names one
+// that can run
+func passwdShell(entry string) string {
+	fields := strings.Split(entry, ":")
+	if len(fields) != 7 {
+		return ""
+	}
+	shell := fields[6]
+	if info, err := os.Stat(shell); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return ""
+	}
+	return shell
+}
+
+// bashPath returns the bash to source rcfiles with, wherever it is installed
+func bashPath() string {
+	if path, err := exec.LookPath("bash"); err == nil {
+		return path
+	}
+	return "/bin/bash"
+}
@@ -0,0 +1,65 @@
+package jcat
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSharedCommand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// The rcfile is not used when a command is shared
+	server := NewServerWithOptions(ln.Addr().String(), "/nonexistent/rc.sh", ServerOptions{
+		Shell:   "sh",
+		Command: `stty -echo; echo "shared $JCAT_MODE via $0"`,
+	})
+	go server.serve(ln, server.handle)
+
+	var wire atomic.Int64
+	out := catSession(t, ln.Addr().String(), ClientOptions{NoReconnect: true}, &wire, 0)
+	if !strings.Contains(out, "shared pair via sh") || strings.Contains(out, "Warning") {
+		t.Fatalf("output = %q, want the shared command's", out)
+	}
+}
+
+func TestRcfilePathIsNotInterpolated(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), `it's "$HOME"; here`)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	rcfile := filepath.Join(dir, "rc.sh")
+	if err := os.WriteFile(rcfile, []byte("stty -echo\necho \"sourced for $JCAT_MODE\"\nexit 0\n"), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := NewServerWithOptions(ln.Addr().String(), rcfile, ServerOptions{Mode: ModeView})
+	go server.serve(ln, server.handle)
+
+	var wire atomic.Int64
+	out := catSession(t, ln.Addr().String(), ClientOptions{Mode: ModeView, NoReconnect: true}, &wire, 0)
+	if !strings.Contains(out, "sourced for view") {
+		t.Fatalf("output = %q, want the rcfile sourced", out)
+	}
+}
+
+func TestPasswdShell(t *testing.T) {
+	if got := passwdShell("alice:x:1000:1000::/home/alice:/bin/sh"); got != "/bin/sh" {
+		t.Errorf("passwdShell = %q, want /bin/sh", got)
+	}
+	if got := passwdShell("alice:x:1000:1000::/home/alice:/nonexistent/zsh"); got != "" {
+		t.Errorf("passwdShell accepted a missing shell: %q", got)
+	}
+}
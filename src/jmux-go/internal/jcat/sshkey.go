@@ -0,0 +1,170 @@
+package jcat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"jmux/internal/security"
+)
+
+// maxKeyOffers bounds the keys a guest may try before it is refused
+const maxKeyOffers = 10
+
+// Key offer replies
+const (
+	keyAccepted = "KEY_OK"
+	keyRefused  = "KEY_NO"
+)
+
+// authenticateSSHKey has the guest prove it holds a key from the host's
+// authorized_keys and returns the session key and who the key belongs to.
+// The session key is agreed from ephemeral X25519 keys the signature
+// covers, so it is fresh for every connection.
+func (s *SecureServer) authenticateSSHKey(conn net.Conn, reader *bufio.Reader) ([32]byte, string, error) {
+	remote := conn.RemoteAddr().String()
+	refuse := func(err error) ([32]byte, string, error) {
+		conn.Write([]byte("AUTH_FAIL\n"))
+		return [32]byte{}, "", err
+	}
+
+	nonce, err := s.auth.GenerateNonce()
+	if err != nil {
+		return [32]byte{}, "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	ephemeral, err := security.GenerateEphemeralKey()
+	if err != nil {
+		return [32]byte{}, "", fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+	serverKey := ephemeral.PublicKey().Bytes()
+
+	// The challenge carries our ephemeral key after the nonce
+	challenge := append(append([]byte{}, nonce...), serverKey...)
+	if _, err := conn.Write([]byte(security.FormatChallengeMessage(challenge))); err != nil {
+		return [32]byte{}, "", fmt.Errorf("failed to send challenge: %v", err)
+	}
+
+	// Tell the guest which of its keys would do until it signs with one
+	var responseMsg string
+	for offers := 0; ; offers++ {
+		msg, err := reader.ReadString('\n')
+		if err != nil {
+			return [32]byte{}, "", fmt.Errorf("failed to read response: %v", err)
+		}
+		if !strings.HasPrefix(msg, "OFFER:") {
+			responseMsg = msg
+			break
+		}
+		if offers == maxKeyOffers {
+			return refuse(fmt.Errorf("too many keys offered"))
+		}
+		key, err := security.ParseOfferMessage(msg)
+		if err != nil {
+			return refuse(fmt.Errorf("failed to parse offer: %v", err))
+		}
+		reply := keyAccepted
+		if _, err := s.sshAuth.Authorize(key); err != nil {
+			reply = keyRefused
+		}
+		if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+			return [32]byte{}, "", fmt.Errorf("failed to answer offer: %v", err)
+		}
+	}
+
+	wire, err := security.ParseResponseMessage(responseMsg)
+	if err != nil {
+		return refuse(fmt.Errorf("failed to parse response: %v", err))
+	}
+	var response security.SSHKeyResponse
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(wire, &response); err != nil {
+		return refuse(fmt.Errorf("failed to parse response: %v", err))
+	}
+	if err := ssh.Unmarshal(response.Signature, &signature); err != nil {
+		return refuse(fmt.Errorf("failed to parse signature: %v", err))
+	}
+	key, err := ssh.ParsePublicKey(response.PublicKey)
+	if err != nil {
+		return refuse(fmt.Errorf("failed to parse key: %v", err))
+	}
+
+	user, err := s.sshAuth.Authorize(key)
+	if err != nil {
+		return refuse(err)
+	}
+	proof := security.SSHKeyProof(nonce, serverKey, response.ClientKey, key)
+	if err := security.VerifyProof(key, proof, &signature); err != nil {
+		return refuse(fmt.Errorf("bad signature from %s: %v", user, err))
+	}
+	sessionKey, err := security.DeriveEphemeralSessionKey(ephemeral, response.ClientKey, nonce)
+	if err != nil {
+		return refuse(err)
+	}
+
+	s.logger.Printf("[%s] client authenticated as '%s' with %s key %s", remote, user, key.Type(), ssh.FingerprintSHA256(key))
+	return sessionKey, user, nil
+}
+
+// authenticateSSHKey offers the server our SSH keys, signs its challenge
+// with the first one it accepts and returns the agreed session key
+func (c *SecureClient) authenticateSSHKey(conn net.Conn, reader *bufio.Reader) ([32]byte, error) {
+	challengeMsg, err := reader.ReadString('\n')
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("failed to read challenge: %v", err)
+	}
+	challenge, err := security.ParseChallengeMessage(challengeMsg)
+	if err != nil || len(challenge) != 64 {
+		return [32]byte{}, fmt.Errorf("failed to parse challenge: %s", strings.TrimSpace(challengeMsg))
+	}
+	nonce, serverKey := challenge[:32], challenge[32:]
+
+	signers, done, err := c.sshAuth.Signers()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer done()
+	ephemeral, err := security.GenerateEphemeralKey()
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+	clientKey := ephemeral.PublicKey().Bytes()
+
+	for _, signer := range signers {
+		key := signer.PublicKey()
+		if _, err := conn.Write([]byte(security.FormatOfferMessage(key))); err != nil {
+			return [32]byte{}, fmt.Errorf("failed to offer key: %v", err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("failed to read offer reply: %v", err)
+		}
+		switch strings.TrimSpace(reply) {
+		case keyRefused:
+			continue
+		case keyAccepted:
+		default:
+			return [32]byte{}, fmt.Errorf("authentication failed: %s", strings.TrimSpace(reply))
+		}
+
+		signature, err := security.SignProof(signer, security.SSHKeyProof(nonce, serverKey, clientKey, key))
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("failed to sign with %s key %s: %v", key.Type(), ssh.FingerprintSHA256(key), err)
+		}
+		response := security.SSHKeyResponse{
+			PublicKey: key.Marshal(),
+			ClientKey: clientKey,
+			Signature: ssh.Marshal(signature),
+		}
+		if _, err := conn.Write([]byte(security.FormatResponseMessage(ssh.Marshal(&response)))); err != nil {
+			return [32]byte{}, fmt.Errorf("failed to send response: %v", err)
+		}
+		if err := readAuthResult(reader); err != nil {
+			return [32]byte{}, err
+		}
+		c.logger.Printf("Authenticated with %s key %s", key.Type(), ssh.FingerprintSHA256(key))
+		return security.DeriveEphemeralSessionKey(ephemeral, serverKey, nonce)
+	}
+	return [32]byte{}, fmt.Errorf("authentication failed: the host has authorized none of your SSH keys")
+}
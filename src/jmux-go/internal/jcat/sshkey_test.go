@@ -0,0 +1,115 @@
+package jcat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jmux/internal/audit"
+	"jmux/internal/security"
+)
+
+// writeSSHKey creates an SSH key in dir and returns the private key file
+// and its authorized_keys line, commented with comment
+func writeSSHKey(t *testing.T, dir, comment string) (string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, strings.ReplaceAll(comment, "@", "_"))
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + comment
+}
+
+// sshKeyConfig returns the settings of an sshkey share or guest
+func sshKeyConfig(authorizedKeys string, identityFiles ...string) *security.SecurityConfig {
+	config := security.DefaultSecurityConfig()
+	config.Enabled = true
+	config.Method = security.AuthMethodSSHKey
+	config.SSHKey = &security.SSHKeyConfig{AuthorizedKeys: authorizedKeys, IdentityFiles: identityFiles}
+	return config
+}
+
+func TestSSHKeyAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	bobKey, bobLine := writeSSHKey(t, dir, "bob@laptop")
+	malloryKey, _ := writeSSHKey(t, dir, "mallory@laptop")
+	authorizedKeys := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(authorizedKeys, []byte("# the team\n"+bobLine+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	if err := os.WriteFile(rcfile, []byte("stty -echo\necho ready\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(opts ServerOptions) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		server := NewSecureServerWithOptions(ln.Addr().String(), rcfile, sshKeyConfig(authorizedKeys), opts)
+		go server.serve(ln, server.handleSecure)
+		return ln.Addr().String()
+	}
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	addr := serve(ServerOptions{AuditPath: auditPath})
+
+	// Bob claims to be someone else, but his key says who he is. The
+	// unauthorized key he also has is offered first and passed over.
+	input, typing := io.Pipe()
+	output := &syncBuffer{}
+	bob := NewSecureClientWithOptions(addr, sshKeyConfig("", malloryKey, bobKey), ClientOptions{User: "mallory", NoReconnect: true})
+	go bob.ConnectTerminal("", "", input, output, nil)
+	output.waitFor(t, "ready")
+	typing.Write([]byte("typed by bob\n"))
+	output.waitFor(t, "typed by bob")
+	records := waitForRecords(t, auditPath, 1)
+	if records[0].Event != audit.EventJoin || records[0].User != "bob" {
+		t.Fatalf("audit record = %+v, want bob joining", records[0])
+	}
+	typing.Close()
+	waitForRecords(t, auditPath, 2)
+
+	// A key the host has not authorized gets nowhere
+	mallory := NewSecureClientWithOptions(addr, sshKeyConfig("", malloryKey), ClientOptions{NoReconnect: true})
+	if _, err := mallory.dialSecure("", ""); err == nil || !strings.Contains(err.Error(), "none of your SSH keys") {
+		t.Errorf("joining with an unauthorized key = %v, want it refused", err)
+	}
+
+	// Nor does a password on a share that wants keys
+	password := NewSecureClientWithOptions(addr, testSecurityConfig(), ClientOptions{NoReconnect: true})
+	if _, err := password.dialSecure("demo", ""); err == nil || !strings.Contains(err.Error(), "sshkey") {
+		t.Errorf("joining by password = %v, want it refused", err)
+	}
+	records = waitForRecords(t, auditPath, 4)
+	if records[2].Event != audit.EventAuthFailed || records[3].Event != audit.EventAuthFailed {
+		t.Errorf("audit records = %+v, want both refusals recorded", records[2:])
+	}
+
+	// Private shares let in only the users they invited, by key
+	private := serve(ServerOptions{AllowedUsers: []string{"carol"}})
+	bob = NewSecureClientWithOptions(private, sshKeyConfig("", bobKey), ClientOptions{User: "carol", NoReconnect: true})
+	if _, err := bob.dialSecure("", ""); err == nil || !strings.Contains(err.Error(), "bob is not invited") {
+		t.Errorf("joining a private share = %v, want bob refused", err)
+	}
+}
@@ -0,0 +1,331 @@
+package jcat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsInterval is how often connections are pinged and their throughput
+// sampled
+const statsInterval = 2 * time.Second
+
+// Stats is a snapshot of one connection's latency and throughput
+type Stats struct {
+	RTT     time.Duration // round trip of the last answered ping, zero if none yet
+	InRate  float64       // bytes per second received over the last interval
+	OutRate float64       // bytes per second sent over the last interval
+}
+
+// connStats measures a connection's latency and throughput
+type connStats struct {
+	in, out atomic.Int64 // bytes received and sent so far
+
+	mu         sync.Mutex
+	stats      Stats
+	lastIn     int64
+	lastOut    int64
+	lastSample time.Time
+	pings      map[uint64]time.Time // sent pings waiting for their pong
+	seq        uint64
+}
+
+// newConnStats starts measuring a connection
+func newConnStats() *connStats {
+	return &connStats{
+		lastSample: time.Now(),
+		pings:      make(map[uint64]time.Time),
+	}
+}
+
+// sample updates the rates from the bytes counted since the last sample
+func (s *connStats) sample() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	in, out := s.in.Load(), s.out.Load()
+	s.stats.InRate = float64(in-s.lastIn) / elapsed
+	s.stats.OutRate = float64(out-s.lastOut) / elapsed
+	s.lastIn, s.lastOut, s.lastSample = in, out, now
+}
+
+// nextPing returns the sequence number of a new ping and notes when it left.
+// Pings never answered are forgotten once a later one is.
+func (s *connStats) nextPing() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.pings[s.seq] = time.Now()
+	return s.seq
+}
+
+// pong records the round trip of the ping with sequence number seq
+func (s *connStats) pong(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent, ok := s.pings[seq]
+	if !ok {
+		return
+	}
+	s.stats.RTT = time.Since(sent)
+	for pending := range s.pings {
+		if pending <= seq {
+			delete(s.pings, pending)
+		}
+	}
+}
+
+// snapshot returns the latest measurements
+func (s *connStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// measure pings the peer and samples throughput every statsInterval until
+// done is closed. 2.0.0 peers are never pinged.
+func (s *connStats) measure(control *controlConn, done <-chan struct{}) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sample()
+			if control.versioned() {
+				control.send(ControlMessage{Kind: KindPing, Seq: s.nextPing()})
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// GuestStats describes a connected guest as seen by the server
+type GuestStats struct {
+	Remote    string
+	User      string // who joined, if the client said
+	Mode      string
+	Connected time.Time
+	Stats
+}
+
+// guestConn is a guest connection registered with the server
+type guestConn struct {
+	remote    string
+	user      string
+	mode      string
+	connected time.Time
+	stats     *connStats
+	kicked    chan string // receives why the guest is disconnected for good
+}
+
+// addGuest registers a newly connected guest
+func (s *Server) addGuest(remote, user, mode string) *guestConn {
+	guest := &guestConn{
+		remote:    remote,
+		user:      user,
+		mode:      mode,
+		connected: time.Now(),
+		stats:     newConnStats(),
+		kicked:    make(chan string, 1),
+	}
+	s.guestsMu.Lock()
+	s.guests[guest] = struct{}{}
+	s.guestsMu.Unlock()
+	return guest
+}
+
+// kick disconnects the guest for good, telling it reason. Only the first
+// reason is kept.
+func (g *guestConn) kick(reason string) {
+	select {
+	case g.kicked <- reason:
+	default:
+	}
+}
+
+// removeGuest unregisters a guest that disconnected
+func (s *Server) removeGuest(guest *guestConn) {
+	s.guestsMu.Lock()
+	delete(s.guests, guest)
+	s.guestsMu.Unlock()
+}
+
+// Guests returns the connected guests, oldest first
+func (s *Server) Guests() []GuestStats {
+	s.guestsMu.Lock()
+	defer s.guestsMu.Unlock()
+
+	guests := make([]GuestStats, 0, len(s.guests))
+	for guest := range s.guests {
+		guests = append(guests, GuestStats{
+			Remote:    guest.remote,
+			User:      guest.user,
+			Mode:      guest.mode,
+			Connected: guest.connected,
+			Stats:     guest.stats.snapshot(),
+		})
+	}
+	sort.Slice(guests, func(i, j int) bool {
+		return guests[i].Connected.Before(guests[j].Connected)
+	})
+	return guests
+}
+
+// writeStatsFile keeps path up to date with the connected guests until
+// done is closed, then removes it
+func (s *Server) writeStatsFile(path string, done <-chan struct{}) {
+	defer os.Remove(path)
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		if err := WriteGuestStats(path, s.Guests()); err != nil {
+			s.logger.Printf("stats file error: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// WriteGuestStats replaces the stats file at path, one line of key=value
+// fields per guest
+func WriteGuestStats(path string, guests []GuestStats) error {
+	var b strings.Builder
+	for _, g := range guests {
+		user := g.User
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(&b, "remote=%s user=%s mode=%s connected=%d rtt_ms=%.1f in_bps=%.0f out_bps=%.0f\n",
+			g.Remote, user, g.Mode, g.Connected.Unix(),
+			float64(g.RTT)/float64(time.Millisecond), g.InRate, g.OutRate)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".guests-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadGuestStats reads a stats file written by WriteGuestStats
+func ReadGuestStats(path string) ([]GuestStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var guests []GuestStats
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var g GuestStats
+		for _, field := range strings.Fields(scanner.Text()) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "remote":
+				g.Remote = value
+			case "user":
+				if value != "-" {
+					g.User = value
+				}
+			case "mode":
+				g.Mode = value
+			case "connected":
+				if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+					g.Connected = time.Unix(sec, 0)
+				}
+			case "rtt_ms":
+				if ms, err := strconv.ParseFloat(value, 64); err == nil {
+					g.RTT = time.Duration(ms * float64(time.Millisecond))
+				}
+			case "in_bps":
+				g.InRate, _ = strconv.ParseFloat(value, 64)
+			case "out_bps":
+				g.OutRate, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		if g.Remote != "" {
+			guests = append(guests, g)
+		}
+	}
+	return guests, scanner.Err()
+}
+
+// FormatRate formats a byte rate for display
+func FormatRate(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", bytesPerSec/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.1f KB/s", bytesPerSec/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSec)
+	}
+}
+
+// FormatRTT formats a round trip time for display
+func FormatRTT(rtt time.Duration) string {
+	if rtt <= 0 {
+		return "-"
+	}
+	if rtt < 10*time.Millisecond {
+		return fmt.Sprintf("%.1fms", float64(rtt)/float64(time.Millisecond))
+	}
+	return fmt.Sprintf("%dms", rtt.Milliseconds())
+}
@@ -0,0 +1,51 @@
+package jcat
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConnStatsPong(t *testing.T) {
+	stats := newConnStats()
+	first := stats.nextPing()
+	second := stats.nextPing()
+	time.Sleep(10 * time.Millisecond)
+
+	stats.pong(second)
+	if rtt := stats.snapshot().RTT; rtt < 10*time.Millisecond {
+		t.Fatalf("RTT = %s, want at least 10ms", rtt)
+	}
+
+	// The older ping is forgotten once a newer one is answered
+	before := stats.snapshot().RTT
+	stats.pong(first)
+	if stats.snapshot().RTT != before {
+		t.Fatalf("a stale pong changed the RTT")
+	}
+}
+
+func TestGuestStatsFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice_demo.guests")
+	connected := time.Unix(1700000000, 0)
+	want := []GuestStats{
+		{Remote: "10.0.0.5:51234", Mode: ModePair, Connected: connected, Stats: Stats{RTT: 23 * time.Millisecond, InRate: 12, OutRate: 4096}},
+		{Remote: "unix:uid=1001,pid=42", Mode: ModeView, Connected: connected},
+	}
+
+	if err := WriteGuestStats(path, want); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got, err := ReadGuestStats(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d guests, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("guest %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package jcat
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// StreamKind says what an extra stream, opened by the guest after its
+// control and data streams, is for
+type StreamKind string
+
+const (
+	// StreamFile transfers a file between guest and host
+	StreamFile StreamKind = "file"
+	// StreamForward carries one forwarded TCP connection to Addr on the
+	// receiving side. Hosts open them back to the guest for reverse
+	// forwardings.
+	StreamForward StreamKind = "forward"
+	// StreamListen asks the host to listen on Addr for a reverse forwarding
+	// for as long as the stream stays open
+	StreamListen StreamKind = "listen"
+	// StreamExec runs Command on the host without a terminal
+	StreamExec StreamKind = "exec"
+)
+
+// streamFeatures maps each stream kind to the feature the host must accept
+var streamFeatures = map[StreamKind]string{
+	StreamFile:    FeatureFiles,
+	StreamForward: FeatureForward,
+	StreamListen:  FeatureForward,
+	StreamExec:    FeatureExec,
+}
+
+// StreamRequest is the first frame on every extra stream
+type StreamRequest struct {
+	Kind  StreamKind `json:"kind"`
+	Op    string     `json:"op,omitempty"`    // file: "put" or "get"
+	Path  string     `json:"path,omitempty"`  // file: path on the host
+	Size  int64      `json:"size,omitempty"`  // file put: bytes that follow
+	Mode  uint32     `json:"mode,omitempty"`  // file put: permission bits
+	Force bool       `json:"force,omitempty"` // file put: replace an existing file
+	Addr  string     `json:"addr,omitempty"`  // forward: target, listen: address to listen on
+
+	Command string `json:"command,omitempty"` // exec: shell command line to run
+}
+
+// StreamReply answers a StreamRequest
+type StreamReply struct {
+	Error string `json:"error,omitempty"`
+	Path  string `json:"path,omitempty"` // file: where the host put or found the file
+	Size  int64  `json:"size,omitempty"` // file get: bytes that follow
+	Mode  uint32 `json:"mode,omitempty"` // file get: permission bits
+	Sum   string `json:"sum,omitempty"`  // file: hex SHA-256 of the bytes sent
+	Addr  string `json:"addr,omitempty"` // listen: address the host listens on
+}
+
+// acceptStreams serves the extra streams a guest opens until its session
+// closes
+func (s *Server) acceptStreams(session *yamux.Session, remote, mode string) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveStream(session, stream, remote, mode)
+	}
+}
+
+// serveStream dispatches an extra stream on the kind its request names
+func (s *Server) serveStream(session *yamux.Session, stream net.Conn, remote, mode string) {
+	defer stream.Close()
+
+	var req StreamRequest
+	if err := readFrame(stream, &req); err != nil {
+		s.logger.Printf("[%s] stream request error: %v", remote, err)
+		return
+	}
+	switch req.Kind {
+	case StreamFile:
+		s.serveFile(stream, req, remote, mode)
+	case StreamForward:
+		s.serveForward(stream, req, remote, mode)
+	case StreamListen:
+		s.serveListen(session, stream, req, remote, mode)
+	case StreamExec:
+		s.runExec(stream, req, remote, mode)
+	default:
+		writeFrame(stream, StreamReply{Error: fmt.Sprintf("unknown stream kind %q", req.Kind)})
+	}
+}
+
+// liveSession is the connection local commands are relayed over
+type liveSession struct {
+	session *yamux.Session
+	peer    Hello
+}
+
+// serveLocal accepts connections from local dmux commands on ln and relays
+// each over a new stream of the current connection to the host
+func (c *Client) serveLocal(ln net.Listener) {
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.relay(local)
+	}
+}
+
+// relay copies a local command's connection to and from a new stream,
+// refusing up front what the host is known not to accept
+func (c *Client) relay(local net.Conn) {
+	defer local.Close()
+
+	var req StreamRequest
+	if err := readFrame(local, &req); err != nil {
+		return
+	}
+	live := c.live.Load()
+	if live == nil {
+		writeFrame(local, StreamReply{Error: "not connected to the host right now"})
+		return
+	}
+	if feature, ok := streamFeatures[req.Kind]; ok && !live.peer.Supports(feature) {
+		writeFrame(local, StreamReply{Error: fmt.Sprintf("the host does not allow %s streams", req.Kind)})
+		return
+	}
+
+	stream, err := live.session.Open()
+	if err != nil {
+		writeFrame(local, StreamReply{Error: fmt.Sprintf("failed to open stream: %v", err)})
+		return
+	}
+	defer stream.Close()
+	if err := writeFrame(stream, req); err != nil {
+		return
+	}
+
+	join(local, stream)
+}
+
+// requestStream opens a stream on session, sends req and waits for the
+// other side to accept it
+func requestStream(session *yamux.Session, req StreamRequest) (net.Conn, error) {
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	var reply StreamReply
+	if err := writeFrame(stream, req); err == nil {
+		err = readFrame(stream, &reply)
+	}
+	if err == nil && reply.Error != "" {
+		err = fmt.Errorf("%s", reply.Error)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// openStream connects to the dmux join listening on socket and sends req,
+// returning the connection and the host's reply
+func openStream(socket string, req StreamRequest) (net.Conn, StreamReply, error) {
+	var reply StreamReply
+	conn, err := dial(UnixPrefix + socket)
+	if err != nil {
+		return nil, reply, fmt.Errorf("cannot reach dmux join: %v", err)
+	}
+	if err := writeFrame(conn, req); err != nil {
+		conn.Close()
+		return nil, reply, err
+	}
+	if err := readFrame(conn, &reply); err != nil {
+		conn.Close()
+		return nil, reply, fmt.Errorf("no reply from the host: %v", err)
+	}
+	if reply.Error != "" {
+		conn.Close()
+		return nil, reply, fmt.Errorf("%s", reply.Error)
+	}
+	return conn, reply, nil
+}
@@ -0,0 +1,93 @@
+package jcat
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"jmux/internal/audit"
+	"jmux/internal/security"
+)
+
+// TLSServer wraps Server with mutual TLS: guests must present a certificate
+// from the team CA, and are known by the user it was issued to rather than
+// by the name in their hello
+type TLSServer struct {
+	*Server
+	config *tls.Config
+}
+
+// NewTLSServerWithOptions creates a jcat server that requires mutual TLS
+// with config, usually from security.TLSConfig.ServerConfig
+func NewTLSServerWithOptions(listenAddr, rcfile string, config *tls.Config, opts ServerOptions) *TLSServer {
+	return &TLSServer{
+		Server: NewServerWithOptions(listenAddr, rcfile, opts),
+		config: config,
+	}
+}
+
+// Start starts the TLS jcat server and runs it until it fails
+func (s *TLSServer) Start() error {
+	return s.Serve(context.Background())
+}
+
+// Serve runs the TLS server until ctx is done, then shuts it down, giving
+// guests ShutdownTimeout to go
+func (s *TLSServer) Serve(ctx context.Context) error {
+	return s.listenAndServe(ctx, "TLS jcat server", s.handleTLS)
+}
+
+// ServeListener serves guests from ln like Server.ServeListener, requiring
+// mutual TLS
+func (s *TLSServer) ServeListener(ctx context.Context, ln net.Listener) error {
+	return s.serveUntil(ctx, ln, s.handleTLS)
+}
+
+// ServeConn serves a guest on conn like Server.ServeConn, requiring mutual
+// TLS
+func (s *TLSServer) ServeConn(conn net.Conn) {
+	s.serveOne(conn, s.handleTLS)
+}
+
+// handleTLS authenticates a guest by its certificate and serves it as the
+// user the certificate names
+func (s *TLSServer) handleTLS(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+
+	tlsConn := tls.Server(conn, s.config)
+	if err := tlsConn.Handshake(); err != nil {
+		s.logger.Printf("[%s] TLS handshake failed: %v", remote, err)
+		s.auditEvent(audit.Record{Event: audit.EventAuthFailed, Remote: remote, Reason: err.Error()})
+		conn.Close()
+		return
+	}
+	user := security.PeerIdentity(tlsConn.ConnectionState())
+	s.logger.Printf("[%s] client authenticated as '%s'", remote, user)
+
+	s.handleAs(tlsConn, user)
+}
+
+// NewTLSClientWithOptions creates a jcat client that connects over mutual
+// TLS with config, usually from security.TLSConfig.ClientConfig
+func NewTLSClientWithOptions(connectAddr string, config *tls.Config, opts ClientOptions) *Client {
+	c := NewClientWithOptions(connectAddr, opts)
+	transport := c.transport
+	c.transport = func() (net.Conn, error) {
+		conn, err := transport()
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	return c
+}
@@ -0,0 +1,90 @@
+package jcat
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"jmux/internal/audit"
+	"jmux/internal/security"
+)
+
+// currentAccount stands in for user.Lookup, so that requests the test
+// makes in any name count as that user's
+func currentAccount(string) (*user.User, error) { return user.Current() }
+
+// teamCert creates user's key and has ca issue a certificate for it
+func teamCert(t *testing.T, ca *security.CA, user string) *security.TLSConfig {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), user+".key")
+	key, err := security.LoadOrCreateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Request(user, key); err != nil {
+		t.Fatal(err)
+	}
+	// Test users have no accounts, so every request counts as ours
+	ca.LookupUser = currentAccount
+	if _, err := ca.Issue(user); err != nil {
+		t.Fatal(err)
+	}
+	return ca.TLSConfig(user, keyPath)
+}
+
+func TestTLSServerKnowsGuestsByCertificate(t *testing.T) {
+	ca := security.NewCA(filepath.Join(t.TempDir(), "ca"))
+	if _, err := ca.Init("alice"); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := teamCert(t, ca, "alice").ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := teamCert(t, ca, "bob").ClientConfig("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcfile := filepath.Join(t.TempDir(), "rc.sh")
+	if err := os.WriteFile(rcfile, []byte("stty -echo\necho ready\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := NewTLSServerWithOptions(ln.Addr().String(), rcfile, serverConfig, ServerOptions{AuditPath: auditPath})
+	go server.serve(ln, server.handleTLS)
+	addr := ln.Addr().String()
+
+	// Bob claims to be someone else in his hello, but his certificate says who he is
+	input, typing := io.Pipe()
+	defer typing.Close()
+	output := &syncBuffer{}
+	client := NewTLSClientWithOptions(addr, clientConfig, ClientOptions{User: "mallory", NoReconnect: true})
+	if err := client.ConnectTerminal(input, output, nil); err != nil {
+		t.Fatalf("ConnectTerminal failed: %v", err)
+	}
+	output.waitFor(t, "ready")
+	records := waitForRecords(t, auditPath, 1)
+	if len(records) == 0 || records[0].Event != audit.EventJoin || records[0].User != "bob" {
+		t.Fatalf("audit records = %+v, want bob joining", records)
+	}
+
+	// A guest without a team certificate never gets a shell
+	anonymous := NewTLSClientWithOptions(addr, &tls.Config{InsecureSkipVerify: true}, ClientOptions{NoReconnect: true})
+	if _, err := anonymous.dial(); err == nil {
+		t.Fatal("a guest without a certificate was let in")
+	}
+	records = waitForRecords(t, auditPath, 3)
+	if last := records[len(records)-1]; last.Event != audit.EventAuthFailed {
+		t.Errorf("last audit record = %+v, want the guest without a certificate refused", last)
+	}
+}
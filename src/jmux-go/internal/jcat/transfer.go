@@ -0,0 +1,334 @@
+package jcat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File transfer operations
+const (
+	filePut = "put" // guest sends a file to the host
+	fileGet = "get" // guest fetches a file from the host
+)
+
+// progressInterval is how often transfer progress is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// TransferOptions holds optional file transfer settings
+type TransferOptions struct {
+	// Force replaces a file that already exists at the destination
+	Force bool
+
+	// Progress receives a progress line that is redrawn as the transfer
+	// goes, if set
+	Progress io.Writer
+}
+
+// SendFile sends the file at localPath to remotePath on the host, through
+// the dmux join listening on socket, and returns where the host put it. An
+// empty remotePath keeps the file's name.
+func SendFile(socket, localPath, remotePath string, opts TransferOptions) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", localPath)
+	}
+	if remotePath == "" {
+		remotePath = filepath.Base(localPath)
+	}
+
+	conn, reply, err := openStream(socket, StreamRequest{
+		Kind:  StreamFile,
+		Op:    filePut,
+		Path:  remotePath,
+		Size:  info.Size(),
+		Mode:  uint32(info.Mode().Perm()),
+		Force: opts.Force,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	sum := sha256.New()
+	progress := newProgress(opts.Progress, filepath.Base(localPath), info.Size())
+	if _, err := io.CopyN(io.MultiWriter(conn, sum, progress), file, info.Size()); err != nil {
+		return "", fmt.Errorf("send failed: %v", err)
+	}
+	progress.finish()
+	if err := writeFrame(conn, StreamReply{Sum: hex.EncodeToString(sum.Sum(nil))}); err != nil {
+		return "", err
+	}
+
+	// The host answers once it has checked the file against the checksum
+	var result StreamReply
+	if err := readFrame(conn, &result); err != nil {
+		return "", fmt.Errorf("no confirmation from the host: %v", err)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("%s", result.Error)
+	}
+	return reply.Path, nil
+}
+
+// GetFile fetches remotePath from the host into localPath, through the dmux
+// join listening on socket, and returns where the host found it. An empty
+// localPath keeps the file's name in the current directory.
+func GetFile(socket, remotePath, localPath string, opts TransferOptions) (string, error) {
+	if localPath == "" {
+		localPath = filepath.Base(remotePath)
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, filepath.Base(remotePath))
+	}
+	if _, err := os.Stat(localPath); err == nil && !opts.Force {
+		return "", fmt.Errorf("%s already exists", localPath)
+	}
+
+	conn, reply, err := openStream(socket, StreamRequest{Kind: StreamFile, Op: fileGet, Path: remotePath})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	progress := newProgress(opts.Progress, filepath.Base(localPath), reply.Size)
+	if err := receiveFile(conn, localPath, reply.Size, os.FileMode(reply.Mode), progress); err != nil {
+		return "", err
+	}
+	return reply.Path, nil
+}
+
+// receiveFile reads size bytes and the checksum trailer that follows them
+// from r, and moves them into place at path only if they match
+func receiveFile(r io.Reader, path string, size int64, mode os.FileMode, progress *progress) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dmux-transfer-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tmp, sum, progress), r, size)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("transfer interrupted: %v", err)
+	}
+	progress.finish()
+
+	var trailer StreamReply
+	if err := readFrame(r, &trailer); err != nil {
+		return fmt.Errorf("transfer interrupted: %v", err)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != trailer.Sum {
+		return fmt.Errorf("checksum mismatch: got %s, sender had %s", got, trailer.Sum)
+	}
+
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.Chmod(tmp.Name(), mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// serveFile serves a guest's file transfer stream
+func (s *Server) serveFile(stream net.Conn, req StreamRequest, remote, mode string) {
+	refuse := func(format string, args ...interface{}) {
+		reason := fmt.Sprintf(format, args...)
+		s.logger.Printf("[%s] file transfer refused: %s", remote, reason)
+		writeFrame(stream, StreamReply{Error: reason})
+	}
+
+	if s.noFiles {
+		refuse("file transfer is turned off for this share")
+		return
+	}
+	// Reading the host's files is as much more than watching as writing
+	// them is
+	if mode == ModeView {
+		refuse("view-only guests cannot transfer files")
+		return
+	}
+
+	switch req.Op {
+	case filePut:
+		path, err := s.transferPath(req.Path)
+		if err != nil {
+			refuse("%v", err)
+			return
+		}
+		if info, err := os.Stat(path); err == nil {
+			if info.IsDir() {
+				path = filepath.Join(path, filepath.Base(req.Path))
+			}
+			if _, err := os.Stat(path); err == nil && !req.Force {
+				refuse("%s already exists on the host", path)
+				return
+			}
+		}
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
+			refuse("%v", err)
+			return
+		}
+		if err := writeFrame(stream, StreamReply{Path: path}); err != nil {
+			return
+		}
+
+		if err := receiveFile(stream, path, req.Size, os.FileMode(req.Mode), nil); err != nil {
+			s.logger.Printf("[%s] file transfer to %s failed: %v", remote, path, err)
+			writeFrame(stream, StreamReply{Error: err.Error()})
+			return
+		}
+		s.logger.Printf("[%s] received %s (%d bytes)", remote, path, req.Size)
+		writeFrame(stream, StreamReply{Path: path})
+
+	case fileGet:
+		path, err := s.transferPath(req.Path)
+		if err != nil {
+			refuse("%v", err)
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			refuse("%v", err)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			refuse("%v", err)
+			return
+		}
+		if !info.Mode().IsRegular() {
+			refuse("%s is not a regular file", path)
+			return
+		}
+		if err := writeFrame(stream, StreamReply{Path: path, Size: info.Size(), Mode: uint32(info.Mode().Perm())}); err != nil {
+			return
+		}
+
+		sum := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(stream, sum), file, info.Size()); err != nil {
+			s.logger.Printf("[%s] file transfer of %s failed: %v", remote, path, err)
+			return
+		}
+		writeFrame(stream, StreamReply{Sum: hex.EncodeToString(sum.Sum(nil))})
+		s.logger.Printf("[%s] sent %s (%d bytes)", remote, path, info.Size())
+
+	default:
+		refuse("unknown file operation %q", req.Op)
+	}
+}
+
+// transferDir is where relative transfer paths are resolved: the directory
+// of the shared session's active pane, or else the server's own
+func (s *Server) transferDir() string {
+	if s.sessionName != "" {
+		out, err := exec.Command("tmux", "display-message", "-p", "-t", s.sessionName, "#{pane_current_path}").Output()
+		if dir := strings.TrimSpace(string(out)); err == nil && dir != "" {
+			return dir
+		}
+	}
+	if dir, err := os.Getwd(); err == nil {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// transferPath resolves the host path a guest named, relative to the
+// transfer directory
+func (s *Server) transferPath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no path given")
+	}
+	dir := s.transferDir()
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// progress draws a transfer's progress on one line
+type progress struct {
+	out         io.Writer
+	name        string
+	total, done int64
+	start, last time.Time
+}
+
+// newProgress returns a progress line for a transfer of total bytes, or nil
+// if out is nil
+func newProgress(out io.Writer, name string, total int64) *progress {
+	if out == nil {
+		return nil
+	}
+	now := time.Now()
+	return &progress{out: out, name: name, total: total, start: now, last: now}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	if p == nil {
+		return len(b), nil
+	}
+	p.done += int64(len(b))
+	if time.Since(p.last) >= progressInterval {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// finish draws the final state and ends the line
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(p.out)
+}
+
+func (p *progress) draw() {
+	p.last = time.Now()
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.done * 100 / p.total)
+	}
+	rate := float64(p.done) / max(time.Since(p.start).Seconds(), 0.001)
+	fmt.Fprintf(p.out, "\r%s  %s / %s  %3d%%  %s\x1b[K", p.name, FormatSize(p.done), FormatSize(p.total), percent, FormatRate(rate))
+}
+
+// FormatSize formats a byte count for display
+func FormatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
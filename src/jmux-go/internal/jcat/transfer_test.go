@@ -0,0 +1,138 @@
+package jcat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// joinForTransfer connects a guest in mode to a server started with opts
+// and returns the socket local commands reach it through
+func joinForTransfer(t *testing.T, opts ServerOptions, mode string) string {
+	t.Helper()
+	addr := startScriptServer(t, "stty -echo\necho ready\nexec cat\n", opts)
+
+	client := NewClientWithOptions(addr, ClientOptions{Mode: mode, NoReconnect: true})
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "join.sock")
+	ln, err := listen(UnixPrefix+socket, 0600)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go client.serveLocal(ln)
+
+	stdinReader, stdinWriter := io.Pipe()
+	t.Cleanup(func() { stdinWriter.Close() })
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+	go client.run(conn, readInput(stdinReader), output, sizes)
+	output.waitFor(t, "ready")
+	return socket
+}
+
+func TestFileTransferRoundTrip(t *testing.T) {
+	socket := joinForTransfer(t, ServerOptions{}, ModePair)
+	dir := t.TempDir()
+
+	// Large enough to take several yamux windows
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	local := filepath.Join(dir, "local.bin")
+	if err := os.WriteFile(local, content, 0640); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var progress bytes.Buffer
+	remote := filepath.Join(dir, "on-host.bin")
+	where, err := SendFile(socket, local, remote, TransferOptions{Progress: &progress})
+	if err != nil {
+		t.Fatalf("SendFile failed: %v", err)
+	}
+	if where != remote {
+		t.Fatalf("host put the file at %s, want %s", where, remote)
+	}
+	if got, _ := os.ReadFile(remote); !bytes.Equal(got, content) {
+		t.Fatalf("host copy differs from the original")
+	}
+	if info, _ := os.Stat(remote); info.Mode().Perm() != 0640 {
+		t.Fatalf("host copy has mode %v, want 0640", info.Mode().Perm())
+	}
+	if !strings.Contains(progress.String(), "100%") {
+		t.Fatalf("progress never reached 100%%: %q", progress.String())
+	}
+
+	// Sending again must not overwrite without being forced
+	if _, err := SendFile(socket, local, remote, TransferOptions{}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("second SendFile error = %v, want already exists", err)
+	}
+
+	fetched := filepath.Join(dir, "fetched.bin")
+	if _, err := GetFile(socket, remote, fetched, TransferOptions{}); err != nil {
+		t.Fatalf("GetFile failed: %v", err)
+	}
+	if got, _ := os.ReadFile(fetched); !bytes.Equal(got, content) {
+		t.Fatalf("fetched copy differs from the original")
+	}
+}
+
+func TestFileTransferRefusals(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "notes.txt")
+	os.WriteFile(local, []byte("notes\n"), 0644)
+
+	t.Run("view guests cannot push", func(t *testing.T) {
+		socket := joinForTransfer(t, ServerOptions{}, ModeView)
+		_, err := SendFile(socket, local, filepath.Join(dir, "pushed.txt"), TransferOptions{})
+		if err == nil || !strings.Contains(err.Error(), "view-only") {
+			t.Fatalf("SendFile error = %v, want a view-only refusal", err)
+		}
+	})
+
+	t.Run("view guests cannot pull", func(t *testing.T) {
+		socket := joinForTransfer(t, ServerOptions{}, ModeView)
+		pulled := filepath.Join(dir, "pulled.txt")
+		for _, path := range []string{local, "~/.ssh/id_ed25519", "notes.txt"} {
+			_, err := GetFile(socket, path, pulled, TransferOptions{})
+			if err == nil || !strings.Contains(err.Error(), "view-only") {
+				t.Errorf("GetFile(%s) error = %v, want a view-only refusal", path, err)
+			}
+		}
+		if _, err := os.Stat(pulled); err == nil {
+			t.Errorf("a view guest got a file from the host")
+		}
+	})
+
+	t.Run("host turned transfers off", func(t *testing.T) {
+		socket := joinForTransfer(t, ServerOptions{NoFiles: true}, ModePair)
+		_, err := SendFile(socket, local, filepath.Join(dir, "pushed.txt"), TransferOptions{})
+		if err == nil || !strings.Contains(err.Error(), "does not allow") {
+			t.Fatalf("SendFile error = %v, want a refusal", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "pushed.txt")); err == nil {
+			t.Fatalf("file was written although transfers are off")
+		}
+	})
+}
+
+func TestReceiveFileRejectsBadChecksum(t *testing.T) {
+	var stream bytes.Buffer
+	stream.WriteString("hello")
+	writeFrame(&stream, StreamReply{Sum: strings.Repeat("0", 64)})
+
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	err := receiveFile(&stream, path, 5, 0644, nil)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("receiveFile error = %v, want checksum mismatch", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("corrupt file was moved into place")
+	}
+}
@@ -0,0 +1,160 @@
+package jcat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixPrefix marks a listen or connect address as a Unix domain socket path,
+// as in "unix:/tmp/jmux.sock"; any other address is TCP "host:port"
+const UnixPrefix = "unix:"
+
+// DefaultSocketMode is the permission given to a socket file when none is
+// configured, allowing only its owner to connect
+const DefaultSocketMode os.FileMode = 0600
+
+// splitAddr returns the network and address to use for addr
+func splitAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// listen listens on addr. A Unix socket left behind by a server that died
+// is removed first, and the new socket file gets the given permissions.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+
+	// Create the socket without group or other access and widen it once it
+	// exists, so nobody can connect in between
+	oldMask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", address)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err := os.Chmod(address, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	// Closing the listener removes the socket file
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+	return &unixListener{Listener: ln}, nil
+}
+
+// removeStaleSocket deletes the socket at path unless a server still
+// answers on it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	// Nobody answers, so the server that made it is gone
+	return os.Remove(path)
+}
+
+// dial connects to addr, which may be a Unix socket
+func dial(addr string) (net.Conn, error) {
+	network, address := splitAddr(addr)
+	return net.DialTimeout(network, address, dialTimeout)
+}
+
+// unixListener reports the credentials of the connecting process as the
+// remote address, since Unix socket peers have no address of their own
+type unixListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection and labels it with its peer
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, user := peerCred(conn)
+	return &peerConn{Conn: conn, peer: peer, user: user}, nil
+}
+
+// peerConn is a Unix socket connection labelled with its peer
+type peerConn struct {
+	net.Conn
+	peer net.Addr
+	user string // account the peer process runs as, "" if unknown
+}
+
+// RemoteAddr returns the peer's credentials
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// peerCred describes the process on the other end of a Unix socket and
+// returns the account it runs as: its user name, or its uid if it has none
+func peerCred(conn net.Conn) (net.Addr, string) {
+	addr := &net.UnixAddr{Net: "unix", Name: "unix:unknown"}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return addr, ""
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return addr, ""
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return addr, ""
+	}
+
+	addr.Name = fmt.Sprintf("unix:uid=%d,pid=%d", cred.Uid, cred.Pid)
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	if account, err := user.LookupId(uid); err == nil {
+		return addr, account.Username
+	}
+	return addr, uid
+}
+
+// peerUser returns the account of the local process on the other end of
+// conn, which the kernel vouches for, or "" if conn is not a Unix socket
+func peerUser(conn net.Conn) string {
+	if peer, ok := conn.(*peerConn); ok {
+		return peer.user
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+package jcat
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocketTransport(t *testing.T) {
+	dir := t.TempDir()
+	rcfile := filepath.Join(dir, "rc.sh")
+	script := "stty -echo\necho \"ready:$JMUX_SESSION_NAME\"\nexec cat\n"
+	if err := os.WriteFile(rcfile, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write rcfile: %v", err)
+	}
+
+	path := filepath.Join(dir, "jcat.sock")
+	ln, err := listen(UnixPrefix+path, 0600)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket not created: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket permissions = %o, want 600", perm)
+	}
+
+	server := NewServerWithOptions(UnixPrefix+path, rcfile, ServerOptions{SessionName: "demo"})
+	go server.serve(ln, server.handle)
+
+	client := NewClient(UnixPrefix + path)
+	conn, err := client.dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	output := &syncBuffer{}
+	sizes := make(chan WinSize, 1)
+	sizes <- WinSize{Rows: 24, Cols: 80}
+
+	go client.stream(conn, readInput(stdinReader), output, sizes, &resumeState{})
+	output.waitFor(t, "ready:demo")
+
+	stdinWriter.Write([]byte("over the socket\n"))
+	output.waitFor(t, "over the socket")
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind after close: %v", err)
+	}
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+
+	// Leave a socket file behind the way a killed server would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(UnixPrefix+path, 0)
+	if err != nil {
+		t.Fatalf("listen over a stale socket failed: %v", err)
+	}
+	defer ln.Close()
+
+	// A live socket must not be taken over
+	if _, err := listen(UnixPrefix+path, 0); err == nil {
+		t.Fatalf("listen should refuse a socket that is in use")
+	}
+}
+
+func TestUnixSocketGuestsAreTheirAccount(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	serve := func(opts ServerOptions) string {
+		path := filepath.Join(t.TempDir(), "jcat.sock")
+		ln, err := listen(UnixPrefix+path, 0)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		server := NewServerWithOptions(UnixPrefix+path, "/bin/true", opts)
+		go server.serve(ln, server.handle)
+		return UnixPrefix + path
+	}
+
+	// Claiming to be an invited user does not get anyone in
+	private := serve(ServerOptions{AllowedUsers: []string{"carol"}})
+	_, err = NewClientWithOptions(private, ClientOptions{User: "carol", NoReconnect: true}).dial()
+	if err == nil || !strings.Contains(err.Error(), me.Username+" is not invited") {
+		t.Errorf("dial claiming to be carol = %v, want %s refused", err, me.Username)
+	}
+
+	// and the audit log names the account, not the claim
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	addr := serve(ServerOptions{AllowedUsers: []string{me.Username}, AuditPath: auditPath})
+	conn, err := NewClientWithOptions(addr, ClientOptions{User: "carol", NoReconnect: true}).dial()
+	if err != nil {
+		t.Fatalf("dial as %s failed: %v", me.Username, err)
+	}
+	conn.Close()
+	if records := waitForRecords(t, auditPath, 1); records[0].User != me.Username {
+		t.Errorf("audit record = %+v, want %s", records[0], me.Username)
+	}
+}
+
+// dialAs connects to addr as the account uid, switching only the calling
+// thread's identity for the connect, which is when the socket takes its
+// peer credentials
+func dialAs(uid int, addr string) (net.Conn, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	keep := ^uintptr(0)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, keep, uintptr(uid), keep); errno != 0 {
+		return nil, errno
+	}
+	conn, err := dial(addr)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, keep, 0, keep); errno != 0 {
+		panic("cannot switch back to root: " + errno.Error())
+	}
+	return conn, err
+}
+
+func TestUnixSocketAdmitsOtherAccounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to connect as another account")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody account: %v", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+
+	// Others can reach a socket in the directory but not list it
+	dir, err := os.MkdirTemp("", "jcat-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0711); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(name string, mode os.FileMode, opts ServerOptions) string {
+		addr := UnixPrefix + filepath.Join(dir, name)
+		ln, err := listen(addr, mode)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		server := NewServerWithOptions(addr, "/bin/true", opts)
+		go server.serve(ln, server.handle)
+		return addr
+	}
+	join := func(addr string) (net.Conn, error) {
+		client := NewClientWithOptions(addr, ClientOptions{User: "carol", NoReconnect: true})
+		client.transport = func() (net.Conn, error) { return dialAs(uid, addr) }
+		return client.dial()
+	}
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	open := serve("open.sock", 0666, ServerOptions{AllowedUsers: []string{nobody.Username}, AuditPath: auditPath})
+	conn, err := join(open)
+	if err != nil {
+		t.Fatalf("joining as %s failed: %v", nobody.Username, err)
+	}
+	conn.Close()
+	if records := waitForRecords(t, auditPath, 1); records[0].User != nobody.Username {
+		t.Errorf("audit record = %+v, want %s", records[0], nobody.Username)
+	}
+
+	// The share decides who else may join, and who may reach its socket
+	private := serve("private.sock", 0666, ServerOptions{AllowedUsers: []string{"carol"}})
+	if _, err := join(private); err == nil || !strings.Contains(err.Error(), nobody.Username+" is not invited") {
+		t.Errorf("joining a share %s is not invited to = %v, want a refusal", nobody.Username, err)
+	}
+	ownerOnly := serve("owner.sock", 0600, ServerOptions{})
+	if _, err := join(ownerOnly); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("joining through an owner-only socket = %v, want permission denied", err)
+	}
+}
@@ -0,0 +1,142 @@
+package messaging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// inviteBoxMode lets anyone drop an invitation into a user's box, but only
+// its owner list the box, so no one else can find the tokens in it
+const inviteBoxMode = os.ModeSticky | 0733
+
+// inviteBox returns the box the invitations sent to user are delivered to
+func (m *Messaging) inviteBox(user string) string {
+	return filepath.Join(m.config.InviteBoxesDir, user)
+}
+
+// EnsureInviteBox creates the current user's invitation box, or checks the
+// one they have, so that hosts can send them invitation tokens
+func (m *Messaging) EnsureInviteBox() error {
+	currentUser := os.Getenv("USER")
+	if currentUser == "" {
+		return fmt.Errorf("unable to determine current user")
+	}
+	// Everyone keeps a box here, and no one may remove another's
+	if err := os.Mkdir(m.config.InviteBoxesDir, 0755); err == nil {
+		os.Chmod(m.config.InviteBoxesDir, os.ModeSticky|0777)
+	} else if !os.IsExist(err) {
+		return err
+	}
+
+	box := m.inviteBox(currentUser)
+	if err := os.Mkdir(box, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(box)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || !ownedBy(info, currentUser) {
+		return fmt.Errorf("%s is not yours; remove it so invitations can reach you", box)
+	}
+	return os.Chmod(box, inviteBoxMode)
+}
+
+// dropInvite writes msg, which carries an invitation token, into toUser's
+// invitation box under a random name
+func (m *Messaging) dropInvite(toUser string, msg Message) error {
+	box := m.inviteBox(toUser)
+	info, err := os.Lstat(box)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s has no invitation box yet; they need to run dmux once", toUser)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || !ownedBy(info, toUser) || info.Mode().Perm()&0044 != 0 {
+		return fmt.Errorf("%s is not a private invitation box of %s", box, toUser)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(box, hex.EncodeToString(name)+".invite"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// Readable by toUser, who alone can find it
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// FindInvite returns the token of the latest unexpired invitation fromUser
+// sent to sessionName, or "" if there is none. Only invitations fromUser
+// wrote count; expired ones are cleared from the box.
+func (m *Messaging) FindInvite(fromUser, sessionName string) string {
+	box := m.inviteBox(os.Getenv("USER"))
+	entries, err := os.ReadDir(box)
+	if err != nil {
+		return ""
+	}
+
+	now := time.Now().Unix()
+	token := ""
+	var latest int64
+	for _, entry := range entries {
+		path := filepath.Join(box, entry.Name())
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Expires <= now {
+			os.Remove(path)
+			continue
+		}
+		if msg.Type != MessageTypeInvite || msg.Token == "" || msg.From != fromUser || msg.Data != sessionName || !ownedBy(info, fromUser) {
+			continue
+		}
+		if msg.Timestamp >= latest {
+			token, latest = msg.Token, msg.Timestamp
+		}
+	}
+	return token
+}
+
+// ownedBy reports whether the file info describes belongs to the account
+// named name
+func ownedBy(info os.FileInfo, name string) bool {
+	account, err := user.Lookup(name)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && strconv.FormatUint(uint64(stat.Uid), 10) == account.Uid
+}
@@ -33,6 +33,8 @@ type Message struct {
 	Timestamp int64
 	Data      string
 	Priority  string
+	Token     string // invitation token, only ever in the invitation box
+	Expires   int64  // when Token expires
 }
 
 // Messaging handles the messaging system
@@ -386,7 +388,6 @@ func (m *Messaging) displayRealtimeMessage(msg *Message) {
 // SendMessage sends a message to a user by appending to their message file
 func (m *Messaging) SendMessage(toUser string, msgType MessageType, data string) error {
 	timestamp := time.Now().Unix()
-	userMessageFile := filepath.Join(m.config.MessagesDir, toUser+".messages")
 
 	currentUser := os.Getenv("USER")
 	if currentUser == "" {
@@ -397,6 +398,36 @@ func (m *Messaging) SendMessage(toUser string, msgType MessageType, data string)
 	messageLine := fmt.Sprintf("{\"from\":\"%s\",\"type\":\"%s\",\"timestamp\":%d,\"data\":\"%s\",\"priority\":\"normal\"}\n", 
 		currentUser, msgType, timestamp, strings.ReplaceAll(data, "\"", "\\\""))
 
+	return m.deliver(toUser, messageLine, data)
+}
+
+// SendInvite invites a user to a session, putting the invitation's token
+// in their invitation box and telling them in their message file
+func (m *Messaging) SendInvite(toUser, sessionName, token string, expires time.Time) error {
+	currentUser := os.Getenv("USER")
+	if currentUser == "" {
+		currentUser = "unknown"
+	}
+
+	err := m.dropInvite(toUser, Message{
+		From:      currentUser,
+		Type:      MessageTypeInvite,
+		Timestamp: time.Now().Unix(),
+		Data:      sessionName,
+		Token:     token,
+		Expires:   expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.SendMessage(toUser, MessageTypeInvite, sessionName)
+}
+
+// deliver appends messageLine, a message carrying data, to a user's
+// message file
+func (m *Messaging) deliver(toUser, messageLine, data string) error {
+	userMessageFile := filepath.Join(m.config.MessagesDir, toUser+".messages")
+
 	// Ensure message file exists with proper permissions before writing
 	if _, err := os.Stat(userMessageFile); os.IsNotExist(err) {
 		// Create file with 666 permissions for shared access
@@ -0,0 +1,108 @@
+package recording
+
+import (
+	"io"
+	"time"
+)
+
+// PlayOptions controls how a recording is replayed
+type PlayOptions struct {
+	// Speed multiplies playback speed; values <= 0 mean normal speed
+	Speed float64
+	// IdleTimeLimit caps the pause between two events; zero uses the limit
+	// stored in the recording, if any
+	IdleTimeLimit time.Duration
+}
+
+// Command is a playback control sent while a recording is replayed
+type Command int
+
+const (
+	// TogglePause pauses or resumes playback
+	TogglePause Command = iota
+	// Quit stops playback
+	Quit
+)
+
+// Play writes the recording's output events to out with their original
+// timing, adjusted by opts and interrupted by commands. Resize events keep
+// their place in the timing but are not applied: the recording plays in
+// whatever size the viewer's terminal has.
+func (c *Cast) Play(out io.Writer, opts PlayOptions, commands <-chan Command) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	idleLimit := opts.IdleTimeLimit
+	if idleLimit == 0 && c.Header.IdleTimeLimit > 0 {
+		idleLimit = time.Duration(c.Header.IdleTimeLimit * float64(time.Second))
+	}
+
+	previous := 0.0
+	for _, event := range c.Events {
+		delay := time.Duration((event.Time - previous) * float64(time.Second))
+		previous = event.Time
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		delay = time.Duration(float64(delay) / speed)
+
+		if quit := wait(delay, commands); quit {
+			return nil
+		}
+
+		if event.Type != "o" {
+			continue
+		}
+		if _, err := io.WriteString(out, event.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait sleeps for delay, stretching it while playback is paused. It reports
+// whether playback should stop.
+func wait(delay time.Duration, commands <-chan Command) bool {
+	deadline := time.Now().Add(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return false
+		case cmd, ok := <-commands:
+			if !ok {
+				// No more commands can arrive; just finish the delay
+				commands = nil
+				continue
+			}
+			switch cmd {
+			case Quit:
+				return true
+			case TogglePause:
+				timer.Stop()
+				remaining := time.Until(deadline)
+				if quit := waitForResume(commands); quit {
+					return true
+				}
+				deadline = time.Now().Add(remaining)
+				timer.Reset(remaining)
+			}
+		}
+	}
+}
+
+// waitForResume blocks until playback is resumed or stopped
+func waitForResume(commands <-chan Command) bool {
+	for cmd := range commands {
+		switch cmd {
+		case Quit:
+			return true
+		case TogglePause:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package recording
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that playback can write while a test reads
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testCast has output a second apart, with a resize in between
+func testCast() *Cast {
+	return &Cast{
+		Header: Header{Version: 2, Width: 80, Height: 24},
+		Events: []Event{
+			{Time: 0, Type: "o", Data: "one "},
+			{Time: 0.5, Type: "r", Data: "100x30"},
+			{Time: 1, Type: "o", Data: "two"},
+		},
+	}
+}
+
+// play runs Play in the background and returns its output and a channel
+// that delivers its result
+func play(cast *Cast, opts PlayOptions, commands <-chan Command) (*lockedBuffer, <-chan error) {
+	out := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() { done <- cast.Play(out, opts, commands) }()
+	return out, done
+}
+
+// waitFor waits until playback has written want
+func (b *lockedBuffer) waitFor(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for b.String() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, got %q", want, b.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPlaySpeed(t *testing.T) {
+	start := time.Now()
+	out, done := play(testCast(), PlayOptions{Speed: 10}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("a 1s recording at 10x took %v", elapsed)
+	}
+	if out.String() != "one two" {
+		t.Errorf("output = %q, want only the output events", out.String())
+	}
+}
+
+func TestPlayIdleLimit(t *testing.T) {
+	cast := testCast()
+	cast.Events[2].Time = 3600
+
+	start := time.Now()
+	if _, done := play(cast, PlayOptions{IdleTimeLimit: 50 * time.Millisecond}, nil); <-done != nil {
+		t.Fatal("playback failed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("an hour-long pause capped at 50ms took %v", elapsed)
+	}
+
+	// Without an option, the recording's own limit applies
+	cast.Header.IdleTimeLimit = 0.05
+	start = time.Now()
+	if _, done := play(cast, PlayOptions{}, nil); <-done != nil {
+		t.Fatal("playback failed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the recording's idle limit was ignored: playback took %v", elapsed)
+	}
+}
+
+func TestPlayPause(t *testing.T) {
+	commands := make(chan Command)
+	out, done := play(testCast(), PlayOptions{}, commands)
+
+	out.waitFor(t, "one ")
+	commands <- TogglePause
+	time.Sleep(1500 * time.Millisecond)
+	if out.String() != "one " {
+		t.Errorf("output while paused = %q, want only the first event", out.String())
+	}
+	select {
+	case <-done:
+		t.Fatal("playback finished while paused")
+	default:
+	}
+
+	commands <- TogglePause
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("playback did not resume")
+	}
+	if out.String() != "one two" {
+		t.Errorf("output = %q, want the whole recording", out.String())
+	}
+}
+
+func TestPlayQuit(t *testing.T) {
+	cast := testCast()
+	cast.Events[2].Time = 3600
+
+	for _, paused := range []bool{false, true} {
+		commands := make(chan Command)
+		out, done := play(cast, PlayOptions{}, commands)
+		out.waitFor(t, "one ")
+		if paused {
+			commands <- TogglePause
+		}
+		commands <- Quit
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("quit (paused: %v) did not stop playback", paused)
+		}
+		if out.String() != "one " {
+			t.Errorf("output after quit = %q, want only the first event", out.String())
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Default terminal size written to the header when output arrives before
+// the first window size report
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Header is the first line of an asciicast v2 file
+type Header struct {
+	Version       int               `json:"version"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Timestamp     int64             `json:"timestamp,omitempty"`
+	IdleTimeLimit float64           `json:"idle_time_limit,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+// Event is a single timed entry of an asciicast v2 file
+type Event struct {
+	Time float64 // seconds since the start of the recording
+	Type string  // "o" for output, "r" for resize
+	Data string
+}
+
+// Recorder writes a PTY output stream to an asciicast v2 file
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	start   time.Time
+	started bool
+	pending []byte // incomplete UTF-8 sequence held back from the last write
+	failed  bool
+	logger  *log.Logger // where a broken recording is reported
+}
+
+// NewRecorder creates the recording file at path. The header is written
+// lazily so it can carry the first reported window size. Errors go to
+// logger, or the standard logger if it is nil.
+func NewRecorder(path string, logger *log.Logger) (*Recorder, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		start:  time.Now(),
+		logger: logger,
+	}, nil
+}
+
+// Write records p as an output event. It never fails so it can sit in an
+// io.TeeReader without disturbing the session; a broken recording is logged
+// and abandoned instead.
+func (r *Recorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return len(p), nil
+	}
+	r.writeHeader(defaultHeight, defaultWidth)
+
+	data := append(r.pending, p...)
+	cut := completeUTF8(data)
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.writeEvent("o", string(data[:cut]))
+	}
+	return len(p), nil
+}
+
+// Resize records a window size change
+func (r *Recorder) Resize(rows, cols int) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	if !r.started {
+		r.writeHeader(rows, cols)
+		return
+	}
+	r.writeEvent("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes the recording and closes the file
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 && !r.failed {
+		r.writeEvent("o", string(r.pending))
+		r.pending = nil
+	}
+	r.writer.Flush()
+	return r.file.Close()
+}
+
+// writeHeader writes the asciicast header once
+func (r *Recorder) writeHeader(rows, cols int) {
+	if r.started {
+		return
+	}
+	r.started = true
+
+	header := Header{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.writeLine(line)
+}
+
+// writeEvent appends one [time, type, data] event line
+func (r *Recorder) writeEvent(eventType, data string) {
+	elapsed := time.Since(r.start).Seconds()
+	elapsed = math.Round(elapsed*1e6) / 1e6
+
+	line, err := json.Marshal([]interface{}{elapsed, eventType, data})
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.writeLine(line)
+}
+
+// writeLine writes a line and flushes so the recording survives a crash
+func (r *Recorder) writeLine(line []byte) {
+	if _, err := r.writer.Write(append(line, '\n')); err != nil {
+		r.fail(err)
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		r.fail(err)
+	}
+}
+
+// fail stops recording after a write error
+func (r *Recorder) fail(err error) {
+	r.logger.Printf("recording stopped: %v", err)
+	r.failed = true
+}
+
+// completeUTF8 returns the length of the prefix of p that does not end in
+// the middle of a UTF-8 sequence
+func completeUTF8(p []byte) int {
+	// A rune is at most 4 bytes, so only the tail can be incomplete
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+		if utf8.FullRune(p[i:]) {
+			return len(p)
+		}
+		return i
+	}
+	return len(p)
+}
+
+// Cast is a parsed asciicast v2 recording
+type Cast struct {
+	Header Header
+	Events []Event
+}
+
+// Load reads an asciicast v2 file
+func Load(path string) (*Cast, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty recording")
+	}
+
+	cast := &Cast{}
+	if err := json.Unmarshal(scanner.Bytes(), &cast.Header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if cast.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", cast.Header.Version)
+	}
+
+	lineNo := 1
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var raw []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			return nil, fmt.Errorf("invalid event on line %d", lineNo)
+		}
+		t, okTime := raw[0].(float64)
+		eventType, okType := raw[1].(string)
+		data, okData := raw[2].(string)
+		if !okTime || !okType || !okData {
+			return nil, fmt.Errorf("invalid event on line %d", lineNo)
+		}
+		cast.Events = append(cast.Events, Event{Time: t, Type: eventType, Data: data})
+	}
+
+	return cast, scanner.Err()
+}
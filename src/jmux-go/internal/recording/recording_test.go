@@ -0,0 +1,206 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readLines returns the lines of the recording at path
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRecorderWritesAsciicast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	r, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Resize(30, 100)
+	r.Write([]byte("hello\r\n"))
+	r.Resize(40, 120)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLines(t, path)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 events: %q", len(lines), lines)
+	}
+
+	var header Header
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("invalid header %q: %v", lines[0], err)
+	}
+	if header.Version != 2 || header.Width != 100 || header.Height != 30 || header.Timestamp == 0 {
+		t.Errorf("header = %+v, want version 2 at 100x30 with a timestamp", header)
+	}
+
+	want := [][2]string{{"o", "hello\r\n"}, {"r", "120x40"}}
+	for i, line := range lines[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		if _, ok := event[0].(float64); !ok {
+			t.Errorf("event %q has no time", line)
+		}
+		if event[1] != want[i][0] || event[2] != want[i][1] {
+			t.Errorf("event %d = %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestRecorderDefaultsHeaderSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	r, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("early"))
+	r.Close()
+
+	var header Header
+	json.Unmarshal([]byte(readLines(t, path)[0]), &header)
+	if header.Width != defaultWidth || header.Height != defaultHeight {
+		t.Errorf("header size = %dx%d, want %dx%d", header.Width, header.Height, defaultWidth, defaultHeight)
+	}
+}
+
+func TestCompleteUTF8(t *testing.T) {
+	euro := []byte("€") // 3 bytes
+	tests := []struct {
+		name string
+		in   []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"ascii", []byte("abc"), 3},
+		{"whole rune", append([]byte("a"), euro...), 4},
+		{"one byte of three", append([]byte("a"), euro[:1]...), 1},
+		{"two bytes of three", append([]byte("a"), euro[:2]...), 1},
+		{"invalid byte", []byte{'a', 0xff}, 2},
+	}
+	for _, tt := range tests {
+		if got := completeUTF8(tt.in); got != tt.want {
+			t.Errorf("%s: completeUTF8(%q) = %d, want %d", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRecorderHoldsBackSplitRunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	r, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	euro := []byte("€")
+	r.Write(append([]byte("a"), euro[:1]...))
+	r.Write(euro[1:])
+	r.Write([]byte{0xe2}) // flushed as is on close
+	r.Close()
+
+	cast, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, event := range cast.Events {
+		got = append(got, event.Data)
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "€" {
+		t.Errorf("events = %q, want \"a\", \"€\" and the dangling byte", got)
+	}
+}
+
+func TestRecorderLogsFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	var logs bytes.Buffer
+	r, err := NewRecorder(path, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.file.Close()
+
+	if n, err := r.Write([]byte("lost")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v; a broken recording must not fail the session", n, err)
+	}
+	if !strings.Contains(logs.String(), "recording stopped") {
+		t.Errorf("the failure was not logged to the recorder's logger: %q", logs.String())
+	}
+}
+
+func TestLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	r, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Resize(24, 80)
+	r.Write([]byte("one"))
+	r.Resize(50, 132)
+	r.Write([]byte("two \"quoted\" \x1b[0m"))
+	r.Close()
+
+	cast, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cast.Header.Width != 80 || cast.Header.Height != 24 {
+		t.Errorf("header size = %dx%d, want 80x24", cast.Header.Width, cast.Header.Height)
+	}
+	want := []Event{{Type: "o", Data: "one"}, {Type: "r", Data: "132x50"}, {Type: "o", Data: "two \"quoted\" \x1b[0m"}}
+	if len(cast.Events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(cast.Events), len(want))
+	}
+	previous := 0.0
+	for i, event := range cast.Events {
+		if event.Type != want[i].Type || event.Data != want[i].Data {
+			t.Errorf("event %d = %+v, want %+v", i, event, want[i])
+		}
+		if event.Time < previous {
+			t.Errorf("event %d goes back in time", i)
+		}
+		previous = event.Time
+	}
+}
+
+func TestLoadRejectsMalformedRecordings(t *testing.T) {
+	header := `{"version": 2, "width": 80, "height": 24}`
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"empty", "", "empty recording"},
+		{"bad header", "not json\n", "invalid header"},
+		{"old version", `{"version": 1}` + "\n", "unsupported asciicast version 1"},
+		{"bad event", header + "\n[0.1, \"o\"\n", "invalid event on line 2"},
+		{"short event", header + "\n[0.1, \"o\"]\n", "invalid event on line 2"},
+		{"wrong types", header + "\n[0.1, \"o\", \"ok\"]\n[\"0.2\", \"o\", \"x\"]\n", "invalid event on line 3"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "bad.cast")
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.cast")); !os.IsNotExist(err) {
+		t.Errorf("Load of a missing file = %v, want not exist", err)
+	}
+}
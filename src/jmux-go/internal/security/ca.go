@@ -0,0 +1,456 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Validity of what a team CA signs
+const (
+	CAValidity   = 10 * 365 * 24 * time.Hour
+	CertValidity = 365 * 24 * time.Hour
+	CRLValidity  = 365 * 24 * time.Hour
+)
+
+// clockSkew backdates certificates so peers whose clocks run a little
+// behind accept them straight away
+const clockSkew = 5 * time.Minute
+
+// CA is a team certificate authority kept in a directory every member can
+// read, usually in the shared directory. Its key is readable only by the
+// member who created it, who issues and revokes everyone's certificates.
+// Members keep their own private keys and only publish signing requests.
+type CA struct {
+	Dir string
+	// LookupUser finds the account whose requests are signed under its
+	// name, user.Lookup if nil
+	LookupUser func(name string) (*user.User, error)
+}
+
+// NewCA returns the CA kept in dir
+func NewCA(dir string) *CA {
+	return &CA{Dir: dir}
+}
+
+// CertPath returns the CA's own certificate, which peers verify against
+func (ca *CA) CertPath() string { return filepath.Join(ca.Dir, "ca.crt") }
+
+// KeyPath returns the CA's private key
+func (ca *CA) KeyPath() string { return filepath.Join(ca.Dir, "ca.key") }
+
+// CRLPath returns the CA's list of revoked certificates
+func (ca *CA) CRLPath() string { return filepath.Join(ca.Dir, "ca.crl") }
+
+// UserCertPath returns where the certificate issued to user is published
+func (ca *CA) UserCertPath(user string) string {
+	return filepath.Join(ca.Dir, "certs", user+".crt")
+}
+
+// RequestPath returns where user's pending signing request is published
+func (ca *CA) RequestPath(user string) string {
+	return filepath.Join(ca.Dir, "requests", user+".csr")
+}
+
+// TLSConfig returns the TLS settings of user, whose private key is at
+// keyPath, for shares using this CA
+func (ca *CA) TLSConfig(user, keyPath string) *TLSConfig {
+	return &TLSConfig{
+		CACert: ca.CertPath(),
+		CRL:    ca.CRLPath(),
+		Cert:   ca.UserCertPath(user),
+		Key:    keyPath,
+	}
+}
+
+// Init creates the CA's key and self-signed certificate, named after
+// owner, and an empty revocation list. It refuses to replace a CA that
+// already exists, since every certificate it issued would stop working.
+func (ca *CA) Init(owner string) (*x509.Certificate, error) {
+	if _, err := os.Stat(ca.CertPath()); err == nil {
+		return nil, fmt.Errorf("a CA already exists in %s", ca.Dir)
+	}
+	for _, dir := range []string{ca.Dir, filepath.Dir(ca.UserCertPath("")), filepath.Dir(ca.RequestPath(""))} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	// Members drop their requests here, but only the owner may remove them,
+	// and Issue only signs a request its own member created
+	if err := os.Chmod(filepath.Dir(ca.RequestPath("")), os.ModeSticky|0777); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dmux team CA (" + owner + ")"},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(ca.KeyPath(), key); err != nil {
+		return nil, err
+	}
+	if err := writePEM(ca.CertPath(), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := ca.writeCRL(cert, key, nil); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Request publishes a signing request for user's key, for the CA's owner
+// to issue a certificate from
+func (ca *CA) Request(user string, key crypto.Signer) error {
+	if err := validIdentity(user); err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: user},
+	}, key)
+	if err != nil {
+		return err
+	}
+	path := ca.RequestPath(user)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// A stale request of ours may be in the way
+	os.Remove(path)
+	return writePEM(path, "CERTIFICATE REQUEST", der, 0644)
+}
+
+// HasRequest reports whether user has a signing request pending
+func (ca *CA) HasRequest(user string) bool {
+	_, err := os.Stat(ca.RequestPath(user))
+	return err == nil
+}
+
+// Issue signs user's pending request and publishes the certificate, which
+// serves both to join shares and to host them
+func (ca *CA) Issue(user string) (*x509.Certificate, error) {
+	if err := validIdentity(user); err != nil {
+		return nil, err
+	}
+	caCert, caKey, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ca.readRequest(user)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has not requested a certificate", user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request from %s: %v", user, err)
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid request from %s: %v", user, err)
+	}
+	if request.Subject.CommonName != user {
+		return nil, fmt.Errorf("the request in %s is for %q, not %s", ca.RequestPath(user), request.Subject.CommonName, user)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: user},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(CertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, request.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(ca.UserCertPath(user), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	os.Remove(ca.RequestPath(user))
+	return x509.ParseCertificate(der)
+}
+
+// readRequest reads user's pending request. Anyone may write into the
+// requests directory, so only a file user created is taken as theirs.
+func (ca *CA) readRequest(name string) (*pem.Block, error) {
+	path := ca.RequestPath(name)
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a signing request", path)
+	}
+
+	lookup := ca.LookupUser
+	if lookup == nil {
+		lookup = user.Lookup
+	}
+	account, err := lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot tell whether %s made %s: %v", name, path, err)
+	}
+	if strconv.FormatUint(uint64(stat.Uid), 10) != account.Uid {
+		return nil, fmt.Errorf("the request in %s was not made by %s", path, name)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodePEM(path, data, "CERTIFICATE REQUEST")
+}
+
+// Revoke adds the certificate issued to user to the revocation list and
+// withdraws it, so that user can neither join nor host shares until issued
+// a new one
+func (ca *CA) Revoke(user string) (*x509.Certificate, error) {
+	if err := validIdentity(user); err != nil {
+		return nil, err
+	}
+	caCert, caKey, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCert(ca.UserCertPath(user))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no certificate has been issued to %s", user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := loadCRL(ca.CRLPath(), caCert)
+	if err != nil {
+		return nil, err
+	}
+	var entries []x509.RevocationListEntry
+	if crl != nil {
+		entries = crl.RevokedCertificateEntries
+	}
+	entries = append(entries, x509.RevocationListEntry{
+		SerialNumber:   cert.SerialNumber,
+		RevocationTime: time.Now(),
+	})
+	if err := ca.writeCRL(caCert, caKey, entries); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(ca.UserCertPath(user)); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// signer loads the CA's certificate and key
+func (ca *CA) signer() (*x509.Certificate, crypto.Signer, error) {
+	cert, err := loadCert(ca.CertPath())
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("no CA in %s", ca.Dir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := LoadKey(ca.KeyPath())
+	if os.IsPermission(err) {
+		return nil, nil, fmt.Errorf("only the CA's owner can issue and revoke certificates")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// writeCRL signs and publishes a revocation list with entries
+func (ca *CA) writeCRL(caCert *x509.Certificate, caKey crypto.Signer, entries []x509.RevocationListEntry) error {
+	number, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(CRLValidity),
+		RevokedCertificateEntries: entries,
+	}, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(ca.CRLPath(), "X509 CRL", der, 0644)
+}
+
+// LoadOrCreateKey loads the private key at path, creating one readable only
+// by its owner if there is none
+func LoadOrCreateKey(path string) (crypto.Signer, error) {
+	key, err := LoadKey(path)
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newKey, writeKey(path, newKey)
+}
+
+// LoadKey loads a PKCS #8 private key
+func LoadKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s cannot sign", path)
+	}
+	return signer, nil
+}
+
+// writeKey saves key readable only by its owner
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0600)
+}
+
+// loadCert loads a PEM certificate
+func loadCert(path string) (*x509.Certificate, error) {
+	block, err := readPEM(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadCRL loads the revocation list at path and checks that caCert signed
+// it. A missing list revokes nothing.
+func loadCRL(path string, caCert *x509.Certificate) (*x509.RevocationList, error) {
+	block, err := readPEM(path, "X509 CRL")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revocation list %s: %v", path, err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("revocation list %s is not signed by the CA: %v", path, err)
+	}
+	return crl, nil
+}
+
+// readPEM reads the first PEM block of kind from path
+func readPEM(path, kind string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodePEM(path, data, kind)
+}
+
+// decodePEM decodes the first PEM block of data, which must be of kind
+func decodePEM(path string, data []byte, kind string) (*pem.Block, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != kind {
+		return nil, fmt.Errorf("%s holds no %s", path, strings.ToLower(kind))
+	}
+	return block, nil
+}
+
+// writePEM writes der to path as a PEM block of kind, replacing the file
+// in one step so readers never see half of it
+func writePEM(path, kind string, der []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := pem.Encode(tmp, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newSerial returns a random 128-bit certificate serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// validIdentity checks that user can name a certificate and its files
+func validIdentity(user string) error {
+	if user == "" || strings.ContainsAny(user, "/\\:\x00") || strings.HasPrefix(user, ".") {
+		return fmt.Errorf("invalid user name %q", user)
+	}
+	return nil
+}
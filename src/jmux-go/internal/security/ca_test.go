@@ -0,0 +1,173 @@
+package security
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// currentAccount stands in for user.Lookup, so that requests the test
+// makes in any name count as that user's
+func currentAccount(string) (*user.User, error) { return user.Current() }
+
+// issueTestCert requests and issues a certificate for user from ca and
+// returns user's TLS settings
+func issueTestCert(t *testing.T, ca *CA, user string) *TLSConfig {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), user+".key")
+	key, err := LoadOrCreateKey(keyPath)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	if err := ca.Request(user, key); err != nil {
+		t.Fatalf("failed to request a certificate: %v", err)
+	}
+	// Test users have no accounts, so every request counts as ours
+	ca.LookupUser = currentAccount
+	if _, err := ca.Issue(user); err != nil {
+		t.Fatalf("failed to issue a certificate: %v", err)
+	}
+	return ca.TLSConfig(user, keyPath)
+}
+
+// tlsHandshake connects a client for host to a server over a pipe and
+// returns the identity the server saw and the client's error
+func tlsHandshake(t *testing.T, server, client *TLSConfig, host string) (string, error) {
+	t.Helper()
+	serverConfig, err := server.ServerConfig()
+	if err != nil {
+		t.Fatalf("ServerConfig: %v", err)
+	}
+	clientConfig, err := client.ClientConfig(host)
+	if err != nil {
+		t.Fatalf("ClientConfig: %v", err)
+	}
+	return pipeHandshake(serverConfig, clientConfig)
+}
+
+// pipeHandshake runs a TLS handshake over a pipe and returns the identity
+// the server saw and the client's error
+func pipeHandshake(serverConfig, clientConfig *tls.Config) (string, error) {
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	identity := make(chan string, 1)
+	go func() {
+		defer serverEnd.Close()
+		conn := tls.Server(serverEnd, serverConfig)
+		if err := conn.Handshake(); err != nil {
+			identity <- ""
+			return
+		}
+		identity <- PeerIdentity(conn.ConnectionState())
+	}()
+
+	conn := tls.Client(clientEnd, clientConfig)
+	err := conn.Handshake()
+	if err == nil {
+		// Under TLS 1.3 the server refuses a client certificate only after
+		// the client's side of the handshake is done
+		if _, err = conn.Read(make([]byte, 1)); err == io.EOF {
+			err = nil
+		}
+	}
+	return <-identity, err
+}
+
+func TestTeamCA(t *testing.T) {
+	ca := NewCA(filepath.Join(t.TempDir(), "ca"))
+	if _, err := ca.Init("alice"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if _, err := ca.Init("alice"); err == nil {
+		t.Error("Init replaced an existing CA")
+	}
+	if _, err := ca.Issue("carol"); err == nil {
+		t.Error("Issue succeeded without a request")
+	}
+
+	alice := issueTestCert(t, ca, "alice")
+	bob := issueTestCert(t, ca, "bob")
+
+	identity, err := tlsHandshake(t, alice, bob, "alice")
+	if err != nil || identity != "bob" {
+		t.Fatalf("handshake = %q, %v; want bob's identity", identity, err)
+	}
+
+	// Bob joining what he takes for carol's share notices it is alice's
+	if _, err := tlsHandshake(t, alice, bob, "carol"); err == nil || !strings.Contains(err.Error(), "alice's certificate") {
+		t.Errorf("handshake with the wrong host = %v, want a certificate mismatch", err)
+	}
+
+	// A certificate from another CA is refused
+	other := NewCA(filepath.Join(t.TempDir(), "other"))
+	if _, err := other.Init("mallory"); err != nil {
+		t.Fatal(err)
+	}
+	mallory := issueTestCert(t, other, "mallory")
+	mallory.CACert = alice.CACert
+	if identity, _ := tlsHandshake(t, alice, mallory, "alice"); identity != "" {
+		t.Errorf("server accepted a certificate from another CA as %q", identity)
+	}
+}
+
+func TestIssueRefusesRequestsOfOthers(t *testing.T) {
+	ca := NewCA(filepath.Join(t.TempDir(), "ca"))
+	if _, err := ca.Init("alice"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "bob.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Whoever runs the test drops a request in bob's name
+	if err := ca.Request("bob", key); err != nil {
+		t.Fatal(err)
+	}
+	ca.LookupUser = func(name string) (*user.User, error) {
+		return &user.User{Username: name, Uid: strconv.Itoa(os.Getuid() + 1)}, nil
+	}
+	if _, err := ca.Issue("bob"); err == nil || !strings.Contains(err.Error(), "not made by bob") {
+		t.Errorf("Issue of a request bob did not make = %v, want a refusal", err)
+	}
+	if _, err := os.Stat(ca.UserCertPath("bob")); err == nil {
+		t.Error("a certificate was published for bob")
+	}
+}
+
+func TestRevokedCertificateIsRefused(t *testing.T) {
+	ca := NewCA(filepath.Join(t.TempDir(), "ca"))
+	if _, err := ca.Init("alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice := issueTestCert(t, ca, "alice")
+	bob := issueTestCert(t, ca, "bob")
+	serverConfig, err := alice.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := bob.ClientConfig("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := pipeHandshake(serverConfig, clientConfig); identity != "bob" {
+		t.Fatalf("handshake before revoking = %q, %v; want bob's identity", identity, err)
+	}
+
+	if _, err := ca.Revoke("bob"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := bob.ClientConfig("alice"); err == nil {
+		t.Error("bob's certificate is still published after revoking it")
+	}
+	// Bob kept his loaded certificate, but the running server reads the
+	// revocation list on every handshake
+	if identity, err := pipeHandshake(serverConfig, clientConfig); identity != "" || err == nil {
+		t.Errorf("handshake after revoking = %q, %v; want bob refused", identity, err)
+	}
+}
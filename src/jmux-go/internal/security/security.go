@@ -2,10 +2,12 @@ package security
 
 import (
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"strings"
 
@@ -20,6 +22,8 @@ type SecurityConfig struct {
 	GlobalPassword   string                 `json:"global_password,omitempty"`
 	SessionPasswords map[string]string      `json:"session_passwords,omitempty"`
 	Argon2Params     *Argon2Config         `json:"argon2_params,omitempty"`
+	TLS              *TLSConfig             `json:"tls_config,omitempty"` // certificates for the tls method
+	SSHKey           *SSHKeyConfig          `json:"sshkey_config,omitempty"` // keys for the sshkey method
 }
 
 // Argon2Config holds Argon2 key derivation parameters
@@ -134,84 +138,163 @@ func (p *PasswordAuth) GetPasswordConfig() *SecurityConfig {
 	return p.config
 }
 
-// EncryptedConnection wraps a connection with ChaCha20-Poly1305 encryption
+// Sides of an encrypted connection. Each side sends under a key of its
+// own, so the two directions never use a nonce twice under one key.
+const (
+	SideClient = "client"
+	SideServer = "server"
+)
+
+// Rekey thresholds: a direction moves on to a fresh key after this many
+// frames or plaintext bytes under the last one, whichever comes first
+const (
+	RekeyFrames = 1 << 20
+	RekeyBytes  = 1 << 30
+)
+
+// HKDF labels for the direction keys and the keys that follow them
+const (
+	clientToServerLabel = "jmux-session-v2 client to server"
+	serverToClientLabel = "jmux-session-v2 server to client"
+	rekeyLabel          = "jmux-session-v2 rekey"
+)
+
+// EncryptedConnection wraps a connection with ChaCha20-Poly1305 encryption.
+// Nonces are frame counters both sides keep instead of sending them, so a
+// frame that is replayed, reordered or dropped fails to decrypt.
 type EncryptedConnection struct {
-	cipher       cipher.AEAD
-	nonceCounter uint64
+	send        direction
+	receive     direction
+	rekeyFrames uint64
+	rekeyBytes  uint64
 }
 
-// NewEncryptedConnection creates a new encrypted connection wrapper
-func NewEncryptedConnection(sessionKey [32]byte) (*EncryptedConnection, error) {
-	cipher, err := chacha20poly1305.New(sessionKey[:])
-	if err != nil {
+// direction is the key of one direction of a connection and how far it
+// has been used
+type direction struct {
+	key    [32]byte
+	cipher cipher.AEAD
+	frames uint64 // frames under key so far, the nonce of the next one
+	bytes  uint64 // plaintext bytes under key so far
+}
+
+// NewEncryptedConnection creates a new encrypted connection wrapper for
+// side, deriving the keys of both directions from the session key
+func NewEncryptedConnection(sessionKey [32]byte, side string) (*EncryptedConnection, error) {
+	sendLabel, receiveLabel := clientToServerLabel, serverToClientLabel
+	switch side {
+	case SideClient:
+	case SideServer:
+		sendLabel, receiveLabel = receiveLabel, sendLabel
+	default:
+		return nil, fmt.Errorf("unknown side %q", side)
+	}
+
+	ec := &EncryptedConnection{rekeyFrames: RekeyFrames, rekeyBytes: RekeyBytes}
+	if err := ec.send.init(sessionKey[:], sendLabel); err != nil {
 		return nil, err
 	}
-	
-	return &EncryptedConnection{
-		cipher:       cipher,
-		nonceCounter: 0,
-	}, nil
+	if err := ec.receive.init(sessionKey[:], receiveLabel); err != nil {
+		return nil, err
+	}
+	return ec, nil
 }
 
-// Encrypt encrypts data using ChaCha20-Poly1305
+// Encrypt encrypts data as the next frame we send
 func (ec *EncryptedConnection) Encrypt(data []byte) ([]byte, error) {
-	// Generate nonce from counter (96-bit nonce for ChaCha20-Poly1305)
-	nonce := make([]byte, 12)
-	// Use counter as nonce (in little-endian format)
-	for i := 0; i < 8 && i < len(nonce); i++ {
-		nonce[i] = byte(ec.nonceCounter >> (i * 8))
+	ciphertext := ec.send.cipher.Seal(nil, ec.send.nonce(), data, nil)
+	if err := ec.advance(&ec.send, len(data)); err != nil {
+		return nil, err
 	}
-	ec.nonceCounter++
-	
-	// Encrypt with AEAD
-	ciphertext := ec.cipher.Seal(nil, nonce, data, nil)
-	
-	// Prepend nonce to ciphertext for transmission
-	result := make([]byte, len(nonce)+len(ciphertext))
-	copy(result[:len(nonce)], nonce)
-	copy(result[len(nonce):], ciphertext)
-	
-	return result, nil
+	return ciphertext, nil
 }
 
-// Decrypt decrypts data using ChaCha20-Poly1305
+// Decrypt decrypts data as the next frame the peer sent, failing if it is
+// not exactly that frame
 func (ec *EncryptedConnection) Decrypt(data []byte) ([]byte, error) {
-	if len(data) < 12 {
+	if len(data) < ec.receive.cipher.Overhead() {
 		return nil, fmt.Errorf("encrypted data too short")
 	}
-	
-	// Extract nonce and ciphertext
-	nonce := data[:12]
-	ciphertext := data[12:]
-	
-	// Decrypt with AEAD
-	plaintext, err := ec.cipher.Open(nil, nonce, ciphertext, nil)
+
+	plaintext, err := ec.receive.cipher.Open(nil, ec.receive.nonce(), data, nil)
 	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %v", err)
+		return nil, fmt.Errorf("decryption failed: frame is forged, replayed or out of order")
+	}
+	if err := ec.advance(&ec.receive, len(plaintext)); err != nil {
+		return nil, err
 	}
-	
 	return plaintext, nil
 }
 
+// advance counts a frame of n plaintext bytes in d, moving d on to its
+// next key once it reaches a rekey threshold. Both sides count the same
+// frames, so they rekey at the same point without telling each other.
+func (ec *EncryptedConnection) advance(d *direction, n int) error {
+	d.frames++
+	d.bytes += uint64(n)
+	if d.frames < ec.rekeyFrames && d.bytes < ec.rekeyBytes {
+		return nil
+	}
+	return d.init(d.key[:], rekeyLabel)
+}
+
+// init keys d with the key derived from secret for label and starts its
+// count over
+func (d *direction) init(secret []byte, label string) error {
+	key, err := hkdf.Key(sha256.New, secret, nil, label, len(d.key))
+	if err != nil {
+		return err
+	}
+	copy(d.key[:], key)
+	d.cipher, err = chacha20poly1305.New(d.key[:])
+	if err != nil {
+		return err
+	}
+	d.frames, d.bytes = 0, 0
+	return nil
+}
+
+// nonce returns the nonce of the next frame: the frame count, little-endian
+func (d *direction) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce, d.frames)
+	return nonce
+}
+
 // Protocol constants for secure handshake
 const (
-	SecureHandshakeMsg = "JCAT/2.0.0+SEC\n"
+	SecureHandshakeMsg = "JCAT/3.1.0+SEC\n" // 3.1 keys each direction apart
 	AuthMethodPassword = "password"
+	AuthMethodTLS      = "tls"    // mutual TLS with certificates from the team CA
+	AuthMethodSSHKey   = "sshkey" // guests sign a challenge with an authorized SSH key
 )
 
+// FormatAuthMessage formats authentication message "AUTH:method:session\n",
+// naming the session the client authenticates for
+func FormatAuthMessage(method, sessionName string) string {
+	return fmt.Sprintf("AUTH:%s:%s\n", method, sessionName)
+}
+
 // ParseAuthMessage parses authentication message format "AUTH:method\n"
 func ParseAuthMessage(msg string) (string, error) {
+	method, _, err := ParseAuthRequest(msg)
+	return method, err
+}
+
+// ParseAuthRequest parses authentication message format
+// "AUTH:method:session\n". Clients older than session names send none.
+func ParseAuthRequest(msg string) (method, sessionName string, err error) {
 	msg = strings.TrimSpace(msg)
 	if !strings.HasPrefix(msg, "AUTH:") {
-		return "", fmt.Errorf("invalid auth message format")
+		return "", "", fmt.Errorf("invalid auth message format")
 	}
 	
-	method := strings.TrimPrefix(msg, "AUTH:")
+	method, sessionName, _ = strings.Cut(strings.TrimPrefix(msg, "AUTH:"), ":")
 	if method == "" {
-		return "", fmt.Errorf("empty auth method")
+		return "", "", fmt.Errorf("empty auth method")
 	}
 	
-	return method, nil
+	return method, sessionName, nil
 }
 
 // FormatChallengeMessage formats challenge message "CHALLENGE:base64-nonce\n"
@@ -84,8 +84,12 @@ func TestEncryptedConnection(t *testing.T) {
 		t.Fatalf("Failed to generate session key: %v", err)
 	}
 
-	// Create encrypted connection
-	encConn, err := NewEncryptedConnection(sessionKey)
+	// Create both ends of an encrypted connection
+	client, err := NewEncryptedConnection(sessionKey, SideClient)
+	if err != nil {
+		t.Fatalf("Failed to create encrypted connection: %v", err)
+	}
+	server, err := NewEncryptedConnection(sessionKey, SideServer)
 	if err != nil {
 		t.Fatalf("Failed to create encrypted connection: %v", err)
 	}
@@ -94,17 +98,27 @@ func TestEncryptedConnection(t *testing.T) {
 	testData := []byte("Hello, secure world!")
 
 	// Encrypt data
-	encrypted, err := encConn.Encrypt(testData)
+	encrypted, err := client.Encrypt(testData)
 	if err != nil {
 		t.Fatalf("Failed to encrypt data: %v", err)
 	}
 
 	if len(encrypted) <= len(testData) {
-		t.Errorf("Encrypted data should be longer than plaintext (includes nonce and auth tag)")
+		t.Errorf("Encrypted data should be longer than plaintext (includes auth tag)")
+	}
+
+	// Test with tampered data
+	tamperedData := make([]byte, len(encrypted))
+	copy(tamperedData, encrypted)
+	tamperedData[len(tamperedData)-1] ^= 0x01 // Flip a bit in the last byte
+
+	_, err = server.Decrypt(tamperedData)
+	if err == nil {
+		t.Errorf("Decryption should fail with tampered data")
 	}
 
 	// Decrypt data
-	decrypted, err := encConn.Decrypt(encrypted)
+	decrypted, err := server.Decrypt(encrypted)
 	if err != nil {
 		t.Fatalf("Failed to decrypt data: %v", err)
 	}
@@ -114,16 +128,68 @@ func TestEncryptedConnection(t *testing.T) {
 			string(testData), string(decrypted))
 	}
 
-	// Test with tampered data
-	tamperedData := make([]byte, len(encrypted))
-	copy(tamperedData, encrypted)
-	if len(tamperedData) > 0 {
-		tamperedData[len(tamperedData)-1] ^= 0x01 // Flip a bit in the last byte
+	// The same frame sent again is a replay
+	if _, err := server.Decrypt(encrypted); err == nil {
+		t.Errorf("Decryption should fail with a replayed frame")
 	}
 
-	_, err = encConn.Decrypt(tamperedData)
-	if err == nil {
-		t.Errorf("Decryption should fail with tampered data")
+	// Each direction has its own key: a frame cannot be reflected back to
+	// its sender, and the reply uses the first nonce again without harm
+	reply, err := server.Encrypt(testData)
+	if err != nil {
+		t.Fatalf("Failed to encrypt reply: %v", err)
+	}
+	if string(reply) == string(encrypted) {
+		t.Errorf("Both directions encrypted the same data identically")
+	}
+	if _, err := server.Decrypt(reply); err == nil {
+		t.Errorf("Decryption should fail with a reflected frame")
+	}
+	if _, err := client.Decrypt(reply); err != nil {
+		t.Errorf("Failed to decrypt reply: %v", err)
+	}
+
+	// Frames must arrive in the order they were sent
+	first, _ := client.Encrypt([]byte("first"))
+	second, _ := client.Encrypt([]byte("second"))
+	if _, err := server.Decrypt(second); err == nil {
+		t.Errorf("Decryption should fail with a frame out of order")
+	}
+	for _, frame := range [][]byte{first, second} {
+		if _, err := server.Decrypt(frame); err != nil {
+			t.Errorf("Failed to decrypt frame in order: %v", err)
+		}
+	}
+}
+
+func TestEncryptedConnectionRekeys(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	client, _ := NewEncryptedConnection(sessionKey, SideClient)
+	server, _ := NewEncryptedConnection(sessionKey, SideServer)
+	client.rekeyFrames, server.rekeyFrames = 3, 3
+	client.rekeyBytes, server.rekeyBytes = 100, 100
+
+	firstKey := client.send.key
+	var frames [][]byte
+	for i, size := range []int{1, 1, 1, 60, 60, 1} {
+		frame, err := client.Encrypt(make([]byte, size))
+		if err != nil {
+			t.Fatalf("Encrypt #%d failed: %v", i+1, err)
+		}
+		if _, err := server.Decrypt(frame); err != nil {
+			t.Fatalf("Decrypt #%d failed: %v", i+1, err)
+		}
+		frames = append(frames, frame)
+	}
+	// Three frames, then 120 bytes, have each moved on to a new key
+	if client.send.key == firstKey || client.send.frames != 1 || server.receive.key != client.send.key {
+		t.Errorf("send key = %x after %d frames, want the third, which the server shares", client.send.key, client.send.frames)
+	}
+	// Frames from before a rekey cannot be replayed under a later key,
+	// though the nonce counter has come round to theirs again
+	if _, err := server.Decrypt(frames[0]); err == nil {
+		t.Errorf("Decryption should fail with a frame replayed from an earlier key")
 	}
 }
 
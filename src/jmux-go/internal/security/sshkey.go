@@ -0,0 +1,259 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshKeyNamespace keeps signatures made for jmux from passing for SSH
+// logins or anything else signed with the same key
+const sshKeyNamespace = "jmux-sshkey-auth-v1"
+
+// SSHKeyConfig locates the keys used by the sshkey method, under which
+// guests sign a challenge with an SSH key the host has authorized
+type SSHKeyConfig struct {
+	AuthorizedKeys string   `json:"authorized_keys"`        // keys the host lets in
+	IdentityFiles  []string `json:"identity_files"`         // this user's private keys, tried after the agent
+	AgentSocket    string   `json:"agent_socket,omitempty"` // ssh-agent to sign with, if any
+}
+
+// NewSSHKeyConfig returns the settings of a user whose SSH files are in
+// sshDir and whose ssh-agent listens on agentSocket
+func NewSSHKeyConfig(sshDir, agentSocket string) *SSHKeyConfig {
+	return &SSHKeyConfig{
+		AuthorizedKeys: filepath.Join(sshDir, "authorized_keys"),
+		IdentityFiles: []string{
+			filepath.Join(sshDir, "id_ed25519"),
+			filepath.Join(sshDir, "id_ecdsa"),
+			filepath.Join(sshDir, "id_rsa"),
+		},
+		AgentSocket: agentSocket,
+	}
+}
+
+// SSHKeyAuth implements SSH public key authentication
+type SSHKeyAuth struct {
+	config *SSHKeyConfig
+}
+
+// NewSSHKeyAuth creates a new SSH key authenticator
+func NewSSHKeyAuth(config *SSHKeyConfig) *SSHKeyAuth {
+	if config == nil {
+		config = &SSHKeyConfig{}
+	}
+	return &SSHKeyAuth{config: config}
+}
+
+// authorizedKey is a key from authorized_keys and who it belongs to
+type authorizedKey struct {
+	key      ssh.PublicKey
+	identity string
+}
+
+// authorizedKeys reads the keys the host lets in. Keys restricted to a
+// forced command and certificate authorities are left out, since a guest
+// gets a full shell.
+func (a *SSHKeyAuth) authorizedKeys() ([]authorizedKey, error) {
+	data, err := os.ReadFile(a.config.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []authorizedKey
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		if restricted(options) {
+			continue
+		}
+		keys = append(keys, authorizedKey{key: key, identity: keyIdentity(key, comment)})
+	}
+	return keys, nil
+}
+
+// restricted reports whether authorized_keys options keep a key from
+// getting a shell
+func restricted(options []string) bool {
+	for _, option := range options {
+		option = strings.ToLower(option)
+		if option == "cert-authority" || option == "restrict" || strings.HasPrefix(option, "command=") {
+			return true
+		}
+	}
+	return false
+}
+
+// keyIdentity names the owner of an authorized key: the user part of its
+// comment, which ssh-keygen sets to user@host, or its fingerprint if it
+// has no comment
+func keyIdentity(key ssh.PublicKey, comment string) string {
+	user, _, _ := strings.Cut(strings.TrimSpace(comment), "@")
+	if fields := strings.Fields(user); len(fields) > 0 {
+		return fields[0]
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// CheckAuthorizedKeys fails unless the host has authorized some key
+// guests can use
+func (a *SSHKeyAuth) CheckAuthorizedKeys() error {
+	keys, err := a.authorizedKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s has no keys guests can use", a.config.AuthorizedKeys)
+	}
+	return nil
+}
+
+// Authorize returns who key belongs to if the host has authorized it. The
+// file is read afresh every time so removing a key applies to running
+// servers.
+func (a *SSHKeyAuth) Authorize(key ssh.PublicKey) (string, error) {
+	keys, err := a.authorizedKeys()
+	if err != nil {
+		return "", err
+	}
+	wire := key.Marshal()
+	for _, authorized := range keys {
+		if bytes.Equal(authorized.key.Marshal(), wire) {
+			return authorized.identity, nil
+		}
+	}
+	return "", fmt.Errorf("%s key %s is not authorized", key.Type(), ssh.FingerprintSHA256(key))
+}
+
+// Signers returns the keys this user can sign with: those in the ssh-agent
+// first, then unencrypted identity files. Call done once finished signing.
+func (a *SSHKeyAuth) Signers() (signers []ssh.Signer, done func(), err error) {
+	done = func() {}
+	if a.config.AgentSocket != "" {
+		if conn, err := net.Dial("unix", a.config.AgentSocket); err == nil {
+			done = func() { conn.Close() }
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	for _, path := range a.config.IdentityFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			// Encrypted keys can only be used through the agent
+			continue
+		}
+		if err != nil {
+			done()
+			return nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		done()
+		return nil, nil, fmt.Errorf("no SSH keys to sign with: add one to ssh-agent or create one with ssh-keygen")
+	}
+	return signers, done, nil
+}
+
+// SSHKeyProof returns what a guest signs to prove it holds key: the
+// server's challenge and both sides' ephemeral keys, so the signature
+// cannot be replayed to another server or connection
+func SSHKeyProof(nonce, serverKey, clientKey []byte, key ssh.PublicKey) []byte {
+	return ssh.Marshal(struct {
+		Namespace string
+		Nonce     []byte
+		ServerKey []byte
+		ClientKey []byte
+		PublicKey []byte
+	}{sshKeyNamespace, nonce, serverKey, clientKey, key.Marshal()})
+}
+
+// SignProof signs proof with signer, using SHA-512 for RSA keys
+func SignProof(signer ssh.Signer, proof []byte) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, proof, ssh.KeyAlgoRSASHA512)
+	}
+	return signer.Sign(rand.Reader, proof)
+}
+
+// VerifyProof checks the signature a guest made of proof with key
+func VerifyProof(key ssh.PublicKey, proof []byte, signature *ssh.Signature) error {
+	// SHA-1 RSA signatures are no longer considered safe
+	if signature.Format == ssh.KeyAlgoRSA {
+		return fmt.Errorf("refusing a SHA-1 RSA signature")
+	}
+	return key.Verify(proof, signature)
+}
+
+// GenerateEphemeralKey generates a one-time X25519 key, from which the
+// session key of an sshkey connection is agreed
+func GenerateEphemeralKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// DeriveEphemeralSessionKey derives the session encryption key from our
+// ephemeral key, the peer's public one and the challenge nonce
+func DeriveEphemeralSessionKey(private *ecdh.PrivateKey, peer, nonce []byte) ([32]byte, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	shared, err := private.ECDH(peerKey)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	derived, err := hkdf.Key(sha256.New, shared, nonce, sshKeyNamespace, 32)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return key, nil
+}
+
+// SSHKeyResponse is a guest's proof that it holds an authorized key
+type SSHKeyResponse struct {
+	PublicKey []byte // the key, in SSH wire format
+	ClientKey []byte // the guest's ephemeral X25519 key
+	Signature []byte // signature of SSHKeyProof, in SSH wire format
+}
+
+// FormatOfferMessage formats key offer message "OFFER:base64-key\n"
+func FormatOfferMessage(key ssh.PublicKey) string {
+	return fmt.Sprintf("OFFER:%s\n", base64.StdEncoding.EncodeToString(key.Marshal()))
+}
+
+// ParseOfferMessage parses key offer message format
+func ParseOfferMessage(msg string) (ssh.PublicKey, error) {
+	msg = strings.TrimSpace(msg)
+	if !strings.HasPrefix(msg, "OFFER:") {
+		return nil, fmt.Errorf("invalid offer message format")
+	}
+
+	wire, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(msg, "OFFER:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 in offer: %v", err)
+	}
+	return ssh.ParsePublicKey(wire)
+}
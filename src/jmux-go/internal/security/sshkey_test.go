@@ -0,0 +1,81 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSigner generates an SSH key and returns it with its
+// authorized_keys entry
+func newTestSigner(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestSSHKeyAuthorize(t *testing.T) {
+	bob, bobLine := newTestSigner(t)
+	anonymous, anonymousLine := newTestSigner(t)
+	forced, forcedLine := newTestSigner(t)
+	stranger, _ := newTestSigner(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	content := bobLine + " bob@laptop\n" +
+		anonymousLine + "\n" +
+		`command="backup.sh" ` + forcedLine + " backups@server\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := NewSSHKeyAuth(&SSHKeyConfig{AuthorizedKeys: path})
+
+	if user, err := auth.Authorize(bob.PublicKey()); err != nil || user != "bob" {
+		t.Errorf("Authorize(bob) = %q, %v; want bob", user, err)
+	}
+	// A key without a comment is known by its fingerprint
+	if user, err := auth.Authorize(anonymous.PublicKey()); err != nil || user != ssh.FingerprintSHA256(anonymous.PublicKey()) {
+		t.Errorf("Authorize(anonymous) = %q, %v; want its fingerprint", user, err)
+	}
+	// A key limited to a forced command must not get a shell
+	if _, err := auth.Authorize(forced.PublicKey()); err == nil {
+		t.Error("Authorize accepted a key restricted to a command")
+	}
+	if _, err := auth.Authorize(stranger.PublicKey()); err == nil {
+		t.Error("Authorize accepted a key that is not in authorized_keys")
+	}
+}
+
+func TestSSHKeyProof(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	serverKey, clientKey := make([]byte, 32), make([]byte, 32)
+
+	proof := SSHKeyProof(nonce, serverKey, clientKey, signer.PublicKey())
+	signature, err := SignProof(signer, proof)
+	if err != nil {
+		t.Fatalf("SignProof failed: %v", err)
+	}
+	if err := VerifyProof(signer.PublicKey(), proof, signature); err != nil {
+		t.Errorf("VerifyProof rejected a good signature: %v", err)
+	}
+
+	// The signature is only good for the connection it was made for
+	clientKey[0] ^= 1
+	other := SSHKeyProof(nonce, serverKey, clientKey, signer.PublicKey())
+	if err := VerifyProof(signer.PublicKey(), other, signature); err == nil {
+		t.Error("VerifyProof accepted a signature made for another connection")
+	}
+}
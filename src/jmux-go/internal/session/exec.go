@@ -0,0 +1,65 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"jmux/internal/jcat"
+	"jmux/internal/security"
+)
+
+// Exec runs argv in hostUser's shared session without a terminal and
+// returns its exit code. The share must allow it with --allow-exec.
+func (m *Manager) Exec(hostUser, sessionName, password string, argv []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	session, err := m.findUserSession(hostUser, sessionName)
+	if err != nil {
+		return jcat.ExitRemoteFailure, err
+	}
+
+	currentUser := os.Getenv("USER")
+	if currentUser == "" {
+		return jcat.ExitRemoteFailure, fmt.Errorf("unable to determine current user")
+	}
+	if session.Private && !m.isUserAllowed(currentUser, session.AllowedUsers) {
+		return jcat.ExitRemoteFailure, fmt.Errorf("access denied: private session")
+	}
+	if !session.AllowExec {
+		return jcat.ExitRemoteFailure, fmt.Errorf("%s has not allowed dmux exec for '%s'", hostUser, session.Name)
+	}
+
+	command := execCommand(argv)
+	addr, _ := m.shareAddr(hostUser, session)
+	clientOpts := jcat.ClientOptions{
+		Mode:        jcat.ModePair,
+		NoReconnect: true,
+		Invite:      m.messaging.FindInvite(hostUser, session.Name),
+	}
+	if session.Method == security.AuthMethodTLS {
+		client, err := m.tlsClient(hostUser, addr, clientOpts)
+		if err != nil {
+			return jcat.ExitRemoteFailure, err
+		}
+		return client.Exec(command, stdin, stdout, stderr)
+	}
+	securityConfig, password, err := m.secureConfig(hostUser, session, password)
+	if err != nil {
+		return jcat.ExitRemoteFailure, err
+	}
+	if securityConfig != nil {
+		client := jcat.NewSecureClientWithOptions(addr, securityConfig, clientOpts)
+		return client.Exec(session.Name, password, command, stdin, stdout, stderr)
+	}
+	client := jcat.NewClientWithOptions(addr, clientOpts)
+	return client.Exec(command, stdin, stdout, stderr)
+}
+
+// execCommand quotes each argument so the host's shell passes argv on whole
+func execCommand(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,66 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jmux/internal/jcat"
+)
+
+// joinSocketPath returns the Unix socket on which guest's dmux join of
+// host's session takes local commands such as send-file
+func joinSocketPath(guest, host, sessionName string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("jmux-join-%s-%s-%s.sock", guest, host, sessionName))
+}
+
+// findJoinSocket finds the socket of a running dmux join. target is
+// "host" or "host/session" and may be empty if only one join is running.
+func findJoinSocket(target string) (string, error) {
+	currentUser := os.Getenv("USER")
+	if currentUser == "" {
+		return "", fmt.Errorf("unable to determine current user")
+	}
+
+	pattern := joinSocketPath(currentUser, "*", "*")
+	if host, name, ok := strings.Cut(target, "/"); ok {
+		pattern = joinSocketPath(currentUser, host, name)
+	} else if target != "" {
+		pattern = joinSocketPath(currentUser, target, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(matches) {
+	case 0:
+		if target != "" {
+			return "", fmt.Errorf("not joined to %s; run dmux join first", target)
+		}
+		return "", fmt.Errorf("not joined to any session; run dmux join first")
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("joined to several sessions; pick one with --session <host-user>[/<session>]")
+	}
+}
+
+// SendFile sends a local file to the host of a joined session
+func (m *Manager) SendFile(target, localPath, remotePath string, opts jcat.TransferOptions) (string, error) {
+	socket, err := findJoinSocket(target)
+	if err != nil {
+		return "", err
+	}
+	return jcat.SendFile(socket, localPath, remotePath, opts)
+}
+
+// GetFile fetches a file from the host of a joined session
+func (m *Manager) GetFile(target, remotePath, localPath string, opts jcat.TransferOptions) (string, error) {
+	socket, err := findJoinSocket(target)
+	if err != nil {
+		return "", err
+	}
+	return jcat.GetFile(socket, remotePath, localPath, opts)
+}
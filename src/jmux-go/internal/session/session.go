@@ -2,18 +2,25 @@ package session
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"golang.org/x/term"
 	"jmux/internal/config"
+	"jmux/internal/invite"
 	"jmux/internal/jcat"
 	"jmux/internal/messaging"
+	"jmux/internal/security"
 )
 
 // Session represents a jmux session
@@ -26,6 +33,69 @@ type Session struct {
 	Private   bool
 	AllowedUsers []string
 	Mode      string // "pair", "view", or "rogue"
+	Secure    bool   // guests must authenticate and traffic is encrypted
+	Method    string // how guests of a secure share authenticate: "password", "tls" or "sshkey"
+	Hub       bool   // guests share a single server-side PTY
+	Record    string // asciicast file the share is recorded to, if any
+	Host      string // hostname of the machine the share runs on
+	Socket    string // Unix socket that guests on the same machine use, if any
+	SocketMode os.FileMode // permissions of Socket
+	Compress  bool   // guests may ask for compressed output
+	NoFiles   bool   // guests may not transfer files
+	AllowForward bool // pair and rogue guests may forward TCP ports
+	ServerPID int    // jcat server process serving the share, once it runs
+	MaxGuests int    // guests connected at once, unlimited if zero
+	MaxPerIP  int    // connections from one IP at once, the server's default if zero
+	AllowExec bool   // pair and rogue guests may run commands with dmux exec
+	Command   string // program shared instead of a tmux session, if any
+	Bind      string // IP address the share listens on, every interface if empty
+	AllowFrom []string // networks guests may connect from, any if empty
+}
+
+// DefaultSocketMode lets every account on the machine reach a share's
+// socket; the server admits them by the account they run as, as it does
+// the guests it has invited
+const DefaultSocketMode os.FileMode = 0666
+
+// ShareOptions holds optional settings for a new share
+type ShareOptions struct {
+	// Hub serves every guest from one shared PTY instead of a shell each
+	Hub bool
+	// Record is an asciicast v2 file to record the guests' terminal output to
+	Record string
+	// Compress lets guests that ask for it receive compressed output
+	Compress bool
+	// NoFiles turns off dmux send-file and get-file for guests
+	NoFiles bool
+	// AllowForward lets pair and rogue guests forward TCP ports with
+	// dmux join -L and -R
+	AllowForward bool
+	// AllowExec lets pair and rogue guests run commands without a terminal
+	// with dmux exec
+	AllowExec bool
+	// MaxGuests caps the guests connected at once; zero means no limit
+	MaxGuests int
+	// MaxPerIP caps the connections from one IP address at once; zero
+	// uses jcat.DefaultMaxConnsPerIP and a negative value means no limit
+	MaxPerIP int
+	// Command is a program to share instead of a tmux session. Guests all
+	// see one running copy, except rogue guests, who get their own.
+	Command string
+	// Bind is the IP address, interface or CIDR to listen on; empty
+	// listens on every interface
+	Bind string
+	// AllowFrom lists the networks guests may connect from, as CIDRs or
+	// addresses; empty allows any
+	AllowFrom []string
+	// SocketMode sets who on this machine may connect to the share's Unix
+	// socket; zero uses DefaultSocketMode
+	SocketMode os.FileMode
+	// InviteTTL is how long invitations stay good; zero uses
+	// invite.DefaultTTL
+	InviteTTL time.Duration
+	// InviteReconnects is how many times an invited guest may join again
+	// with its invitation; resumes and commands do not count
+	InviteReconnects int
 }
 
 // Manager handles session management
@@ -42,13 +112,51 @@ func NewManager(cfg *config.Config, msg *messaging.Messaging) *Manager {
 	}
 }
 
+// DefaultSessionName returns the name used when a share is started without one
+func DefaultSessionName() string {
+	return fmt.Sprintf("session-%d", time.Now().Unix())
+}
+
 // StartShare starts sharing a tmux session
 func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []string, mode string) error {
+	return m.StartShareWithOptions(sessionName, private, inviteUsers, mode, ShareOptions{})
+}
+
+// StartShareWithOptions starts sharing a tmux session with the given options
+func (m *Manager) StartShareWithOptions(sessionName string, private bool, inviteUsers []string, mode string, opts ShareOptions) error {
 	currentUser := os.Getenv("USER")
 	if currentUser == "" {
 		return fmt.Errorf("unable to determine current user")
 	}
 
+	// Catch bad network settings before anything is started
+	bindAddr, err := jcat.ResolveBind(opts.Bind)
+	if err != nil {
+		return err
+	}
+	if _, err := jcat.ParseNetworks(opts.AllowFrom); err != nil {
+		return err
+	}
+	if opts.SocketMode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid socket mode %#o", opts.SocketMode)
+	}
+	if opts.SocketMode == 0 {
+		opts.SocketMode = DefaultSocketMode
+	}
+	if strings.ContainsAny(opts.Command, "\r\n") {
+		return fmt.Errorf("the shared command must be a single line")
+	}
+	if m.config.Security.Enabled && m.config.Security.Method == security.AuthMethodTLS {
+		if _, err := m.config.Security.TLS.ServerConfig(); err != nil {
+			return fmt.Errorf("cannot share over TLS: %v (get a certificate with 'dmux ca issue %s')", err, currentUser)
+		}
+	}
+	if m.config.Security.Enabled && m.config.Security.Method == security.AuthMethodSSHKey {
+		if err := security.NewSSHKeyAuth(m.config.Security.SSHKey).CheckAuthorizedKeys(); err != nil {
+			return fmt.Errorf("cannot share by SSH key: %v (add your guests' public keys to it)", err)
+		}
+	}
+
 	// Find available port
 	port, err := m.findAvailablePort()
 	if err != nil {
@@ -57,14 +165,18 @@ func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []str
 
 	// Generate session name if not provided
 	if sessionName == "" {
-		sessionName = fmt.Sprintf("session-%d", time.Now().Unix())
+		sessionName = DefaultSessionName()
 	}
 
 	// Use provided session name for registration, but get actual tmux session name for reference
 	tmuxSessionName := sessionName
 	actualTmuxSession := ""
 	
-	if m.isInTmuxSession() {
+	if opts.Command != "" {
+		// A shared program is served from one terminal, not through tmux
+		opts.Hub = true
+		color.Blue("📋 Sharing '%s' as '%s'", opts.Command, tmuxSessionName)
+	} else if m.isInTmuxSession() {
 		// Get current tmux session name for reference, but keep user-provided name for sharing
 		cmd := exec.Command("tmux", "display-message", "-p", "#S")
 		output, err := cmd.Output()
@@ -86,6 +198,24 @@ func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []str
 		Private:      private,
 		AllowedUsers: inviteUsers,
 		Mode:         mode,
+		Secure:       m.config.Security.Enabled,
+		Hub:          opts.Hub,
+		Record:       opts.Record,
+		Socket:       socketPath(currentUser, tmuxSessionName),
+		SocketMode:   opts.SocketMode,
+		Compress:     opts.Compress,
+		NoFiles:      opts.NoFiles,
+		AllowForward: opts.AllowForward,
+		MaxGuests:    opts.MaxGuests,
+		MaxPerIP:     opts.MaxPerIP,
+		AllowExec:    opts.AllowExec,
+		Bind:         bindAddr,
+		AllowFrom:    opts.AllowFrom,
+		Command:      opts.Command,
+	}
+	session.Host, _ = os.Hostname()
+	if session.Secure {
+		session.Method = m.config.Security.Method
 	}
 
 	if err := m.registerSession(session); err != nil {
@@ -97,9 +227,19 @@ func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []str
 		color.Yellow("Warning: Failed to update port mapping: %v", err)
 	}
 
-	// Send invitations
+	// Send invitations, each with a token of its own. Those of an earlier
+	// share of the same name are void.
+	inviteTTL := opts.InviteTTL
+	if inviteTTL <= 0 {
+		inviteTTL = invite.DefaultTTL
+	}
+	invites := invite.NewStore(m.InviteStorePath(session))
+	os.Remove(m.InviteStorePath(session))
 	for _, user := range inviteUsers {
-		err := m.messaging.SendMessage(user, messaging.MessageTypeInvite, tmuxSessionName)
+		token, issued, err := invites.Issue(user, tmuxSessionName, inviteTTL, 1+opts.InviteReconnects)
+		if err == nil {
+			err = m.messaging.SendInvite(user, tmuxSessionName, token, issued.Expires)
+		}
 		if err != nil {
 			color.Yellow("Failed to send invitation to %s: %v", user, err)
 		}
@@ -115,20 +255,48 @@ func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []str
 	default:
 		modeDesc = " (pair mode - shared control)"
 	}
-	color.Green("✓ Session '%s' shared on port %d%s", tmuxSessionName, port, modeDesc)
+	if bindAddr != "" {
+		color.Green("✓ Session '%s' shared on %s%s", tmuxSessionName, jcat.ListenAddr(bindAddr, port), modeDesc)
+	} else {
+		color.Green("✓ Session '%s' shared on port %d%s", tmuxSessionName, port, modeDesc)
+	}
+	color.Cyan("🔌 Guests on this machine connect through %s", session.Socket)
+	if opts.Hub && opts.Command == "" {
+		color.Cyan("🔀 All guests share a single server-side terminal")
+	}
+	if opts.Compress {
+		color.Cyan("🗜  Output is compressed for guests that join with --compress")
+	}
+	if len(opts.AllowFrom) > 0 {
+		color.Cyan("🛡  Guests may only connect from %s", strings.Join(opts.AllowFrom, ", "))
+	}
+	if opts.MaxGuests > 0 {
+		color.Cyan("👥 At most %d guests at a time", opts.MaxGuests)
+	}
+	if opts.AllowExec {
+		color.Cyan("⚙  Pair and rogue guests may run commands with dmux exec")
+	}
+	if opts.AllowForward {
+		color.Cyan("🔁 Pair and rogue guests may forward TCP ports (dmux join -L/-R)")
+	}
+	if opts.Record != "" {
+		color.Cyan("⏺  Recording to %s (replay with: dmux replay %s)", opts.Record, opts.Record)
+	}
 	if len(inviteUsers) > 0 {
 		color.Cyan("📧 Invitations sent to: %s", strings.Join(inviteUsers, ", "))
 	}
 
+	// A shared program needs no tmux session, so its server runs right here
+	if opts.Command != "" {
+		color.Cyan("👀 Watch it yourself with: dmux join %s %s", currentUser, tmuxSessionName)
+		color.Yellow("Press Ctrl+C to stop sharing")
+		defer m.unregisterSession(session)
+		return m.RunServer(session, m.config.Security)
+	}
+
 	// If already in tmux, just start the server
 	if m.isInTmuxSession() {
-		if m.config.Security.Enabled {
-			secureServer := jcat.NewSecureServer(fmt.Sprintf(":%d", port), m.config.SetSizeScript, m.config.Security)
-			return secureServer.Start()
-		} else {
-			server := jcat.NewServer(fmt.Sprintf(":%d", port), m.config.SetSizeScript)
-			return server.Start()
-		}
+		return m.RunServer(session, m.config.Security)
 	}
 
 	// Create wrapper script to start jcat server in background
@@ -140,18 +308,28 @@ func (m *Manager) StartShare(sessionName string, private bool, inviteUsers []str
 	// Get the directory containing the jmux-go binary
 	jmuxDir := filepath.Dir(jmuxBinary)
 	
+	// The server reads the share settings back from the session file. Secure
+	// shares hand the password over through the environment rather than the
+	// command line, which other users can read from ps
+	serverEnv := ""
+	if session.Secure && (session.Method == "" || session.Method == security.AuthMethodPassword) {
+		password := security.NewPasswordAuth(m.config.Security).GetPasswordForSession(tmuxSessionName)
+		serverEnv = "JMUX_SHARE_PASSWORD=" + shellQuote(password) + " "
+	}
+
 	wrapperScript := fmt.Sprintf(`#!/bin/bash
 # Add jmux-go binary directory to PATH
 export PATH="%s:$PATH"
 # Start jcat server in background
-%s _internal_jcat_server %d %s &
+%s%s _internal_jcat_server %d %s --session %s &
 # Start a shell
 exec $SHELL
-`, jmuxDir, jmuxBinary, port, m.config.SetSizeScript)
+`, jmuxDir, serverEnv, jmuxBinary, port, m.config.SetSizeScript, shellQuote(tmuxSessionName))
 
-	// Write wrapper script to temp file
+	// Write wrapper script to temp file, readable only by us since it may
+	// carry the share password
 	wrapperPath := filepath.Join(os.TempDir(), fmt.Sprintf("jmux-wrapper-%d.sh", time.Now().UnixNano()))
-	if err := os.WriteFile(wrapperPath, []byte(wrapperScript), 0755); err != nil {
+	if err := os.WriteFile(wrapperPath, []byte(wrapperScript), 0700); err != nil {
 		return fmt.Errorf("failed to create wrapper script: %v", err)
 	}
 	defer os.Remove(wrapperPath) // Clean up on exit
@@ -165,8 +343,131 @@ exec $SHELL
 	return cmd.Run()
 }
 
+// stopTimeout is how long dmux stop waits for a share's server to shut down
+// before killing it
+const stopTimeout = jcat.ShutdownTimeout + 5*time.Second
+
+// RunServer runs the jcat server for a registered session until it fails
+// or is told to stop with SIGTERM or SIGINT
+func (m *Manager) RunServer(session *Session, securityConfig *security.SecurityConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// dmux stop signals the server through the session file
+	session.ServerPID = os.Getpid()
+	if err := m.registerSession(session); err != nil {
+		color.Yellow("Warning: Failed to record the server process: %v", err)
+	}
+
+	allowFrom, err := jcat.ParseNetworks(session.AllowFrom)
+	if err != nil {
+		return err
+	}
+
+	if session.Socket != "" {
+		if err := ensureSocketDir(filepath.Dir(session.Socket)); err != nil {
+			return err
+		}
+	}
+
+	listenAddr := jcat.ListenAddr(session.Bind, session.Port)
+	opts := jcat.ServerOptions{
+		Mode:          session.Mode,
+		Hub:           session.Hub,
+		RecordPath:    session.Record,
+		Socket:        session.Socket,
+		SocketMode:    session.SocketMode,
+		SessionName:   session.Name,
+		StatsPath:     m.GuestStatsPath(session),
+		Compress:      session.Compress,
+		NoFiles:       session.NoFiles,
+		AllowForward:  session.AllowForward,
+		MaxGuests:     session.MaxGuests,
+		MaxConnsPerIP: session.MaxPerIP,
+		AllowExec:     session.AllowExec,
+		AllowFrom:     allowFrom,
+		Shell:         m.config.Shell,
+		AuditPath:     m.config.AuditFile,
+		Command:       session.Command,
+	}
+	if session.Private {
+		opts.AllowedUsers = session.AllowedUsers
+	}
+	// Guests present their invitation, and once a share has sent any, no
+	// one gets in without one
+	opts.InvitePath = m.InviteStorePath(session)
+	opts.RequireInvite = len(session.AllowedUsers) > 0
+
+	if session.Secure && session.Method == security.AuthMethodTLS {
+		tlsConfig, err := securityConfig.TLS.ServerConfig()
+		if err != nil {
+			return err
+		}
+		server := jcat.NewTLSServerWithOptions(listenAddr, m.config.SetSizeScript, tlsConfig, opts)
+		return server.Serve(ctx)
+	}
+	if session.Secure {
+		secureConfig := *securityConfig
+		secureConfig.Enabled = true
+		if session.Method != "" {
+			secureConfig.Method = session.Method
+		}
+		server := jcat.NewSecureServerWithOptions(listenAddr, m.config.SetSizeScript, &secureConfig, opts)
+		return server.Serve(ctx)
+	}
+
+	server := jcat.NewServerWithOptions(listenAddr, m.config.SetSizeScript, opts)
+	return server.Serve(ctx)
+}
+
+// InviteStorePath returns the file the invitations to session are kept in
+func (m *Manager) InviteStorePath(session *Session) string {
+	return filepath.Join(m.config.InvitesDir, session.Name+".json")
+}
+
+// GuestStatsPath returns the file the server of session keeps its guests'
+// latency and throughput in
+func (m *Manager) GuestStatsPath(session *Session) string {
+	return filepath.Join(m.config.SessionsDir, fmt.Sprintf("%s_%s.guests", session.User, session.Name))
+}
+
+// GuestStats returns the guests connected to session, as last reported by
+// its server
+func (m *Manager) GuestStats(session *Session) ([]jcat.GuestStats, error) {
+	guests, err := jcat.ReadGuestStats(m.GuestStatsPath(session))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return guests, err
+}
+
+// FindSession returns the registered session of user with the given name
+func (m *Manager) FindSession(user, sessionName string) (*Session, error) {
+	return m.findUserSession(user, sessionName)
+}
+
+// JoinOptions holds optional settings for joining a session
+type JoinOptions struct {
+	// NoReconnect gives up when the connection drops instead of
+	// reconnecting and resuming the session
+	NoReconnect bool
+	// ShowStats draws latency and throughput in a corner of the terminal
+	ShowStats bool
+	// Compress asks the host to compress the session output
+	Compress bool
+	// LocalForwards carry guest ports to targets reachable from the host
+	LocalForwards []jcat.Forward
+	// RemoteForwards carry host ports to targets reachable from the guest
+	RemoteForwards []jcat.Forward
+}
+
 // JoinSession joins an existing session
 func (m *Manager) JoinSession(hostUser, sessionName string, modeOverride string, password string) error {
+	return m.JoinSessionWithOptions(hostUser, sessionName, modeOverride, password, JoinOptions{})
+}
+
+// JoinSessionWithOptions joins an existing session with the given options
+func (m *Manager) JoinSessionWithOptions(hostUser, sessionName string, modeOverride string, password string, opts JoinOptions) error {
 	// Find the session
 	session, err := m.findUserSession(hostUser, sessionName)
 	if err != nil {
@@ -194,19 +495,28 @@ func (m *Manager) JoinSession(hostUser, sessionName string, modeOverride string,
 		actualMode = "pair"
 	}
 
-	// Check if this is a local session (same user or local connection)
-	if hostUser == currentUser {
+	// Check if this is a local session (same user or local connection).
+	// A shared program has no tmux session to attach to.
+	if hostUser == currentUser && session.Command == "" {
 		// Local session - use direct tmux connection
 		return m.joinLocalSession(session, actualMode)
 	}
 
-	// Remote session - use jcat for now (network connection)
-	// Get host IP (for now, use localhost or try to resolve)
-	hostIP, err := m.resolveHostIP(hostUser)
-	if err != nil {
-		hostIP = "localhost" // fallback
+	// The host enforces its mode, so say up front what the guest will get
+	hostMode := session.Mode
+	if hostMode == "" {
+		hostMode = "pair"
+	}
+	if grantedMode, err := jcat.GrantMode(actualMode, hostMode); err != nil {
+		return err
+	} else if grantedMode != actualMode {
+		color.Yellow("%s shared '%s' in %s mode; joining in %s mode instead of %s", hostUser, session.Name, hostMode, grantedMode, actualMode)
+		actualMode = grantedMode
 	}
 
+	// Remote session - use jcat for now (network connection)
+	addr, where := m.shareAddr(hostUser, session)
+
 	// Display mode-specific connection message
 	var modeDesc string
 	switch actualMode {
@@ -218,15 +528,52 @@ func (m *Manager) JoinSession(hostUser, sessionName string, modeOverride string,
 		modeDesc = " in pair mode (shared control)"
 	}
 	
-	color.Cyan("Connecting to %s's session (%s) at %s:%d%s...", hostUser, session.Name, hostIP, session.Port, modeDesc)
+	color.Cyan("Connecting to %s's session (%s) at %s%s...", hostUser, session.Name, where, modeDesc)
 	color.Yellow("Press Ctrl+C to disconnect")
+	if (len(opts.LocalForwards) > 0 || len(opts.RemoteForwards) > 0) && !session.AllowForward {
+		color.Yellow("%s has not allowed port forwarding for '%s'; forwards will be refused", hostUser, session.Name)
+	}
+	for _, fwd := range opts.LocalForwards {
+		color.Cyan("Forwarding %s to %s on %s's machine", fwd.Listen, fwd.Target, hostUser)
+	}
+	for _, fwd := range opts.RemoteForwards {
+		color.Cyan("Forwarding %s on %s's machine to %s", fwd.Listen, hostUser, fwd.Target)
+	}
+	if !session.NoFiles {
+		color.Cyan("Transfer files from another terminal: dmux send-file <path>, dmux get-file <remote-path>")
+	}
 
 	// Connect with jcat client using the specified mode
-	if m.config.Security.Enabled {
-		secureClient := jcat.NewSecureClientWithMode(fmt.Sprintf("%s:%d", hostIP, session.Port), actualMode, m.config.Security)
-		return secureClient.Connect(sessionName, password)
+	clientOpts := jcat.ClientOptions{
+		Mode:        actualMode,
+		NoReconnect: opts.NoReconnect,
+		ShowStats:   opts.ShowStats,
+		Compress:    opts.Compress,
+		LocalSocket: joinSocketPath(currentUser, hostUser, session.Name),
+
+		LocalForwards:  opts.LocalForwards,
+		RemoteForwards: opts.RemoteForwards,
+	}
+	// Present the invitation to the share from our inbox, if we have one
+	if clientOpts.Invite = m.messaging.FindInvite(hostUser, session.Name); clientOpts.Invite != "" {
+		color.Cyan("Joining with %s's invitation", hostUser)
+	}
+	if session.Method == security.AuthMethodTLS {
+		client, err := m.tlsClient(hostUser, addr, clientOpts)
+		if err != nil {
+			return err
+		}
+		return client.Connect()
+	}
+	securityConfig, password, err := m.secureConfig(hostUser, session, password)
+	if err != nil {
+		return err
+	}
+	if securityConfig != nil {
+		secureClient := jcat.NewSecureClientWithOptions(addr, securityConfig, clientOpts)
+		return secureClient.Connect(session.Name, password)
 	} else {
-		client := jcat.NewClientWithMode(fmt.Sprintf("%s:%d", hostIP, session.Port), actualMode)
+		client := jcat.NewClientWithOptions(addr, clientOpts)
 		return client.Connect()
 	}
 }
@@ -297,6 +644,9 @@ func (m *Manager) ListSessions() error {
 		fmt.Printf("\n")
 		color.Cyan("User: %s", session.User)
 		fmt.Printf("  Session: %s\n", session.Name)
+		if session.Command != "" {
+			fmt.Printf("  Command: %s\n", session.Command)
+		}
 		fmt.Printf("  Port: %d\n", session.Port)
 		fmt.Printf("  Started: %s (%s ago)\n", startTime.Format("15:04:05"), duration)
 
@@ -362,7 +712,24 @@ PID=%d
 PRIVATE=%t
 ALLOWED_USERS=%s
 MODE=%s
-`, session.User, session.Name, session.Port, session.Started, session.PID, session.Private, strings.Join(session.AllowedUsers, ","), session.Mode)
+SECURE=%t
+METHOD=%s
+HUB=%t
+RECORD=%s
+HOST=%s
+SOCKET=%s
+SOCKET_MODE=%#o
+COMPRESS=%t
+NOFILES=%t
+FORWARD=%t
+SERVER_PID=%d
+MAX_GUESTS=%d
+MAX_PER_IP=%d
+EXEC=%t
+BIND=%s
+ALLOW_FROM=%s
+COMMAND=%s
+`, session.User, session.Name, session.Port, session.Started, session.PID, session.Private, strings.Join(session.AllowedUsers, ","), session.Mode, session.Secure, session.Method, session.Hub, session.Record, session.Host, session.Socket, uint32(session.SocketMode), session.Compress, session.NoFiles, session.AllowForward, session.ServerPID, session.MaxGuests, session.MaxPerIP, session.AllowExec, session.Bind, strings.Join(session.AllowFrom, ","), session.Command)
 
 	return os.WriteFile(filePath, []byte(content), 0644)
 }
@@ -476,6 +843,50 @@ func (m *Manager) readSessionFile(filePath string) (*Session, error) {
 			}
 		case "MODE":
 			session.Mode = value
+		case "SECURE":
+			session.Secure = value == "true"
+		case "METHOD":
+			session.Method = value
+		case "HUB":
+			session.Hub = value == "true"
+		case "RECORD":
+			session.Record = value
+		case "HOST":
+			session.Host = value
+		case "SOCKET":
+			session.Socket = value
+		case "SOCKET_MODE":
+			if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+				session.SocketMode = os.FileMode(mode) & os.ModePerm
+			}
+		case "COMPRESS":
+			session.Compress = value == "true"
+		case "NOFILES":
+			session.NoFiles = value == "true"
+		case "FORWARD":
+			session.AllowForward = value == "true"
+		case "SERVER_PID":
+			if pid, err := strconv.Atoi(value); err == nil {
+				session.ServerPID = pid
+			}
+		case "MAX_GUESTS":
+			if n, err := strconv.Atoi(value); err == nil {
+				session.MaxGuests = n
+			}
+		case "MAX_PER_IP":
+			if n, err := strconv.Atoi(value); err == nil {
+				session.MaxPerIP = n
+			}
+		case "EXEC":
+			session.AllowExec = value == "true"
+		case "BIND":
+			session.Bind = value
+		case "COMMAND":
+			session.Command = value
+		case "ALLOW_FROM":
+			if value != "" {
+				session.AllowFrom = strings.Split(value, ",")
+			}
 		}
 	}
 
@@ -485,14 +896,36 @@ func (m *Manager) readSessionFile(filePath string) (*Session, error) {
 func (m *Manager) stopSession(session *Session) {
 	color.Yellow("Stopping sharing for session '%s'...", session.Name)
 
-	// Find and kill only the jcat server process, not the tmux session
-	cmd := exec.Command("pkill", "-f", fmt.Sprintf("_internal_jcat_server %d", session.Port))
-	if err := cmd.Run(); err != nil {
-		// Try alternative method using lsof and port
-		cmd = exec.Command("sh", "-c", fmt.Sprintf("lsof -ti:%d | xargs -r kill", session.Port))
-		cmd.Run() // Ignore errors - process might already be dead
+	// Stop only the jcat server process, not the tmux session. Shares
+	// started before servers recorded their pid are found by port.
+	if !m.stopServer(session) {
+		cmd := exec.Command("pkill", "-f", fmt.Sprintf("_internal_jcat_server %d", session.Port))
+		if err := cmd.Run(); err != nil {
+			// Try alternative method using lsof and port
+			cmd = exec.Command("sh", "-c", fmt.Sprintf("lsof -ti:%d | xargs -r kill", session.Port))
+			cmd.Run() // Ignore errors - process might already be dead
+		}
 	}
 
+	m.unregisterSession(session)
+
+	if session.Command != "" {
+		color.Green("✓ Sharing stopped for '%s'", session.Name)
+		return
+	}
+	color.Green("✓ Sharing stopped for session '%s' (tmux session remains active)", session.Name)
+}
+
+// unregisterSession removes everything a share leaves behind: its session
+// file, port mapping, guest stats, and the socket of a server killed before
+// it could clean up
+func (m *Manager) unregisterSession(session *Session) {
+	if session.Socket != "" {
+		os.Remove(session.Socket)
+	}
+	os.Remove(m.GuestStatsPath(session))
+	os.Remove(m.InviteStorePath(session))
+
 	// Remove session file
 	fileName := fmt.Sprintf("%s_%s.session", session.User, session.Name)
 	filePath := filepath.Join(m.config.SessionsDir, fileName)
@@ -502,8 +935,85 @@ func (m *Manager) stopSession(session *Session) {
 	if err := m.removePortMapping(session.Port); err != nil {
 		color.Yellow("Warning: Failed to update port mapping: %v", err)
 	}
+}
 
-	color.Green("✓ Sharing stopped for session '%s' (tmux session remains active)", session.Name)
+// stopServer asks the share's jcat server to shut down, which tells its
+// guests the share has ended, and waits for it to exit, killing it if it
+// takes longer than stopTimeout. It reports false if the session does not
+// say which process its server is.
+func (m *Manager) stopServer(session *Session) bool {
+	if session.ServerPID <= 0 {
+		return false
+	}
+	if err := syscall.Kill(session.ServerPID, syscall.SIGTERM); err != nil {
+		// Already gone
+		return true
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(session.ServerPID, 0) != nil {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	color.Yellow("Server of '%s' did not shut down in time, killing it", session.Name)
+	syscall.Kill(session.ServerPID, syscall.SIGKILL)
+	return true
+}
+
+// shareAddr returns the address to reach hostUser's share at, and how to
+// show it
+func (m *Manager) shareAddr(hostUser string, session *Session) (addr, where string) {
+	// Get host IP (for now, use localhost or try to resolve)
+	hostIP, err := m.resolveHostIP(hostUser)
+	if err != nil {
+		hostIP = "localhost" // fallback
+	}
+	// A share bound to one address is only reachable there
+	if ip := net.ParseIP(session.Bind); ip != nil && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() {
+		hostIP = session.Bind
+	}
+	addr = jcat.ListenAddr(hostIP, session.Port)
+
+	// A share on this machine is reachable without going through TCP
+	if m.isLocalShare(session) {
+		return jcat.UnixPrefix + session.Socket, session.Socket
+	}
+	return addr, addr
+}
+
+// secureConfig returns the security settings for connecting to a secure
+// share, prompting for its password unless one is given or configured or
+// the share authenticates by SSH key, or nil if the share is not secure
+func (m *Manager) secureConfig(hostUser string, session *Session, password string) (*security.SecurityConfig, string, error) {
+	if !session.Secure && !m.config.Security.Enabled {
+		return nil, password, nil
+	}
+	securityConfig := *m.config.Security
+	securityConfig.Enabled = true
+	if session.Method == security.AuthMethodSSHKey {
+		securityConfig.Method = security.AuthMethodSSHKey
+		return &securityConfig, "", nil
+	}
+	if password == "" && security.NewPasswordAuth(&securityConfig).GetPasswordForSession(session.Name) == "" {
+		var err error
+		password, err = promptPassword(fmt.Sprintf("Password for %s's session '%s': ", hostUser, session.Name))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return &securityConfig, password, nil
+}
+
+// tlsClient returns a client that joins a share of hostUser over mutual TLS
+// with this user's team certificate
+func (m *Manager) tlsClient(hostUser, addr string, opts jcat.ClientOptions) (*jcat.Client, error) {
+	tlsConfig, err := m.config.Security.TLS.ClientConfig(hostUser)
+	if err != nil {
+		return nil, fmt.Errorf("%s's share needs a team certificate: %v (request one with 'dmux ca request')", hostUser, err)
+	}
+	return jcat.NewTLSClientWithOptions(addr, tlsConfig, opts), nil
 }
 
 func (m *Manager) isUserAllowed(user string, allowedUsers []string) bool {
@@ -526,20 +1036,104 @@ func (m *Manager) resolveHostIP(hostUser string) (string, error) {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) >= 2 && parts[0] == hostUser {
-			return parts[1], nil
+		user, host, ok := parseUserEntry(scanner.Text())
+		if ok && user == hostUser {
+			return host, nil
 		}
 	}
 
 	return "", fmt.Errorf("user %s not found", hostUser)
 }
 
+// parseUserEntry splits a users.db line, "user:host" optionally followed by
+// ":timestamp". An IPv6 host is written in brackets, as in
+// "alice:[fd00::5]:1700000000"; a bare one is only understood without a
+// timestamp.
+func parseUserEntry(line string) (user, host string, ok bool) {
+	user, rest, ok := strings.Cut(line, ":")
+	if !ok || user == "" {
+		return "", "", false
+	}
+	if bracketed, ok := strings.CutPrefix(rest, "["); ok {
+		host, _, ok = strings.Cut(bracketed, "]")
+		return user, host, ok && host != ""
+	}
+	if net.ParseIP(rest) != nil {
+		return user, rest, true
+	}
+	host, _, _ = strings.Cut(rest, ":")
+	return user, host, host != ""
+}
+
+// socketPath returns the Unix socket a share of user's session listens on,
+// in a directory only user may add to
+func socketPath(user, sessionName string) string {
+	return filepath.Join(os.TempDir(), "jmux-"+user, sessionName+".sock")
+}
+
+// ensureSocketDir creates the directory our share sockets are kept in,
+// which others may reach a socket in but not list or change, refusing one
+// that somebody else made or that others may change
+func ensureSocketDir(dir string) error {
+	if err := os.Mkdir(dir, 0711); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is not a directory only you can change; remove it and share again", dir)
+	}
+	// Guests on this machine must be able to reach the socket in it
+	return os.Chmod(dir, 0711)
+}
+
+// isLocalShare reports whether session is served from this machine through
+// a socket that is still there and that its mode lets us connect to
+func (m *Manager) isLocalShare(session *Session) bool {
+	if session.Socket == "" || session.Host == "" {
+		return false
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname != session.Host {
+		return false
+	}
+	info, err := os.Stat(session.Socket)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	// Connecting takes write permission on the socket
+	const writeOK = 0x2 // W_OK
+	return syscall.Access(session.Socket, writeOK) == nil
+}
+
 func (m *Manager) isInTmuxSession() bool {
 	return os.Getenv("TMUX") != ""
 }
 
+// shellQuote quotes s for safe interpolation into a bash script
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// promptPassword reads a password from the terminal without echoing it
+func promptPassword(prompt string) (string, error) {
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return "", fmt.Errorf("session requires a password (use --password)")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	return string(password), nil
+}
+
 // joinLocalSession joins a local session using direct tmux commands
 func (m *Manager) joinLocalSession(session *Session, mode string) error {
 	// For local sessions, we first try to find the session in the default tmux server
@@ -0,0 +1,253 @@
+// Package jcat lets other programs host and join dmux shares. A Server
+// serves guests from any net.Listener or net.Conn, and a Client joins a
+// share over any connection with any reader and writer as its terminal, so
+// neither needs the process's own terminal, and both can run in-process.
+package jcat
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"jmux/internal/jcat"
+	"jmux/internal/security"
+)
+
+// Sharing modes a guest can join in
+const (
+	ModePair  = jcat.ModePair  // everyone types into the same session
+	ModeView  = jcat.ModeView  // the guest only watches
+	ModeRogue = jcat.ModeRogue // the guest gets its own session on the same tmux server
+)
+
+// Version is the jcat release plain servers announce in their banner,
+// kept at 2.0.0 for older clients
+const Version = jcat.JcatVersion
+
+// Protocol is the handshake protocol spoken by servers and clients
+const Protocol = jcat.ProtocolVersion
+
+// WinSize is the size of a guest's terminal window
+type WinSize = jcat.WinSize
+
+// ServerOptions configures a Server. The zero value shares an interactive
+// shell in pair mode without a password.
+type ServerOptions struct {
+	// Mode is the most a guest may get; guests asking for more are
+	// downgraded to it. Defaults to ModePair.
+	Mode string
+
+	// RCFile is a bash script every guest's shell sources first, usually
+	// to attach to a tmux session. Empty starts the shell directly.
+	RCFile string
+
+	// Shell is the guest shell. Defaults to the user's login shell.
+	Shell string
+
+	// Command is a program to share instead of the shell, run with Shell -c
+	Command string
+
+	// Hub runs a single PTY shared by every guest instead of one per guest
+	Hub bool
+
+	// SessionName names the share. Guests of a secure server give it when
+	// they authenticate.
+	SessionName string
+
+	// Password makes the server require the secure handshake: guests must
+	// prove they know it, and the connection is encrypted
+	Password string
+
+	// AllowExec lets pair and rogue guests run commands without a terminal
+	AllowExec bool
+
+	// AllowForward lets pair and rogue guests forward TCP ports
+	AllowForward bool
+
+	// NoFiles refuses file transfers
+	NoFiles bool
+
+	// Compress lets guests that ask for it receive compressed output
+	Compress bool
+
+	// MaxGuests caps the guests connected at once. Zero means no limit.
+	MaxGuests int
+
+	// MaxConnsPerIP caps the connections from one IP address at once. Zero
+	// uses the dmux default; a negative value means no limit.
+	MaxConnsPerIP int
+
+	// AllowFrom lists the networks TCP guests may connect from. Empty
+	// allows any.
+	AllowFrom []*net.IPNet
+
+	// HandshakeTimeout bounds each phase of a guest's handshake. Zero uses
+	// the dmux default.
+	HandshakeTimeout time.Duration
+
+	// ResumeGrace is how long a disconnected guest's shell is kept for it
+	// to resume. Zero uses the dmux default; negative closes it right away.
+	ResumeGrace time.Duration
+
+	// AuditPath is a log that guests joining, leaving and being refused
+	// are recorded in, in the format dmux audit reads. Empty records
+	// nothing.
+	AuditPath string
+
+	// Logger is where the server logs connections and errors. Defaults to
+	// the standard logger.
+	Logger *log.Logger
+}
+
+// server is what both the plain and the secure internal servers do
+type server interface {
+	ServeListener(ctx context.Context, ln net.Listener) error
+	ServeConn(conn net.Conn)
+	Shutdown(ctx context.Context) error
+}
+
+// Server hosts a share for the guests it is given connections from
+type Server struct {
+	server server
+}
+
+// NewServer creates a server with the given options
+func NewServer(opts ServerOptions) *Server {
+	internal := jcat.ServerOptions{
+		Mode:             opts.Mode,
+		Shell:            opts.Shell,
+		Command:          opts.Command,
+		Hub:              opts.Hub,
+		SessionName:      opts.SessionName,
+		AllowExec:        opts.AllowExec,
+		AllowForward:     opts.AllowForward,
+		NoFiles:          opts.NoFiles,
+		Compress:         opts.Compress,
+		MaxGuests:        opts.MaxGuests,
+		MaxConnsPerIP:    opts.MaxConnsPerIP,
+		AllowFrom:        opts.AllowFrom,
+		HandshakeTimeout: opts.HandshakeTimeout,
+		ResumeGrace:      opts.ResumeGrace,
+		AuditPath:        opts.AuditPath,
+		Logger:           opts.Logger,
+	}
+	if opts.Password != "" {
+		return &Server{server: jcat.NewSecureServerWithOptions("", opts.RCFile, securityConfig(opts.Password), internal)}
+	}
+	return &Server{server: jcat.NewServerWithOptions("", opts.RCFile, internal)}
+}
+
+// Serve serves guests from ln until ctx is done, then shuts the server
+// down, giving guests a few seconds to go. The server closes ln.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return s.server.ServeListener(ctx, ln)
+}
+
+// ServeConn serves the guest on conn and returns once it is gone
+func (s *Server) ServeConn(conn net.Conn) {
+	s.server.ServeConn(conn)
+}
+
+// Shutdown stops accepting guests, tells the connected ones that the share
+// has ended and waits for them to go. If ctx is done first, whatever is
+// left is killed and ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// ClientOptions configures a Client
+type ClientOptions struct {
+	// Mode is the sharing mode to ask for. Defaults to ModePair.
+	Mode string
+
+	// User is who is joining, as told to the host. Defaults to $USER.
+	User string
+
+	// Password authenticates to a server that has one
+	Password string
+
+	// SessionName is the share to authenticate for on a secure server
+	SessionName string
+
+	// NoReconnect gives up as soon as the connection drops instead of
+	// reconnecting and resuming the session
+	NoReconnect bool
+
+	// Compress asks for compressed output
+	Compress bool
+
+	// Dial opens the connection to the server, for reconnects too, instead
+	// of dialing the client's address
+	Dial func() (net.Conn, error)
+
+	// Logger is where the client logs reconnects and errors. Defaults to
+	// the standard logger.
+	Logger *log.Logger
+}
+
+// Client joins a share
+type Client struct {
+	addr string
+	opts ClientOptions
+}
+
+// NewClient creates a client for the share at addr, a host:port or
+// "unix:" followed by a socket path. addr is unused if opts.Dial is set.
+func NewClient(addr string, opts ClientOptions) *Client {
+	return &Client{addr: addr, opts: opts}
+}
+
+// Attach joins the share with terminal as the guest's terminal: what is
+// read from it is typed into the share and the share's output is written
+// to it. sizes reports the terminal's size, its current one first; if it
+// is nil the terminal is taken to be 80x24. Attach returns when the shared
+// program exits, terminal reaches EOF or the connection is lost for good.
+func (c *Client) Attach(terminal io.ReadWriter, sizes <-chan WinSize) error {
+	if c.opts.Password != "" {
+		return c.secure().ConnectTerminal(c.opts.SessionName, c.opts.Password, terminal, terminal, sizes)
+	}
+	return c.plain().ConnectTerminal(terminal, terminal, sizes)
+}
+
+// Exec runs command with the host's shell without a terminal, feeding it
+// stdin if that is not nil and copying its output to stdout and stderr. It
+// returns the command's exit code. The server must allow exec.
+func (c *Client) Exec(command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if c.opts.Password != "" {
+		return c.secure().Exec(c.opts.SessionName, c.opts.Password, command, stdin, stdout, stderr)
+	}
+	return c.plain().Exec(command, stdin, stdout, stderr)
+}
+
+// options returns the internal client options
+func (c *Client) options() jcat.ClientOptions {
+	return jcat.ClientOptions{
+		Mode:        c.opts.Mode,
+		User:        c.opts.User,
+		NoReconnect: c.opts.NoReconnect,
+		Compress:    c.opts.Compress,
+		Dial:        c.opts.Dial,
+		Logger:      c.opts.Logger,
+	}
+}
+
+// plain returns a fresh internal client for a server without a password
+func (c *Client) plain() *jcat.Client {
+	return jcat.NewClientWithOptions(c.addr, c.options())
+}
+
+// secure returns a fresh internal client for a server with a password
+func (c *Client) secure() *jcat.SecureClient {
+	return jcat.NewSecureClientWithOptions(c.addr, securityConfig(c.opts.Password), c.options())
+}
+
+// securityConfig returns a secure handshake configuration with password
+// for every session
+func securityConfig(password string) *security.SecurityConfig {
+	config := security.DefaultSecurityConfig()
+	config.Enabled = true
+	config.GlobalPassword = password
+	return config
+}
@@ -0,0 +1,114 @@
+package jcat
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to write and read concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAttachOverPipe(t *testing.T) {
+	var logs syncBuffer
+	server := NewServer(ServerOptions{
+		Command: "echo shared-output",
+		Logger:  log.New(&logs, "", 0),
+	})
+
+	serverEnd, clientEnd := net.Pipe()
+	go server.ServeConn(serverEnd)
+	dialed := false
+	client := NewClient("", ClientOptions{
+		NoReconnect: true,
+		Logger:      log.New(io.Discard, "", 0),
+		Dial: func() (net.Conn, error) {
+			if dialed {
+				return nil, io.EOF
+			}
+			dialed = true
+			return clientEnd, nil
+		},
+	})
+
+	// The terminal's input stays open, so only the program exiting ends it
+	in, typing := io.Pipe()
+	defer typing.Close()
+	var out syncBuffer
+	terminal := struct {
+		io.Reader
+		io.Writer
+	}{in, &out}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Attach(terminal, nil) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Attach did not return after the shared program exited")
+	}
+	if !strings.Contains(out.String(), "shared-output") {
+		t.Errorf("terminal output = %q, want the program's output", out.String())
+	}
+	if !strings.Contains(logs.String(), "pipe") {
+		t.Errorf("server log = %q, want the guest logged to the given logger", logs.String())
+	}
+}
+
+func TestSecureExec(t *testing.T) {
+	server := NewServer(ServerOptions{
+		SessionName: "embedded",
+		Password:    "hunter2",
+		AllowExec:   true,
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	}()
+
+	opts := ClientOptions{SessionName: "embedded", Password: "hunter2", Logger: log.New(io.Discard, "", 0)}
+	var stdout, stderr bytes.Buffer
+	code, err := NewClient(ln.Addr().String(), opts).Exec("echo hello; exit 4", nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if code != 4 || stdout.String() != "hello\n" {
+		t.Errorf("Exec = %d with stdout %q, want 4 with %q", code, stdout.String(), "hello\n")
+	}
+
+	opts.Password = "wrong"
+	if _, err := NewClient(ln.Addr().String(), opts).Exec("true", nil, &stdout, &stderr); err == nil {
+		t.Error("Exec with the wrong password succeeded")
+	}
+}